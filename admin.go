@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+// adminPauseReason is the reason the launch gate is paused for when an
+// operator pauses launches through the admin API.
+const adminPauseReason = "paused by an operator"
+
+// adminFiles lists the files in a submission directory that the admin API
+// will serve. The irods-config file and the job config file are left out
+// because they contain credentials.
+var adminFiles = []string{"iplant.cmd", "config.json", "job"}
+
+// launchView is the representation of an in-flight launch returned by the
+// admin API.
+type launchView struct {
+	InvocationID  string             `json:"invocation_id"`
+	SubmissionDir string             `json:"submission_dir"`
+	ClusterID     string             `json:"cluster_id"`
+	State         messaging.JobState `json:"state"`
+	Time          time.Time          `json:"time"`
+	Files         []string           `json:"files,omitempty"`
+}
+
+func newLaunchView(entry JournalEntry) launchView {
+	return launchView{
+		InvocationID:  entry.InvocationID,
+		SubmissionDir: entry.SubmissionDir,
+		ClusterID:     entry.ClusterID,
+		State:         entry.State,
+		Time:          entry.Time,
+	}
+}
+
+// adminAPI serves the HTTP API that operators use to inspect and control a
+// running launcher. If condor.admin.token is set, every route requires it as
+// a bearer token.
+//
+//	GET  /launches                     lists the in-flight launches
+//	GET  /launches/{id}                describes a single launch
+//	GET  /launches/{id}/files/{name}   returns a rendered submission file
+//	POST /launches/{id}/stop           stops a job
+//	POST /held-jobs/sweep              applies the held job policy right away
+//	GET  /consumer                     reports whether launches are paused
+//	POST /consumer/pause               stops handling launch requests
+//	POST /consumer/resume              resumes handling launch requests
+//	GET  /metrics                      returns the metrics in the Prometheus format
+type adminAPI struct {
+	cl *CondorLauncher
+}
+
+// newAdminAPI returns an http.Handler for the admin API of a launcher.
+func newAdminAPI(cl *CondorLauncher) http.Handler {
+	return &adminAPI{cl: cl}
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to write an admin API response"))
+	}
+}
+
+// writeError writes a JSON error response.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// requireMethod writes an error response and returns false if the request
+// doesn't use the given method.
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("use %s for %s", method, r.URL.Path))
+		return false
+	}
+	return true
+}
+
+// isLoopbackAddr returns true if a listen address only accepts connections
+// from the local host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorize writes an error response and returns false if the admin token is
+// set and the request doesn't carry it as a bearer token.
+func (a *adminAPI) authorize(w http.ResponseWriter, r *http.Request) bool {
+	token := a.cl.config().GetString("condor.admin.token")
+	if token == "" {
+		return true
+	}
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, prefix) &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(token)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="condor-launcher"`)
+	writeError(w, http.StatusUnauthorized, "a valid bearer token is required")
+	return false
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "launches":
+		if requireMethod(w, r, http.MethodGet) {
+			a.listLaunches(w)
+		}
+	case len(parts) == 2 && parts[0] == "launches":
+		if requireMethod(w, r, http.MethodGet) {
+			a.getLaunch(w, parts[1])
+		}
+	case len(parts) == 4 && parts[0] == "launches" && parts[2] == "files":
+		if requireMethod(w, r, http.MethodGet) {
+			a.getLaunchFile(w, parts[1], parts[3])
+		}
+	case len(parts) == 3 && parts[0] == "launches" && parts[2] == "stop":
+		if requireMethod(w, r, http.MethodPost) {
+			a.stopLaunch(w, parts[1])
+		}
+	case len(parts) == 2 && parts[0] == "held-jobs" && parts[1] == "sweep":
+		if requireMethod(w, r, http.MethodPost) {
+			handleHeldJobs(a.cl)
+			writeJSON(w, http.StatusOK, map[string]string{"status": "swept"})
+		}
+	case len(parts) == 1 && parts[0] == "metrics":
+		if requireMethod(w, r, http.MethodGet) {
+			metricsHandler.ServeHTTP(w, r)
+		}
+	case len(parts) == 1 && parts[0] == "consumer":
+		if requireMethod(w, r, http.MethodGet) {
+			a.consumerStatus(w)
+		}
+	case len(parts) == 2 && parts[0] == "consumer" && parts[1] == "pause":
+		if requireMethod(w, r, http.MethodPost) {
+			log.Warnln("launch requests were paused through the admin API")
+			a.cl.launchGate.Pause(adminPauseReason)
+			a.consumerStatus(w)
+		}
+	case len(parts) == 2 && parts[0] == "consumer" && parts[1] == "resume":
+		if requireMethod(w, r, http.MethodPost) {
+			log.Warnln("launch requests were resumed through the admin API")
+			a.cl.launchGate.Resume(adminPauseReason)
+			a.consumerStatus(w)
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s was not found", r.URL.Path))
+	}
+}
+
+func (a *adminAPI) listLaunches(w http.ResponseWriter) {
+	entries := a.cl.journal.Entries()
+	retval := make([]launchView, 0, len(entries))
+	for _, entry := range entries {
+		retval = append(retval, newLaunchView(entry))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"launches": retval})
+}
+
+func (a *adminAPI) getLaunch(w http.ResponseWriter, invocationID string) {
+	entry, ok := a.cl.journal.Entry(invocationID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("job %s is not in flight", invocationID))
+		return
+	}
+	view := newLaunchView(entry)
+	for _, name := range adminFiles {
+		if _, err := os.Stat(path.Join(entry.SubmissionDir, name)); err == nil {
+			view.Files = append(view.Files, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (a *adminAPI) getLaunchFile(w http.ResponseWriter, invocationID, name string) {
+	entry, ok := a.cl.journal.Entry(invocationID)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("job %s is not in flight", invocationID))
+		return
+	}
+
+	allowed := false
+	for _, f := range adminFiles {
+		if f == name {
+			allowed = true
+		}
+	}
+	if !allowed {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s is not a submission file", name))
+		return
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(entry.SubmissionDir, name))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("job %s has no %s file", invocationID, name))
+		return
+	}
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to read %s for job %s", name, invocationID))
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(contents)
+}
+
+func (a *adminAPI) stopLaunch(w http.ResponseWriter, invocationID string) {
+	if err := validateInvocationID(invocationID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Warnf("job %s is being stopped through the admin API", invocationID)
+	if err := a.cl.stopJob(invocationID); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "stopped"})
+}
+
+func (a *adminAPI) consumerStatus(w http.ResponseWriter) {
+	reasons := a.cl.launchGate.Reasons()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"paused":  len(reasons) > 0,
+		"reasons": reasons,
+	})
+}
+
+// startAdminServer starts serving the admin API on the given address.
+func startAdminServer(cl *CondorLauncher, addr string) *http.Server {
+	server := &http.Server{Addr: addr, Handler: newAdminAPI(cl)}
+	go func() {
+		log.Infof("serving the admin API on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("%+v\n", errors.Wrap(err, "the admin API server failed"))
+		}
+	}()
+	return server
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestAdminAPILaunches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"iplant.cmd", "irods-config", "config"} {
+		if err = ioutil.WriteFile(path.Join(dir, name), []byte(name+" contents"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := test.InitConfig(t)
+	cl := New(cfg, newtmessenger(), newtsys(), newtscheduler())
+	cl.journal.Record(JournalEntry{InvocationID: "job", SubmissionDir: dir, ClusterID: "10000", State: messaging.SubmittedState})
+	h := newAdminAPI(cl)
+
+	w := adminRequest(t, h, http.MethodGet, "/launches")
+	var list struct {
+		Launches []launchView `json:"launches"`
+	}
+	if err = json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Launches) != 1 || list.Launches[0].InvocationID != "job" || list.Launches[0].SubmissionDir != dir {
+		t.Errorf("unexpected launch list: %#v", list.Launches)
+	}
+
+	w = adminRequest(t, h, http.MethodGet, "/launches/job")
+	var view launchView
+	if err = json.NewDecoder(w.Body).Decode(&view); err != nil {
+		t.Fatal(err)
+	}
+	if len(view.Files) != 1 || view.Files[0] != "iplant.cmd" {
+		t.Errorf("the launch listed the files %v instead of [iplant.cmd]", view.Files)
+	}
+
+	w = adminRequest(t, h, http.MethodGet, "/launches/job/files/iplant.cmd")
+	if w.Code != http.StatusOK || w.Body.String() != "iplant.cmd contents" {
+		t.Errorf("unexpected iplant.cmd response: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, target := range []string{
+		"/launches/job/files/irods-config",
+		"/launches/job/files/config",
+		"/launches/job/files/..%2firods-config",
+		"/launches/missing",
+		"/launches/missing/files/iplant.cmd",
+	} {
+		if w = adminRequest(t, h, http.MethodGet, target); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s returned %d instead of %d", target, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestAdminAPIStop(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+	h := newAdminAPI(cl)
+
+	id := "571722aa-f46c-40fd-a688-69068fb52ee1"
+
+	if w := adminRequest(t, h, http.MethodGet, "/launches/"+id+"/stop"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned %d instead of %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if w := adminRequest(t, h, http.MethodPost, "/launches/job/stop"); w.Code != http.StatusBadRequest {
+		t.Errorf("stopping an invalid invocation ID returned %d", w.Code)
+	}
+
+	w := adminRequest(t, h, http.MethodPost, "/launches/"+id+"/stop")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST returned %d: %s", w.Code, w.Body.String())
+	}
+	if len(scheduler.removed) != 1 || scheduler.removed[0] != ipcUUIDConstraint(id) {
+		t.Errorf("unexpected removals: %v", scheduler.removed)
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState {
+		t.Errorf("unexpected updates: %#v", client.updates)
+	}
+}
+
+func TestAdminAPISweep(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	cl := New(cfg, newtmessenger(), newtsys(), scheduler)
+	scheduler.queue = []JobAd{{"IpcUuid": "571722aa-f46c-40fd-a688-69068fb52ee1", "ClusterId": "10000", "HoldReasonCode": "1"}}
+
+	w := adminRequest(t, newAdminAPI(cl), http.MethodPost, "/held-jobs/sweep")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST returned %d: %s", w.Code, w.Body.String())
+	}
+	if len(scheduler.removed) != 1 {
+		t.Errorf("the held job wasn't removed: %v", scheduler.removed)
+	}
+}
+
+func TestAdminAPIPause(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cl := New(cfg, newtmessenger(), newtsys(), newtscheduler())
+	h := newAdminAPI(cl)
+
+	w := adminRequest(t, h, http.MethodPost, "/consumer/pause")
+	if !strings.Contains(w.Body.String(), `"paused":true`) {
+		t.Errorf("unexpected pause response: %s", w.Body.String())
+	}
+	if waitReturns(cl.launchGate) {
+		t.Error("the launch gate is open after pausing")
+	}
+
+	w = adminRequest(t, h, http.MethodPost, "/consumer/resume")
+	if !strings.Contains(w.Body.String(), `"paused":false`) {
+		t.Errorf("unexpected resume response: %s", w.Body.String())
+	}
+	if !waitReturns(cl.launchGate) {
+		t.Error("the launch gate is closed after resuming")
+	}
+}
+
+func TestAdminAPIToken(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cfg.Set("condor.admin.token", "s3cret")
+	cl := New(cfg, newtmessenger(), newtsys(), newtscheduler())
+	h := newAdminAPI(cl)
+
+	for _, header := range []string{"", "Bearer wrong", "s3cret"} {
+		r := httptest.NewRequest(http.MethodPost, "/consumer/pause", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("POST with the Authorization header %q returned %d instead of 401", header, w.Code)
+		}
+	}
+	if !waitReturns(cl.launchGate) {
+		t.Error("launches were paused without the token")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/consumer/pause", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("POST with the token returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// Reading requires the token too.
+	for _, target := range []string{"/consumer", "/launches", "/metrics"} {
+		if w = adminRequest(t, h, http.MethodGet, target); w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without the token returned %d instead of 401", target, w.Code)
+		}
+	}
+	r = httptest.NewRequest(http.MethodGet, "/consumer", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET with the token returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.2:8080":  false,
+		"8080":           false,
+	} {
+		if actual := isLoopbackAddr(addr); actual != expected {
+			t.Errorf("isLoopbackAddr(%q) returned %t", addr, actual)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// backpressureReason is the reason the launch gate is paused for while the
+// schedd has too many idle jobs.
+const backpressureReason = "too many idle jobs in the queue"
+
+// Backpressure pauses the launch gate while the number of idle jobs in the
+// queue is above condor.backpressure.max_idle_jobs, and resumes it once the
+// number drops to condor.backpressure.resume_idle_jobs.
+type Backpressure struct {
+	scheduler  Scheduler
+	gate       *Gate
+	maxIdle    int
+	resumeIdle int
+	paused     bool
+}
+
+// NewBackpressure returns a *Backpressure configured by the
+// condor.backpressure settings.
+func NewBackpressure(cfg *viper.Viper, scheduler Scheduler, gate *Gate) (*Backpressure, error) {
+	maxIdle := cfg.GetInt("condor.backpressure.max_idle_jobs")
+	if maxIdle <= 0 {
+		return nil, errors.New("condor.backpressure.max_idle_jobs must be positive")
+	}
+	resumeIdle := cfg.GetInt("condor.backpressure.resume_idle_jobs")
+	if resumeIdle <= 0 || resumeIdle > maxIdle {
+		resumeIdle = maxIdle
+	}
+	return &Backpressure{
+		scheduler:  scheduler,
+		gate:       gate,
+		maxIdle:    maxIdle,
+		resumeIdle: resumeIdle,
+	}, nil
+}
+
+// Check counts the idle jobs in the queue and pauses or resumes the launch
+// gate. The gate is left alone if the queue can't be checked.
+func (b *Backpressure) Check() {
+	totals, err := b.scheduler.Totals()
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to count the jobs in the queue"))
+		return
+	}
+	switch {
+	case !b.paused && totals.Idle > b.maxIdle:
+		log.Warnf("pausing launches because there are %d idle jobs in the queue", totals.Idle)
+		b.gate.Pause(backpressureReason)
+		b.paused = true
+		backpressurePauses.Inc()
+	case b.paused && totals.Idle <= b.resumeIdle:
+		log.Infof("resuming launches because there are %d idle jobs in the queue", totals.Idle)
+		b.gate.Resume(backpressureReason)
+		b.paused = false
+	}
+}
+
+// startBackpressure starts up the code that periodically checks the number of
+// idle jobs in the queue.
+func startBackpressure(b *Backpressure, interval time.Duration) *Ticker {
+	return startTicker(interval, b.Check)
+}
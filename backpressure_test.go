@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestBackpressure(t *testing.T) {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("condor.backpressure.max_idle_jobs", 100)
+	cfg.Set("condor.backpressure.resume_idle_jobs", 50)
+	scheduler := newtscheduler()
+	gate := NewGate()
+	b, err := NewBackpressure(cfg, scheduler, gate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		idle   int
+		err    error
+		paused bool
+	}{
+		{100, nil, false},
+		{101, nil, true},
+		{75, nil, true},
+		{0, errors.New("the schedd is down"), true},
+		{50, nil, false},
+	}
+	for _, s := range steps {
+		scheduler.totals = QueueTotals{Idle: s.idle}
+		scheduler.totalsErr = s.err
+		b.Check()
+		expected := []string{}
+		if s.paused {
+			expected = []string{backpressureReason}
+		}
+		if actual := gate.Reasons(); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("with %d idle jobs (error %v), the gate was paused for %v instead of %v", s.idle, s.err, actual, expected)
+		}
+	}
+}
+
+func TestNewBackpressureRequiresThreshold(t *testing.T) {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	if _, err := NewBackpressure(cfg, newtscheduler(), NewGate()); err == nil {
+		t.Error("backpressure was set up without condor.backpressure.max_idle_jobs")
+	}
+}
@@ -0,0 +1,152 @@
+// Package classad builds HTCondor ClassAd expressions, such as the
+// constraints passed to condor_q and condor_rm, without string formatting.
+// String literals are always escaped, so values taken from messages can't
+// change the structure of an expression.
+package classad
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expr is a ClassAd expression.
+type Expr struct {
+	text string
+}
+
+// String returns the text of the expression.
+func (e Expr) String() string {
+	return e.text
+}
+
+// Undefined is the ClassAd UNDEFINED literal.
+var Undefined = Expr{"undefined"}
+
+var attrNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// Attr returns a reference to an attribute. Attribute names are always
+// written by the launcher itself, so an invalid name causes a panic.
+func Attr(name string) Expr {
+	if !attrNameRegexp.MatchString(name) {
+		panic(fmt.Sprintf("invalid ClassAd attribute name: %q", name))
+	}
+	return Expr{name}
+}
+
+// Quote returns s as a ClassAd string literal, escaping the characters that
+// have a special meaning inside one.
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\%03o`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// String returns a string literal.
+func String(s string) Expr {
+	return Expr{Quote(s)}
+}
+
+// Int returns an integer literal.
+func Int(i int64) Expr {
+	return Expr{strconv.FormatInt(i, 10)}
+}
+
+// Bool returns a boolean literal.
+func Bool(b bool) Expr {
+	if b {
+		return Expr{"true"}
+	}
+	return Expr{"false"}
+}
+
+// binary joins two expressions with an operator.
+func binary(op string, a, b Expr) Expr {
+	return Expr{fmt.Sprintf("%s %s %s", a.text, op, b.text)}
+}
+
+// Is returns a =?= b, which is true if a and b are identical, even if either
+// is undefined.
+func Is(a, b Expr) Expr {
+	return binary("=?=", a, b)
+}
+
+// IsNot returns a =!= b.
+func IsNot(a, b Expr) Expr {
+	return binary("=!=", a, b)
+}
+
+// Equal returns a == b.
+func Equal(a, b Expr) Expr {
+	return binary("==", a, b)
+}
+
+// Less returns a < b.
+func Less(a, b Expr) Expr {
+	return binary("<", a, b)
+}
+
+// Member returns member(m, list), which is true if m is equal to an element
+// of the list. Strings are compared without regard to case, as with ==.
+func Member(m, list Expr) Expr {
+	return Expr{fmt.Sprintf("member(%s, %s)", m.text, list.text)}
+}
+
+// join combines expressions with a logical operator, parenthesizing each one.
+func join(op string, exprs []Expr) Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	parts := make([]string, len(exprs))
+	for i, e := range exprs {
+		parts[i] = "(" + e.text + ")"
+	}
+	return Expr{strings.Join(parts, " "+op+" ")}
+}
+
+// And returns the conjunction of the expressions. And() is true.
+func And(exprs ...Expr) Expr {
+	if len(exprs) == 0 {
+		return Bool(true)
+	}
+	return join("&&", exprs)
+}
+
+// Or returns the disjunction of the expressions. Or() is false.
+func Or(exprs ...Expr) Expr {
+	if len(exprs) == 0 {
+		return Bool(false)
+	}
+	return join("||", exprs)
+}
+
+// Not returns the negation of an expression.
+func Not(e Expr) Expr {
+	return Expr{"!(" + e.text + ")"}
+}
@@ -0,0 +1,57 @@
+package classad
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	cases := map[string]string{
+		"foo":                `"foo"`,
+		`a"b`:                `"a\"b"`,
+		`a\b`:                `"a\\b"`,
+		"a\nb\tc":            `"a\nb\tc"`,
+		"a\x00b":             `"a\000b"`,
+		`" || IpcUuid =!= "`: `"\" || IpcUuid =!= \""`,
+		`\" || true || "\`:   `"\\\" || true || \"\\"`,
+		"café":               "\"café\"",
+	}
+	for s, expected := range cases {
+		if actual := Quote(s); actual != expected {
+			t.Errorf("Quote(%q) returned %s instead of %s", s, actual, expected)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	cases := []struct {
+		expr     Expr
+		expected string
+	}{
+		{Is(Attr("IpcUuid"), String("foo")), `IpcUuid =?= "foo"`},
+		{IsNot(Attr("IpcUuid"), Undefined), `IpcUuid =!= undefined`},
+		{Equal(Attr("JobStatus"), Int(5)), `JobStatus == 5`},
+		{And(Is(Attr("JobStatus"), Int(5)), Is(Attr("IpcUuid"), String(`x"y`))), `(JobStatus =?= 5) && (IpcUuid =?= "x\"y")`},
+		{Or(Less(Attr("NumHolds"), Int(3)), Bool(false)), `(NumHolds < 3) || (false)`},
+		{Member(String("groups:lab"), Attr("IpcUserGroups")), `member("groups:lab", IpcUserGroups)`},
+		{And(Is(Attr("A"), Int(1))), `A =?= 1`},
+		{And(), `true`},
+		{Or(), `false`},
+		{Not(Is(Attr("A"), Bool(true))), `!(A =?= true)`},
+	}
+	for _, c := range cases {
+		if actual := c.expr.String(); actual != c.expected {
+			t.Errorf("the expression was %s instead of %s", actual, c.expected)
+		}
+	}
+}
+
+func TestAttrInvalid(t *testing.T) {
+	for _, name := range []string{"", "1abc", "a b", `a"`, "a||b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Attr(%q) didn't panic", name)
+				}
+			}()
+			Attr(name)
+		}()
+	}
+}
@@ -9,22 +9,26 @@
 // Since it launches jobs by executing the condor_submit command it shouldn't
 // run inside a Docker container. Our Condor cluster is moderately large and
 // requires a lot of ports to be opened up, which doesn't play nicely with
-// Docker.
+// Docker. Setting condor.scheduler to ssh avoids this by copying the
+// submission directories to a submit host over SFTP and running the HTCondor
+// commands there over SSH.
 //
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
-	"github.com/cyverse-de/configurate"
 	"github.com/cyverse-de/logcabin"
 	"github.com/cyverse-de/version"
 	"github.com/pkg/errors"
@@ -73,123 +77,275 @@ type Messenger interface {
 	Publish(string, []byte) error
 	SetupPublishing(string) error
 	PublishJobUpdate(*messaging.UpdateMessage) error
+	SendTimeLimitResponse(string, int64) error
 	DeleteQueue(name string) error
 }
 
 // CondorLauncher contains the condor-launcher application state.
 type CondorLauncher struct {
-	cfg          *viper.Viper
-	client       Messenger
-	fs           fsys
-	condorSubmit string //path to the condor_submit executable
-	condorRm     string // path to the condor_rm executable
+	cfgMutex    sync.RWMutex // guards cfg, heldPolicy and credentials, which are replaced when the config is reloaded
+	cfg         *viper.Viper
+	credentials CredentialProvider
+	client      Messenger
+	fs          fsys
+	scheduler   Scheduler
+	journal     *Journal
+	monitor     *StatusMonitor // nil unless job status monitoring is enabled
+	heldPolicy  *HeldJobPolicy
+	launchGate  *Gate              // launch requests wait while this is paused
+	timeLimits  *TimeLimits        // nil unless time limits are enforced
+	templates   *TemplateOverrides // nil unless condor.templates.dir is set
+	launchLimit *Limiter           // limits the launch requests handled at once
+	rateLimits  *LaunchRateLimiter // limits how quickly jobs are launched, overall and per user
+	quotas      *Quotas            // nil unless active job quotas are enforced
+	stopLimit   *Limiter           // limits the stop requests handled at once
+
+	deadLetterSinks []DeadLetterSink
+
+	drainMutex sync.Mutex
+	draining   bool           // set when the launcher is shutting down
+	stopping   chan struct{}  // closed when the launcher starts shutting down
+	closed     chan struct{}  // closed once the AMQP connection is closed
+	inflight   sync.WaitGroup // the delivery handlers that are running
 }
 
-// New returns a new *CondorLauncher
-func New(c *viper.Viper, client Messenger, fs fsys, condorSubmit, condorRm string) *CondorLauncher {
+// New returns a new *CondorLauncher. Launches are journaled in memory until
+// the journal is replaced with one that's written to disk, and held jobs are
+// removed until a HeldJobPolicy is set.
+func New(c *viper.Viper, client Messenger, fs fsys, scheduler Scheduler) *CondorLauncher {
 	return &CondorLauncher{
-		cfg:          c,
-		client:       client,
-		fs:           fs,
-		condorSubmit: condorSubmit,
-		condorRm:     condorRm,
+		cfg:         c,
+		client:      client,
+		fs:          fs,
+		scheduler:   scheduler,
+		journal:     NewMemoryJournal(),
+		credentials: &configCredentials{cfg: c},
+		heldPolicy:  &HeldJobPolicy{},
+		launchGate:  NewGate(),
+		launchLimit: NewLimiter(0),
+		rateLimits:  NewLaunchRateLimiter(RateLimit{}, RateLimit{}),
+		stopLimit:   NewLimiter(0),
+		stopping:    make(chan struct{}),
+		closed:      make(chan struct{}),
 	}
 }
 
-func (cl *CondorLauncher) storeConfig(s *model.Job) error {
-	cfgData := &IRODSConfig{
-		IRODSHost: cl.cfg.GetString("irods.host"),
-		IRODSPort: cl.cfg.GetString("irods.port"),
-		IRODSUser: cl.cfg.GetString("irods.user"),
-		IRODSPass: cl.cfg.GetString("irods.pass"),
-		IRODSBase: cl.cfg.GetString("irods.base"),
-		IRODSResc: cl.cfg.GetString("irods.resc"),
-		IRODSZone: cl.cfg.GetString("irods.zone"),
-	}
-	fileContent, err := GenerateFile(IRODSConfigTemplate, cfgData)
-	if err != nil {
-		return err
-	}
-	log.Infof("generated the irods config for job %s", s.InvocationID)
+// config returns the launcher's current configuration.
+func (cl *CondorLauncher) config() *viper.Viper {
+	cl.cfgMutex.RLock()
+	defer cl.cfgMutex.RUnlock()
+	return cl.cfg
+}
+
+// heldJobPolicy returns the launcher's current HeldJobPolicy.
+func (cl *CondorLauncher) heldJobPolicy() *HeldJobPolicy {
+	cl.cfgMutex.RLock()
+	defer cl.cfgMutex.RUnlock()
+	return cl.heldPolicy
+}
 
+// credentialProvider returns the launcher's current CredentialProvider.
+func (cl *CondorLauncher) credentialProvider() CredentialProvider {
+	cl.cfgMutex.RLock()
+	defer cl.cfgMutex.RUnlock()
+	return cl.credentials
+}
+
+// jobLogsDirectory returns the directory on the submission node that the
+// submission files and logs for a job are written to.
+func jobLogsDirectory(s *model.Job) string {
 	sdir := s.CondorLogDirectory()
 	if path.Base(sdir) != "logs" {
 		sdir = path.Join(sdir, "logs")
 	}
-	fname := path.Join(sdir, "irods-config")
-	err = ioutil.WriteFile(fname, fileContent.Bytes(), 0644)
+	return sdir
+}
+
+// storeConfig writes the irods-config file for a job to dir. Only the
+// launcher's user can read it.
+func (cl *CondorLauncher) storeConfig(s *model.Job, dir string) error {
+	cfg := cl.config()
+	password, err := cl.credentialProvider().Password()
 	if err != nil {
-		return errors.Wrapf(err, "failed to write to file %s", fname)
+		return errors.Wrap(err, "failed to get the iRODS password")
+	}
+	cfgData := &IRODSConfig{
+		IRODSHost: cfg.GetString("irods.host"),
+		IRODSPort: cfg.GetString("irods.port"),
+		IRODSUser: cfg.GetString("irods.user"),
+		IRODSPass: password,
+		IRODSBase: cfg.GetString("irods.base"),
+		IRODSResc: cfg.GetString("irods.resc"),
+		IRODSZone: cfg.GetString("irods.zone"),
+	}
+	tmpl := IRODSConfigTemplate
+	if cl.templates != nil {
+		if override := cl.templates.Lookup(irodsConfigTemplateName); override != nil {
+			tmpl = override
+		}
 	}
+	fileContent, err := GenerateFile(tmpl, cfgData)
+	if err != nil {
+		return err
+	}
+	log.Infof("generated the irods config for job %s", s.InvocationID)
 
-	return nil
+	return writeSecretFile(path.Join(dir, irodsConfigName), fileContent.Bytes())
 }
 
-func (cl *CondorLauncher) launch(s *model.Job, condorPath, condorConfig string) (string, error) {
-
-	// Ensure that the logs directory exists for the job.
-	sdir := s.CondorLogDirectory()
-	if path.Base(sdir) != "logs" {
-		sdir = path.Join(sdir, "logs")
+// restoreIRODSConfig writes the irods-config file for a job that has already
+// been submitted, copying it to the submit host if the scheduler staged the
+// submission directory there.
+func (cl *CondorLauncher) restoreIRODSConfig(s *model.Job, dir string) error {
+	if err := cl.storeConfig(s, dir); err != nil {
+		return err
 	}
-	err := os.MkdirAll(sdir, 0755)
-	if err != nil {
-		return "", errors.Wrapf(err, "failed to create the directory %s", sdir)
+	if u, ok := cl.scheduler.(unstager); ok {
+		return u.Restage(dir, irodsConfigName)
 	}
+	return nil
+}
 
+// renderSubmission writes the submission files for a job to dir and returns
+// the path to the submit description.
+func (cl *CondorLauncher) renderSubmission(s *model.Job, dir string) (string, error) {
 	if s.ExecutionTarget != "osg" {
 		// Write the irods configuration file to relevant locations
-		err = cl.storeConfig(s)
-		if err != nil {
+		if err := cl.storeConfig(s, dir); err != nil {
 			return "", err
 		}
 	}
 
 	// Create a copy of the configuration to use for job submission
-	cfgCopy := CopyConfig(cl.cfg)
+	cfgCopy := CopyConfig(cl.config())
 
 	// Generate the submission files, always using the condor job submission format for now.
 	jobSubmissionBuilder, err := jobs.NewJobSubmissionBuilder(s.ExecutionTarget, cfgCopy)
 	if err != nil {
 		return "", err
 	}
-	submissionPath, err := jobSubmissionBuilder.Build(s, sdir)
+	if err = checkSubmitFields(s); err != nil {
+		return "", err
+	}
+	// The builder places job fields in the submit description as they are.
+	escaped := escapeSubmitFields(s)
+	submissionPath, err := jobSubmissionBuilder.Build(escaped, dir)
 	if err != nil {
 		return "", err
 	}
+	if err = writeJobFile(s, escaped, dir); err != nil {
+		return "", err
+	}
+	if cl.templates != nil {
+		if err = cl.templates.applySubmissionOverrides(s, escaped, cfgCopy, submissionPath); err != nil {
+			return "", err
+		}
+	}
+
+	return submissionPath, nil
+}
+
+func (cl *CondorLauncher) launch(s *model.Job) (string, error) {
+
+	// Ensure that the logs directory exists for the job.
+	sdir := jobLogsDirectory(s)
+	err := os.MkdirAll(sdir, 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create the directory %s", sdir)
+	}
+
+	cl.recordJournal(JournalEntry{
+		InvocationID:  s.InvocationID,
+		SubmissionDir: sdir,
+		State:         launchingState,
+		Job:           s,
+	})
+
+	submissionPath, err := cl.renderSubmission(s, sdir)
+	if err != nil {
+		removeIRODSConfig(cl.scheduler, sdir)
+		return "", err
+	}
 
 	// Submit the job to Condor.
-	cmd := exec.Command(cl.condorSubmit, submissionPath)
-	cmd.Dir = path.Dir(submissionPath)
-	cmd.Env = []string{
-		fmt.Sprintf("PATH=%s", condorPath),
-		fmt.Sprintf("CONDOR_CONFIG=%s", condorConfig),
-	}
-	output, err := cmd.CombinedOutput()
-	log.Infof("Output of condor_submit:\n%s\n", output)
+	id, err := cl.submit(s, submissionPath)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to execute %s", cl.condorSubmit)
+		removeIRODSConfig(cl.scheduler, sdir)
+		return "", err
 	}
 
 	// Log the Condor job ID.
-	id := string(model.ExtractJobID(output))
 	log.Infof("Condor job id is %s\n", id)
 
+	// Spooled input files have already been copied to the schedd.
+	if sp, ok := cl.scheduler.(SpoolingScheduler); ok && sp.Spooling() {
+		removeIRODSConfig(cl.scheduler, sdir)
+	}
+	cl.recordJournal(JournalEntry{InvocationID: s.InvocationID, ClusterID: id})
+
 	return id, err
 }
 
+// existingClusterID returns the cluster ID of a job that has already been
+// submitted for the given invocation ID, or an empty string if there isn't
+// one. Both the queue and the history are checked.
+func (cl *CondorLauncher) existingClusterID(invocationID string) (string, error) {
+	ad, err := findJobAd(cl.scheduler, invocationID, "ClusterId")
+	if err != nil || ad == nil {
+		return "", err
+	}
+	return ad["ClusterId"], nil
+}
+
+// launchOnce launches a job unless a job with the same invocation ID has
+// already been submitted, in which case the existing cluster ID is returned.
+// This keeps redelivered launch requests from creating duplicate jobs.
+func (cl *CondorLauncher) launchOnce(s *model.Job) (string, error) {
+	existingID, err := cl.existingClusterID(s.InvocationID)
+	if err != nil {
+		return "", err
+	}
+	if existingID != "" {
+		log.Infof("job %s was already submitted as Condor ID %s", s.InvocationID, existingID)
+		return existingID, nil
+	}
+	return cl.launch(s)
+}
+
 // handleLaunchRequests triggers Condor jobs in response to launch request messages.
-func (cl *CondorLauncher) handleLaunchRequests(condorPath, condorConfig string) func(d amqp.Delivery) {
+// Deliveries aren't handled while the launch gate is paused, so the broker
+// stops sending them once the prefetch limit is reached.
+func (cl *CondorLauncher) handleLaunchRequests() func(d amqp.Delivery) {
 	return func(delivery amqp.Delivery) {
+		cl.launchGate.Wait()
+		cl.launchLimit.Acquire()
+		defer cl.launchLimit.Release()
+
+		if !cl.beginHandling() {
+			return
+		}
+		defer cl.endHandling()
+
 		body := delivery.Body
 		requeueOnErr := !delivery.Redelivered
 
 		req := messaging.JobRequest{}
 		err := json.Unmarshal(body, &req)
+		if err == nil && req.Command == messaging.Launch && req.Job == nil {
+			err = errors.New("the launch request doesn't contain a job")
+		}
 		if err != nil {
-			log.Errorf("%+v\n", errors.Wrap(err, "failed to unmarshal launch request json"))
+			err = errors.Wrap(err, "failed to unmarshal launch request json")
+			log.Errorf("%+v\n", err)
 			log.Error(string(body[:]))
+			unmarshalFailures.WithLabelValues("launch").Inc()
 
+			// The message will never parse, so there's no point in requeueing
+			// it if it can be dead-lettered.
+			if cl.deadLetter(delivery, "malformed", err) {
+				ackDelivery(delivery, "failed to ACK dead-lettered amqp Launch request delivery")
+				return
+			}
 			rejectDelivery(delivery, requeueOnErr, "failed to Reject amqp Launch request delivery")
 
 			return
@@ -197,9 +353,49 @@ func (cl *CondorLauncher) handleLaunchRequests(condorPath, condorConfig string)
 
 		switch req.Command {
 		case messaging.Launch:
-			jobID, err := cl.launch(req.Job, condorPath, condorConfig)
+			launchRequests.WithLabelValues(req.Job.ExecutionTarget).Inc()
+
+			// Invalid jobs will never launch, so they're failed right away,
+			// dead-lettered and acknowledged.
+			if err = validateJob(req.Job); err != nil {
+				invalidErr := err
+				log.Errorf("rejecting job %s: %s", req.Job.InvocationID, err)
+				invalidJobs.WithLabelValues(req.Job.ExecutionTarget).Inc()
+				err = cl.client.PublishJobUpdate(&messaging.UpdateMessage{
+					Job:     req.Job,
+					State:   messaging.FailedState,
+					Message: fmt.Sprintf("condor-launcher failed to launch job:\n %s", err),
+				})
+				if err != nil {
+					log.Errorf("%+v\n", errors.Wrap(err, "failed to publish the job update for an invalid job"))
+				}
+				cl.deadLetter(delivery, "invalid", invalidErr)
+				ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
+				return
+			}
+
+			if !cl.waitForLaunchRate(req.Job.Submitter) {
+				msg := fmt.Sprintf("%s has reached the launch rate limit", req.Job.Submitter)
+				cl.deferLaunch(delivery, req.Job, "user_rate_limit", msg)
+				return
+			}
+
+			jobID, err := cl.launchWithinQuota(req.Job)
+			if quotaErr, ok := err.(*QuotaExceededError); ok {
+				cl.handleOverQuota(delivery, req.Job, quotaErr)
+				return
+			}
 			if err != nil {
+				launchErr := err
 				log.Errorf("%+v\n", err)
+				launchesFailed.WithLabelValues(req.Job.ExecutionTarget).Inc()
+
+				// A job that can't be written to a submit description, or that
+				// condor_submit rejected, will never be launched, so it's
+				// failed right away.
+				if _, ok := errors.Cause(err).(JobFieldErrors); ok || isPermanentSubmitError(err) {
+					requeueOnErr = false
+				}
 
 				if !requeueOnErr {
 					err = cl.client.PublishJobUpdate(&messaging.UpdateMessage{
@@ -210,18 +406,34 @@ func (cl *CondorLauncher) handleLaunchRequests(condorPath, condorConfig string)
 					if err != nil {
 						log.Errorf("%+v\n", errors.Wrap(err, "failed to publish launch failure job update"))
 					}
+					cl.recordJournal(JournalEntry{InvocationID: req.Job.InvocationID, State: messaging.FailedState})
+					cl.deadLetter(delivery, "launch_failed", launchErr)
 				}
 
 				rejectDelivery(delivery, requeueOnErr, "failed to Reject amqp Launch request delivery")
 			} else {
 				log.Infof("Launched Condor ID %s", jobID)
+				launchesSucceeded.WithLabelValues(req.Job.ExecutionTarget).Inc()
 				err = cl.client.PublishJobUpdate(&messaging.UpdateMessage{
 					Job:     req.Job,
 					State:   messaging.SubmittedState,
 					Message: fmt.Sprintf("Launched Condor ID %s", jobID),
 				})
-				if err != nil {
+				switch {
+				case err != nil:
 					log.Errorf("%+v\n", errors.Wrap(err, "failed to publish successful launch job update"))
+				case cl.monitor == nil:
+					// Nothing else is published for the job, so the journal
+					// doesn't need to keep track of it.
+					cl.recordJournal(JournalEntry{InvocationID: req.Job.InvocationID, State: forgottenState})
+				default:
+					cl.recordJournal(JournalEntry{InvocationID: req.Job.InvocationID, State: messaging.SubmittedState})
+				}
+				if cl.monitor != nil {
+					cl.monitor.Track(req.Job, jobID)
+				}
+				if cl.timeLimits != nil {
+					cl.timeLimits.Track(req.Job)
 				}
 
 				ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
@@ -233,28 +445,140 @@ func (cl *CondorLauncher) handleLaunchRequests(condorPath, condorConfig string)
 	}
 }
 
-func (cl *CondorLauncher) stopJob(invocationID, condorPath, condorConfig string) error {
+// waitForLaunchRate waits until the rate limits allow a job to be launched
+// for a user. It returns false if the user has launched so many jobs that the
+// request should be deferred rather than waited for.
+func (cl *CondorLauncher) waitForLaunchRate(user string) bool {
+	if !cl.rateLimits.WaitUser(user, cl.deferDelay()) {
+		return false
+	}
+	cl.rateLimits.WaitGlobal()
+	return true
+}
+
+// deferDelay returns how long a launch request is held before it's deferred.
+func (cl *CondorLauncher) deferDelay() time.Duration {
+	d, err := time.ParseDuration(cl.config().GetString("condor.rate_limits.defer_delay"))
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// deferLaunch sends a launch request to the back of the queue after a delay,
+// so that other users' requests are handled in the meantime. The handler
+// returns right away, freeing its slot, and the delivery is left
+// unacknowledged until the delay is over so that the broker requeues it if
+// the launcher stops first. It's published again rather than requeued so
+// that it isn't treated as a redelivery.
+func (cl *CondorLauncher) deferLaunch(delivery amqp.Delivery, job *model.Job, reason, msg string) {
+	log.Infof("deferring the launch of job %s: %s", job.InvocationID, msg)
+	launchesDeferred.WithLabelValues(reason).Inc()
+	time.AfterFunc(cl.deferDelay(), func() {
+		if !cl.beginHandling() {
+			return
+		}
+		defer cl.endHandling()
+
+		if err := cl.client.Publish(messaging.LaunchesKey, delivery.Body); err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to defer the launch of job %s", job.InvocationID))
+			rejectDelivery(delivery, true, "failed to Reject amqp Launch request delivery")
+			return
+		}
+		ackDelivery(delivery, "failed to ACK deferred amqp Launch request delivery")
+	})
+}
+
+// launchWithinQuota launches a job if that won't put its submitter over their
+// quota of active jobs. A *QuotaExceededError is returned if it would.
+func (cl *CondorLauncher) launchWithinQuota(s *model.Job) (string, error) {
+	if cl.quotas == nil {
+		return cl.launchOnce(s)
+	}
+	if err := cl.quotas.Reserve(s); err != nil {
+		return "", err
+	}
+	defer cl.quotas.Release(s.InvocationID)
+	return cl.launchOnce(s)
+}
+
+// handleOverQuota either fails or defers a launch that would put its
+// submitter over their quota, depending on condor.quotas.action.
+func (cl *CondorLauncher) handleOverQuota(delivery amqp.Delivery, job *model.Job, quotaErr *QuotaExceededError) {
+	action := cl.quotas.Action()
+	quotaExceeded.WithLabelValues(quotaErr.Kind, action).Inc()
+	if action == quotaActionDefer {
+		cl.deferLaunch(delivery, job, "quota", quotaErr.Error())
+		return
+	}
+
+	log.Errorf("rejecting job %s: %s", job.InvocationID, quotaErr)
+	err := cl.client.PublishJobUpdate(&messaging.UpdateMessage{
+		Job:     job,
+		State:   messaging.FailedState,
+		Message: fmt.Sprintf("condor-launcher failed to launch job:\n %s", quotaErr),
+	})
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to publish the job update for a job over its quota"))
+	}
+	ackDelivery(delivery, "failed to ACK amqp Launch request delivery")
+}
+
+func (cl *CondorLauncher) stopJob(invocationID string) error {
+	if err := cl.removeJob(invocationID, "Job was killed"); err != nil {
+		stops.WithLabelValues("failed").Inc()
+		return err
+	}
+	stops.WithLabelValues("succeeded").Inc()
+	return nil
+}
+
+// removeJob removes a job from the queue and publishes a Failed update for it
+// with the given message.
+func (cl *CondorLauncher) removeJob(invocationID, msg string) error {
+	return cl.removeJobWithExitCode(invocationID, msg, 0)
+}
+
+// removeJobWithExitCode removes a job from the queue and publishes a Failed
+// update for it with the given message and exit code.
+func (cl *CondorLauncher) removeJobWithExitCode(invocationID, msg string, exitCode int) error {
 	var (
 		condorRMOutput []byte
 		err            error
 	)
 
+	if err = validateInvocationID(invocationID); err != nil {
+		return err
+	}
+
 	log.Infof("Running condor_rm for %s", invocationID)
-	if condorRMOutput, err = ExecCondorRm(invocationID, condorPath, condorConfig); err != nil {
+	if condorRMOutput, err = cl.scheduler.Remove(ipcUUIDConstraint(invocationID)); err != nil {
 		log.Errorf("%+v\n", errors.Wrapf(err, "failed to run 'condor_rm %s'", invocationID))
 		return err
 	}
 
-	fauxJob := model.New(cl.cfg)
+	if cl.monitor != nil {
+		cl.monitor.Forget(invocationID)
+	}
+	if cl.timeLimits != nil {
+		cl.timeLimits.Forget(invocationID)
+	}
+	if entry, ok := cl.journal.Entry(invocationID); ok {
+		removeIRODSConfig(cl.scheduler, entry.SubmissionDir)
+	}
+
+	fauxJob := model.New(cl.config())
 	fauxJob.InvocationID = invocationID
+	fauxJob.ExitCode = exitCode
 	update := &messaging.UpdateMessage{
 		Job:     fauxJob,
 		State:   messaging.FailedState,
-		Message: "Job was killed",
+		Message: msg,
 	}
 	if err = cl.client.PublishJobUpdate(update); err != nil {
 		log.Errorf("%+v\n", errors.Wrap(err, "failed to publish job update for a stopped job"))
 	}
+	cl.recordJournal(JournalEntry{InvocationID: invocationID, State: messaging.FailedState})
 	log.Infof("condor_rm output for job %s:\n%s", invocationID, condorRMOutput)
 
 	cl.client.DeleteQueue(messaging.StopQueueName(invocationID))
@@ -262,7 +586,7 @@ func (cl *CondorLauncher) stopJob(invocationID, condorPath, condorConfig string)
 	return nil
 }
 
-func (cl *CondorLauncher) stopHandler(condorPath, condorConfig string) func(d amqp.Delivery) {
+func (cl *CondorLauncher) stopHandler() func(d amqp.Delivery) {
 	return func(d amqp.Delivery) {
 		var (
 			requeueOnErr bool
@@ -270,18 +594,32 @@ func (cl *CondorLauncher) stopHandler(condorPath, condorConfig string) func(d am
 			err          error
 		)
 
+		cl.stopLimit.Acquire()
+		defer cl.stopLimit.Release()
+
+		if !cl.beginHandling() {
+			return
+		}
+		defer cl.endHandling()
+
 		requeueOnErr = !d.Redelivered
 
 		stopRequest := &messaging.StopRequest{}
 		if err = json.Unmarshal(d.Body, stopRequest); err != nil {
 			log.Errorf("%+v\n", errors.Wrap(err, "failed to unmarshal the stop request body"))
+			unmarshalFailures.WithLabelValues("stop").Inc()
 			rejectDelivery(d, requeueOnErr, "failed to Reject StopRequest")
 			return
 		}
 
 		invID = stopRequest.InvocationID
+		if err = validateInvocationID(invID); err != nil {
+			log.Errorf("%+v\n", errors.Wrap(err, "ignoring a stop request"))
+			rejectDelivery(d, false, "failed to Reject StopRequest")
+			return
+		}
 
-		if err = cl.stopJob(invID, condorPath, condorConfig); err != nil {
+		if err = cl.stopJob(invID); err != nil {
 			rejectDelivery(d, requeueOnErr, fmt.Sprintf("failed to Reject StopRequest for %s", invID))
 		} else {
 			ackDelivery(d, fmt.Sprintf("failed to ACK StopRequest for %s", invID))
@@ -289,49 +627,82 @@ func (cl *CondorLauncher) stopHandler(condorPath, condorConfig string) func(d am
 	}
 }
 
-func killHeldJobs(launcher *CondorLauncher, condorPath, condorConfig string) {
-	var (
-		err         error
-		cmdOutput   []byte
-		heldEntries []string
-	)
+// handleHeldJob applies the launcher's HeldJobPolicy to a single held job.
+func (cl *CondorLauncher) handleHeldJob(ad JobAd, now time.Time) {
+	invocationID := ad["IpcUuid"]
+	decision := cl.heldJobPolicy().Decide(ad, now)
+	msg := heldMessage(ad, decision)
+	log.Infof("job %s: %s", invocationID, msg)
+
+	switch decision.action {
+	case heldActionRelease:
+		entry, ok := cl.journal.Entry(invocationID)
+		if !ok {
+			entry = JournalEntry{InvocationID: invocationID}
+		}
+		// The job needs the irods-config file when it restarts. It's
+		// written again in case it was removed or the password changed.
+		if entry.Job != nil && entry.SubmissionDir != "" && entry.Job.ExecutionTarget != "osg" {
+			if err := cl.restoreIRODSConfig(entry.Job, entry.SubmissionDir); err != nil {
+				log.Errorf("%+v\n", errors.Wrapf(err, "failed to write the irods-config file for held job %s", invocationID))
+			}
+		}
+		output, err := cl.scheduler.Release(ipcUUIDConstraint(invocationID))
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to release job %s", invocationID))
+			return
+		}
+		log.Infof("condor_release output for job %s:\n%s", invocationID, output)
+		if cl.monitor != nil {
+			cl.monitor.Requeue(invocationID)
+		}
+		cl.publishJournaled(entry, messaging.SubmittedState, msg)
+	case heldActionRemove:
+		if err := cl.removeJob(invocationID, msg); err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to remove held job %s", invocationID))
+			return
+		}
+	}
+	heldJobsHandled.WithLabelValues(decision.action).Inc()
+}
+
+// handleHeldJobs applies the launcher's HeldJobPolicy to every job in the
+// held state.
+func handleHeldJobs(launcher *CondorLauncher) {
 	log.Infoln("Looking for jobs in the held state...")
-	if cmdOutput, err = ExecCondorQHeldIDs(condorPath, condorConfig); err != nil {
+	ads, err := heldJobAds(launcher.scheduler)
+	if err != nil {
 		log.Errorf("%+v\n", errors.Wrap(err, "error running condor_q"))
 		return
 	}
-	heldEntries = heldQueueInvocationIDs(cmdOutput)
-	log.Infof("There are %d jobs in the held state", len(heldEntries))
-	for _, invocationID := range heldEntries {
-		if invocationID != "" {
-			log.Infof("Sending stop request for invocation id %s", invocationID)
-			if err = launcher.stopJob(invocationID, condorPath, condorConfig); err != nil {
-				log.Errorf("%+v\n", errors.Wrap(err, "error sending stop request"))
-			}
-		}
+	log.Infof("There are %d jobs in the held state", len(ads))
+	heldJobsFound.Add(float64(len(ads)))
+	now := time.Now()
+	for _, ad := range ads {
+		launcher.handleHeldJob(ad, now)
 	}
 }
 
-// startHeldTicker starts up the code that periodically fires and clean up held
+// startHeldTicker starts up the code that periodically fires and handles held
 // jobs
-func startHeldTicker(launcher *CondorLauncher, condorPath, condorConfig string) (*time.Ticker, error) {
-	d, err := time.ParseDuration("30s")
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse duration '30s'")
-	}
-	t := time.NewTicker(d)
-	go func(t *time.Ticker, launcher *CondorLauncher) {
-		for {
-			select {
-			case <-t.C:
-				killHeldJobs(launcher, condorPath, condorConfig)
-			}
-		}
-	}(t, launcher)
-	return t, nil
+func startHeldTicker(launcher *CondorLauncher, interval time.Duration) *Ticker {
+	return startTicker(interval, func() {
+		handleHeldJobs(launcher)
+	})
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "render":
+			runRender(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		cfgPath     = flag.String("config", "", "Path to the config file. Required.")
 		showVersion = flag.Bool("version", false, "Print the version information")
@@ -352,12 +723,9 @@ func main() {
 		os.Exit(-1)
 	}
 
-	csPath := findExecPath("condor_submit")
-	crPath := findExecPath("condor_rm")
-
-	cfg, err := configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
+	cfg, err := loadConfig(*cfgPath)
 	if err != nil {
-		log.Fatalf("%+v\n", errors.Wrap(err, "failed to initialize configuration defaults"))
+		log.Fatalf("%+v\n", err)
 	}
 	log.Infoln("Done reading config.")
 
@@ -369,44 +737,270 @@ func main() {
 	if err != nil {
 		log.Fatalf("%+v\n", errors.Wrap(err, "failed to create new AMQP client"))
 	}
-	defer client.Close()
 
-	launcher := New(cfg, client, &osys{}, csPath, crPath)
+	var scheduler *HTCondorScheduler
+	if cfg.GetString("condor.scheduler") == "ssh" {
+		if scheduler, err = NewSSHScheduler(cfg); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else {
+		scheduler = NewHTCondorScheduler(
+			findExecPath("condor_submit"),
+			findExecPath("condor_rm"),
+			findExecPath("condor_q"),
+			findExecPath("condor_history"),
+			findExecPath("condor_release"),
+			cfg.GetString("condor.path_env_var"),
+			cfg.GetString("condor.condor_config"),
+		)
+	}
+	if scheddName := cfg.GetString("condor.schedd_name"); scheddName != "" {
+		condorTransferData := "condor_transfer_data"
+		if cfg.GetString("condor.scheduler") != "ssh" {
+			condorTransferData = findExecPath(condorTransferData)
+		}
+		scheduler.SpoolTo(condorTransferData, scheddName, cfg.GetString("condor.pool"))
+	}
+	timeouts, err := commandTimeoutsFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	scheduler.SetTimeouts(timeouts)
+
+	launcher := New(cfg, &meteredMessenger{client}, &osys{}, scheduler)
+	if journalPath := cfg.GetString("condor.journal_path"); journalPath != "" {
+		if launcher.journal, err = OpenJournal(journalPath); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		defer launcher.journal.Close()
+	}
+	if launcher.deadLetterSinks, err = newDeadLetterSinks(cfg); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if launcher.heldPolicy, err = validateConfig(cfg); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if launcher.credentials, err = NewCredentialProvider(cfg); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if cfg.GetBool("condor.quotas.enabled") {
+		policy, err := NewQuotaPolicy(cfg)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		launcher.quotas = NewQuotas(scheduler, policy)
+	}
+	launcher.rateLimits.SetLimits(
+		rateLimitFromConfig(cfg, "condor.rate_limits.global"),
+		rateLimitFromConfig(cfg, "condor.rate_limits.per_user"),
+	)
+	if dir := cfg.GetString("condor.templates.dir"); dir != "" {
+		if launcher.templates, err = LoadTemplateOverrides(dir); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		if err = launcher.templates.Watch(); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		defer launcher.templates.Stop()
+	}
+	reloader := NewConfigReloader(*cfgPath, launcher)
+	if err = reloader.Watch(); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	defer reloader.Stop()
+	heldInterval, err := time.ParseDuration(cfg.GetString("condor.held_jobs.interval"))
+	if err != nil {
+		log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.held_jobs.interval"))
+	}
+	shutdownTimeout, err := time.ParseDuration(cfg.GetString("condor.shutdown_timeout"))
+	if err != nil {
+		log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.shutdown_timeout"))
+	}
 	launcher.client.SetupPublishing(exchangeName)
 	go launcher.client.Listen()
 
-	condorPath := cfg.GetString("condor.path_env_var")
-	condorConfig := cfg.GetString("condor.condor_config")
+	tickers := []*Ticker{startHeldTicker(launcher, heldInterval)}
+	log.Infoln("Started up the held state ticker")
 
-	ticker, err := startHeldTicker(
-		launcher,
-		condorPath,
-		condorConfig,
-	)
+	monitorInterval, err := time.ParseDuration(cfg.GetString("condor.status_monitor.interval"))
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.status_monitor.interval"))
+	}
+	if cfg.GetBool("condor.status_monitor.enabled") {
+		launcher.monitor = NewStatusMonitor(scheduler, launcher.client, launcher.journal)
+		switch source := cfg.GetString("condor.status_monitor.source"); source {
+		case "poll":
+			tickers = append(tickers, startStatusMonitor(launcher.monitor, monitorInterval))
+			log.Infoln("Started up the job status monitor")
+		case "userlog":
+			launcher.monitor.FollowUserLogs(monitorInterval)
+			log.Infoln("Started following the job user logs")
+		default:
+			log.Fatalf("unrecognized condor.status_monitor.source: %s", source)
+		}
+	} else {
+		// Nothing sees the jobs finish without the status monitor, so the
+		// irods-config files are removed once the jobs leave the queue.
+		janitor, err := NewJanitor(cfg, scheduler, launcher.journal)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		tickers = append(tickers, startCredentialSweep(janitor, monitorInterval))
+		log.Infoln("Started removing the irods-config files of the jobs that have left the queue")
+	}
+
+	// Time limits start when jobs start running, which only the status
+	// monitor knows about.
+	if cfg.GetBool("condor.time_limits.enabled") {
+		if launcher.monitor == nil {
+			log.Fatal("condor.time_limits.enabled requires condor.status_monitor.enabled")
+		}
+		defaultLimit, err := time.ParseDuration(cfg.GetString("condor.time_limits.default"))
+		if err != nil {
+			log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.time_limits.default"))
+		}
+		interval, err := time.ParseDuration(cfg.GetString("condor.time_limits.interval"))
+		if err != nil {
+			log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.time_limits.interval"))
+		}
+		launcher.timeLimits = NewTimeLimits(defaultLimit)
+		launcher.monitor.EnforceTimeLimits(launcher.timeLimits)
+		tickers = append(tickers, startTimeLimitTicker(launcher, interval))
+		log.Infoln("Started enforcing job time limits")
 	}
-	log.Infof("Started up the held state ticker: %#v", ticker)
+
+	if cfg.GetBool("condor.backpressure.enabled") {
+		interval, err := time.ParseDuration(cfg.GetString("condor.backpressure.interval"))
+		if err != nil {
+			log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.backpressure.interval"))
+		}
+		backpressure, err := NewBackpressure(cfg, scheduler, launcher.launchGate)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		backpressure.Check()
+		tickers = append(tickers, startBackpressure(backpressure, interval))
+		log.Infoln("Started checking the number of idle jobs in the queue")
+	}
+
+	if cfg.GetBool("condor.janitor.enabled") {
+		interval, err := time.ParseDuration(cfg.GetString("condor.janitor.interval"))
+		if err != nil {
+			log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.janitor.interval"))
+		}
+		janitor, err := NewJanitor(cfg, scheduler, launcher.journal)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		tickers = append(tickers, startJanitor(janitor, interval))
+		log.Infoln("Started cleaning up old submission directories")
+	}
+
+	if scheduler.Spooling() {
+		interval, err := time.ParseDuration(cfg.GetString("condor.transfer_data_interval"))
+		if err != nil {
+			log.Fatalf("%+v\n", errors.Wrap(err, "failed to parse condor.transfer_data_interval"))
+		}
+		tickers = append(tickers, startOutputRetrieval(scheduler, interval))
+		log.Infof("Started retrieving the output of the jobs spooled to %s", cfg.GetString("condor.schedd_name"))
+	}
+
+	// Publish any updates that were missed while the launcher wasn't running.
+	launcher.reconcile()
 
 	launcher.client.AddConsumer(
 		exchangeName,
 		exchangeType,
 		"condor-launcher-stops",
 		messaging.StopRequestKey("*"),
-		launcher.stopHandler(condorPath, condorConfig),
+		launcher.stopHandler(),
 		cfg.GetInt("amqp.prefetch.stops"),
 	)
 
+	if launcher.timeLimits != nil {
+		launcher.client.AddConsumer(
+			exchangeName,
+			exchangeType,
+			"condor-launcher-timelimit-requests",
+			messaging.TimeLimitRequestKey("*"),
+			launcher.timeLimitRequestHandler(),
+			cfg.GetInt("amqp.prefetch.stops"),
+		)
+		launcher.client.AddConsumer(
+			exchangeName,
+			exchangeType,
+			"condor-launcher-timelimit-deltas",
+			messaging.TimeLimitDeltaRequestKey("*"),
+			launcher.timeLimitDeltaHandler(),
+			cfg.GetInt("amqp.prefetch.stops"),
+		)
+	}
+
 	// Accept and handle messages sent out with the jobs.launches routing key.
 	launcher.client.AddConsumer(
 		exchangeName,
 		exchangeType,
 		"condor_launches",
 		messaging.LaunchesKey,
-		launcher.handleLaunchRequests(condorPath, condorConfig),
+		launcher.handleLaunchRequests(),
 		cfg.GetInt("amqp.prefetch.launches"),
 	)
 
-	spin := make(chan int)
-	<-spin
+	var adminServer *http.Server
+	if addr := cfg.GetString("condor.admin.listen_addr"); addr != "" {
+		adminServer = startAdminServer(launcher, addr)
+	}
+
+	// SIGHUP reloads the config without waiting for the file to change.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reloader.reloadAndLog()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("received %s, shutting down", sig)
+
+	for _, t := range tickers {
+		t.Stop()
+	}
+	if launcher.monitor != nil {
+		launcher.monitor.Stop()
+	}
+
+	// Deliveries that arrive from now on are held unacknowledged, so they're
+	// requeued for another launcher when the connection is closed.
+	if launcher.drain(shutdownTimeout) {
+		log.Infoln("all in-flight launches and stops have finished")
+	} else {
+		log.Warnf("gave up waiting for in-flight launches and stops after %s", shutdownTimeout)
+
+		// The HTCondor commands that are still running are killed so that
+		// the handlers waiting on them can return.
+		scheduler.Stop()
+		if !launcher.drain(5 * time.Second) {
+			log.Warnln("in-flight launches and stops were still running after their commands were killed")
+		}
+	}
+
+	if adminServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err = adminServer.Shutdown(ctx); err != nil {
+			log.Errorf("%+v\n", errors.Wrap(err, "failed to shut down the admin API server"))
+		}
+		cancel()
+	}
+
+	for _, sink := range launcher.deadLetterSinks {
+		if c, ok := sink.(interface{ Close() }); ok {
+			c.Close()
+		}
+	}
+	launcher.client.Close()
+	launcher.closeDeliveries()
+	log.Infoln("condor-launcher has shut down")
 }
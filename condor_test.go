@@ -1,18 +1,26 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"gopkg.in/cyverse-de/messaging.v6"
 	"gopkg.in/cyverse-de/model.v4"
 
 	"github.com/cyverse-de/condor-launcher/test"
+	"github.com/streadway/amqp"
 )
 
 type filerecord struct {
@@ -48,34 +56,236 @@ func (t *tsys) WriteFile(path string, contents []byte, mode os.FileMode) error {
 	return nil
 }
 
-func TestLaunch(t *testing.T) {
-	cfg := test.InitConfig(t)
-	test.InitPath(t)
-	csPath, err := exec.LookPath("condor_submit")
+// tmessenger is a Messenger that records the job updates that are published.
+type tmessenger struct {
+	mutex     sync.Mutex
+	updates   []*messaging.UpdateMessage
+	published map[string][][]byte
+}
+
+func newtmessenger() *tmessenger {
+	return &tmessenger{
+		updates:   make([]*messaging.UpdateMessage, 0),
+		published: make(map[string][][]byte),
+	}
+}
+
+func (m *tmessenger) AddConsumer(string, string, string, string, messaging.MessageHandler, int) {}
+func (m *tmessenger) Close()                                                                    {}
+func (m *tmessenger) Listen()                                                                   {}
+func (m *tmessenger) SetupPublishing(string) error                                              { return nil }
+func (m *tmessenger) DeleteQueue(name string) error                                             { return nil }
+
+func (m *tmessenger) Publish(key string, body []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.published[key] = append(m.published[key], body)
+	return nil
+}
+
+func (m *tmessenger) SendTimeLimitResponse(invocationID string, remaining int64) error {
+	body, err := json.Marshal(&messaging.TimeLimitResponse{InvocationID: invocationID, MillisecondsRemaining: remaining})
 	if err != nil {
-		t.Error(errors.Wrapf(err, "failed to find condor_submit in $PATH"))
+		return err
 	}
-	if !path.IsAbs(csPath) {
-		csPath, err = filepath.Abs(csPath)
+	return m.Publish(messaging.TimeLimitResponsesKey(invocationID), body)
+}
+
+func (m *tmessenger) PublishJobUpdate(u *messaging.UpdateMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.updates = append(m.updates, u)
+	return nil
+}
+
+// tscheduler is a Scheduler that serves job ads from memory. Constraints on
+// IpcUuid only match the ads with that IpcUuid, and other constraints match
+// every ad.
+type tscheduler struct {
+	mutex     sync.Mutex
+	queue     []JobAd
+	history   []JobAd
+	submitted []string
+	removed   []string
+	released  []string
+	totals    QueueTotals
+	totalsErr error
+	nextID    int
+
+	// submitErrs are returned by the calls to Submit, in order, until they
+	// run out.
+	submitErrs []error
+}
+
+func newtscheduler() *tscheduler {
+	return &tscheduler{nextID: 10000}
+}
+
+func tschedulerMatches(ad JobAd, constraint string) bool {
+	if !strings.Contains(constraint, `IpcUuid =?= "`) {
+		return true
+	}
+	return strings.Contains(constraint, fmt.Sprintf(`"%s"`, ad["IpcUuid"]))
+}
+
+func tschedulerFilter(ads []JobAd, constraint string) []JobAd {
+	var retval []JobAd
+	for _, ad := range ads {
+		if tschedulerMatches(ad, constraint) {
+			retval = append(retval, ad)
+		}
+	}
+	return retval
+}
+
+func (s *tscheduler) Submit(submissionPath string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.submitted = append(s.submitted, submissionPath)
+	if len(s.submitErrs) > 0 {
+		err := s.submitErrs[0]
+		s.submitErrs = s.submitErrs[1:]
 		if err != nil {
-			t.Error(errors.Wrapf(err, "failed to get the absolute path to %s", csPath))
+			return "", err
+		}
+	}
+	id := strconv.Itoa(s.nextID)
+	s.nextID++
+	return id, nil
+}
+
+func (s *tscheduler) Remove(constraint string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removed = append(s.removed, constraint)
+	return []byte(fmt.Sprintf("%s was stopped\n", constraint)), nil
+}
+
+func (s *tscheduler) Release(constraint string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.released = append(s.released, constraint)
+	return []byte(fmt.Sprintf("%s was released\n", constraint)), nil
+}
+
+func (s *tscheduler) QueryByConstraint(constraint string, attrs ...string) ([]JobAd, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return tschedulerFilter(s.queue, constraint), nil
+}
+
+func (s *tscheduler) History(constraint string, limit int, attrs ...string) ([]JobAd, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ads := tschedulerFilter(s.history, constraint)
+	if limit > 0 && len(ads) > limit {
+		ads = ads[:limit]
+	}
+	return ads, nil
+}
+
+func (s *tscheduler) Totals() (QueueTotals, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.totals, s.totalsErr
+}
+
+// tacknowledger is an amqp.Acknowledger that records how a delivery was
+// acknowledged.
+type tacknowledger struct {
+	mutex    sync.Mutex
+	acked    bool
+	rejected bool
+	requeued bool
+}
+
+func (a *tacknowledger) Ack(tag uint64, multiple bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.acked = true
+	return nil
+}
+
+func (a *tacknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rejected = true
+	a.requeued = requeue
+	return nil
+}
+
+func (a *tacknowledger) Reject(tag uint64, requeue bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rejected = true
+	a.requeued = requeue
+	return nil
+}
+
+// settled waits up to a second for a delivery that's handled in the
+// background to be acknowledged or rejected. It returns false if it wasn't.
+func (a *tacknowledger) settled() bool {
+	deadline := time.Now().Add(time.Second)
+	for {
+		a.mutex.Lock()
+		done := a.acked || a.rejected
+		a.mutex.Unlock()
+		if done {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
 		}
+		time.Sleep(time.Millisecond)
 	}
-	crPath, err := exec.LookPath("condor_rm")
+}
+
+// launchDelivery returns an amqp.Delivery containing a launch request for the
+// job along with the acknowledger for it.
+func launchDelivery(t *testing.T, j *model.Job) (amqp.Delivery, *tacknowledger) {
+	body, err := json.Marshal(messaging.NewLaunchRequest(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &tacknowledger{}
+	return amqp.Delivery{Acknowledger: ack, Body: body}, ack
+}
+
+// lookupTestExec finds the absolute path to one of the stand-in HTCondor
+// commands in the test directory.
+func lookupTestExec(t *testing.T, execName string) string {
+	execPath, err := exec.LookPath(execName)
 	if err != nil {
-		t.Error(errors.Wrap(err, "failed to find condor_rm on the $PATH"))
+		t.Error(errors.Wrapf(err, "failed to find %s in $PATH", execName))
 	}
-	if !path.IsAbs(crPath) {
-		crPath, err = filepath.Abs(crPath)
+	if !path.IsAbs(execPath) {
+		execPath, err = filepath.Abs(execPath)
 		if err != nil {
-			t.Error(errors.Wrapf(err, "failed to get the absolute path for %s", crPath))
+			t.Error(errors.Wrapf(err, "failed to get the absolute path to %s", execPath))
 		}
 	}
+	return execPath
+}
+
+// newTestScheduler returns an *HTCondorScheduler that runs the stand-in
+// HTCondor commands in the test directory.
+func newTestScheduler(t *testing.T) *HTCondorScheduler {
+	test.InitPath(t)
+	return NewHTCondorScheduler(
+		lookupTestExec(t, "condor_submit"),
+		lookupTestExec(t, "condor_rm"),
+		lookupTestExec(t, "condor_q"),
+		lookupTestExec(t, "condor_history"),
+		lookupTestExec(t, "condor_release"),
+		"",
+		"",
+	)
+}
+
+func TestLaunch(t *testing.T) {
+	cfg := test.InitConfig(t)
 	filesystem := newtsys()
-	cl := New(cfg, nil, filesystem, csPath, crPath)
-	if err != nil {
-		t.Error(err)
-	}
+	cl := New(cfg, nil, filesystem, newTestScheduler(t))
 	data, err := ioutil.ReadFile("test/test_submission.json")
 	if err != nil {
 		t.Error(err)
@@ -84,7 +294,7 @@ func TestLaunch(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	actual, err := cl.launch(j, "", "")
+	actual, err := cl.launch(j)
 	if err != nil {
 		t.Error(err)
 	}
@@ -98,3 +308,72 @@ func TestLaunch(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLaunchInvalidJobRemovesIRODSConfig(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cl := New(cfg, nil, newtsys(), newTestScheduler(t))
+	j := test.InitTests(t, cfg)
+	defer os.RemoveAll(path.Join(j.CondorLogPath, j.Submitter))
+	j.Steps[0].Component.Name = "wc\nqueue"
+
+	_, err := cl.launch(j)
+	if _, ok := err.(JobFieldErrors); !ok {
+		t.Fatalf("launch returned %v instead of JobFieldErrors", err)
+	}
+	if _, err = os.Stat(path.Join(jobLogsDirectory(j), irodsConfigName)); !os.IsNotExist(err) {
+		t.Errorf("the irods-config file was kept after the job couldn't be rendered: %v", err)
+	}
+}
+
+func TestHandleLaunchRequestsExistingJob(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+
+	j := test.InitTests(t, cfg)
+	scheduler.history = []JobAd{{"IpcUuid": j.InvocationID, "ClusterId": "12345"}}
+
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("a duplicate job was submitted: %v", scheduler.submitted)
+	}
+	if !ack.acked {
+		t.Error("the launch request was not acknowledged")
+	}
+	if len(client.updates) != 1 {
+		t.Fatalf("%d updates were published instead of 1", len(client.updates))
+	}
+	u := client.updates[0]
+	if u.State != messaging.SubmittedState || !strings.Contains(u.Message, "12345") {
+		t.Errorf("unexpected update for the existing job: %s %q", u.State, u.Message)
+	}
+}
+
+func TestHandleLaunchRequestsNewJob(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+
+	j := test.InitTests(t, cfg)
+	defer os.RemoveAll(path.Join(j.CondorLogPath, j.Submitter))
+
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if len(scheduler.submitted) != 1 {
+		t.Errorf("%d jobs were submitted instead of 1", len(scheduler.submitted))
+	}
+	if !ack.acked {
+		t.Error("the launch request was not acknowledged")
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.SubmittedState {
+		t.Errorf("a single Submitted update was not published: %#v", client.updates)
+	}
+	if entries := cl.journal.Entries(); len(entries) != 0 {
+		t.Errorf("the journal kept %#v without a status monitor", entries)
+	}
+}
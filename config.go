@@ -1,6 +1,13 @@
 package main
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
 
 // CopyConfig will create a new *viper.Viper containing all of the settings
 // from the *viper.Viper passed in. Updating one will not update the other.
@@ -11,3 +18,154 @@ func CopyConfig(cfg *viper.Viper) *viper.Viper {
 	}
 	return new
 }
+
+// setDefault sets the default value of a setting. viper doesn't fall back to
+// the defaults for a nested setting when the config file contains its parent
+// but not the setting itself, so the value is set directly in that case.
+func setDefault(cfg *viper.Viper, key string, value interface{}) {
+	cfg.SetDefault(key, value)
+	if cfg.Get(key) == nil {
+		cfg.Set(key, value)
+	}
+}
+
+// SetDefaults sets the default values of the condor-launcher settings that
+// aren't covered by configurate.JobServicesDefaults.
+func SetDefaults(cfg *viper.Viper) {
+	setDefault(cfg, "condor.status_monitor.enabled", false)
+	setDefault(cfg, "condor.status_monitor.interval", "30s")
+	setDefault(cfg, "condor.status_monitor.source", "poll")
+	setDefault(cfg, "condor.held_jobs.interval", "30s")
+	setDefault(cfg, "condor.admin.listen_addr", "")
+	setDefault(cfg, "condor.admin.token", "")
+	setDefault(cfg, "condor.shutdown_timeout", "60s")
+	setDefault(cfg, "condor.dead_letter.exchange", "")
+	setDefault(cfg, "condor.dead_letter.routing_key", "condor-launcher.dead-letters")
+	setDefault(cfg, "condor.dead_letter.quarantine_dir", "")
+	setDefault(cfg, "condor.time_limits.enabled", false)
+	setDefault(cfg, "condor.time_limits.default", "0s")
+	setDefault(cfg, "condor.time_limits.interval", "30s")
+	setDefault(cfg, "condor.templates.dir", "")
+	setDefault(cfg, "condor.janitor.enabled", false)
+	setDefault(cfg, "condor.janitor.interval", "1h")
+	setDefault(cfg, "condor.janitor.retention.succeeded", "168h")
+	setDefault(cfg, "condor.janitor.retention.failed", "720h")
+	setDefault(cfg, "condor.janitor.max_bytes", 0)
+	setDefault(cfg, "condor.janitor.archive_dir", "")
+	setDefault(cfg, "condor.rate_limits.global.rate", 0)
+	setDefault(cfg, "condor.rate_limits.global.burst", 1)
+	setDefault(cfg, "condor.rate_limits.per_user.rate", 0)
+	setDefault(cfg, "condor.rate_limits.per_user.burst", 1)
+	setDefault(cfg, "condor.rate_limits.defer_delay", "5s")
+	setDefault(cfg, "condor.schedd_name", "")
+	setDefault(cfg, "condor.pool", "")
+	setDefault(cfg, "condor.transfer_data_interval", "1m")
+	setDefault(cfg, "condor.scheduler", "local")
+	setDefault(cfg, "condor.ssh.host", "")
+	setDefault(cfg, "condor.ssh.user", "")
+	setDefault(cfg, "condor.ssh.key_file", "")
+	setDefault(cfg, "condor.ssh.host_key", "")
+	setDefault(cfg, "condor.ssh.remote_dir", "")
+	setDefault(cfg, "condor.ssh.connect_timeout", "30s")
+	setDefault(cfg, "condor.command_timeouts.submit", "2m")
+	setDefault(cfg, "condor.command_timeouts.rm", "1m")
+	setDefault(cfg, "condor.command_timeouts.q", "1m")
+	setDefault(cfg, "condor.command_timeouts.history", "2m")
+	setDefault(cfg, "condor.command_timeouts.release", "1m")
+	setDefault(cfg, "condor.command_timeouts.transfer_data", "10m")
+	setDefault(cfg, "condor.submit_retry.max_retries", 3)
+	setDefault(cfg, "condor.submit_retry.initial_delay", "2s")
+	setDefault(cfg, "condor.submit_retry.max_delay", "30s")
+	setDefault(cfg, "condor.backpressure.enabled", false)
+	setDefault(cfg, "condor.backpressure.max_idle_jobs", 0)
+	setDefault(cfg, "condor.backpressure.resume_idle_jobs", 0)
+	setDefault(cfg, "condor.backpressure.interval", "30s")
+	setDefault(cfg, "condor.quotas.enabled", false)
+	setDefault(cfg, "condor.quotas.default_limit", 0)
+	setDefault(cfg, "condor.quotas.users", map[string]interface{}{})
+	setDefault(cfg, "condor.quotas.groups", map[string]interface{}{})
+	setDefault(cfg, "condor.quotas.action", quotaActionFail)
+	setDefault(cfg, "irods.password.source", "config")
+	setDefault(cfg, "irods.password.file", "")
+	setDefault(cfg, "irods.password.env", "IRODS_PASSWORD")
+	setDefault(cfg, "irods.password.url", "")
+	setDefault(cfg, "irods.password.token_file", "")
+	setDefault(cfg, "irods.password.field", "password")
+	setDefault(cfg, "irods.password.cache_ttl", "5m")
+	setDefault(cfg, "irods.password.timeout", "10s")
+}
+
+// loadConfig reads the config file at path and fills in the defaults.
+func loadConfig(path string) (*viper.Viper, error) {
+	cfg, err := configurate.InitDefaults(path, configurate.JobServicesDefaults)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize configuration defaults")
+	}
+	SetDefaults(cfg)
+	return cfg, nil
+}
+
+// durationConfigKeys lists the settings that are parsed as durations.
+var durationConfigKeys = []string{
+	"condor.status_monitor.interval",
+	"condor.held_jobs.interval",
+	"condor.shutdown_timeout",
+	"condor.time_limits.default",
+	"condor.time_limits.interval",
+	"condor.janitor.interval",
+	"condor.janitor.retention.succeeded",
+	"condor.janitor.retention.failed",
+	"condor.rate_limits.defer_delay",
+	"condor.backpressure.interval",
+	"condor.ssh.connect_timeout",
+	"condor.command_timeouts.submit",
+	"condor.command_timeouts.rm",
+	"condor.command_timeouts.q",
+	"condor.command_timeouts.history",
+	"condor.command_timeouts.release",
+	"condor.command_timeouts.transfer_data",
+	"condor.transfer_data_interval",
+	"condor.submit_retry.initial_delay",
+	"condor.submit_retry.max_delay",
+}
+
+// validateConfig checks the settings that the launcher parses, returning the
+// HeldJobPolicy the config describes.
+func validateConfig(cfg *viper.Viper) (*HeldJobPolicy, error) {
+	for _, key := range durationConfigKeys {
+		if _, err := time.ParseDuration(cfg.GetString(key)); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", key)
+		}
+	}
+	for _, key := range []string{"amqp.prefetch.launches", "amqp.prefetch.stops", "condor.submit_retry.max_retries"} {
+		if cfg.GetInt(key) < 0 {
+			return nil, fmt.Errorf("%s can't be negative", key)
+		}
+	}
+	for _, key := range []string{"condor.rate_limits.global.rate", "condor.rate_limits.per_user.rate"} {
+		if cfg.GetFloat64(key) < 0 {
+			return nil, fmt.Errorf("%s can't be negative", key)
+		}
+	}
+	if scheduler := cfg.GetString("condor.scheduler"); scheduler != "local" && scheduler != "ssh" {
+		return nil, fmt.Errorf("unrecognized condor.scheduler: %s", scheduler)
+	}
+	if cfg.GetBool("condor.status_monitor.enabled") && cfg.GetString("condor.status_monitor.source") == "userlog" {
+		// The user logs of spooled jobs are only retrieved once the jobs
+		// finish, and the user logs of jobs submitted over SSH are only
+		// written on the submit host.
+		if cfg.GetString("condor.schedd_name") != "" {
+			return nil, errors.New("condor.status_monitor.source can't be userlog when condor.schedd_name is set")
+		}
+		if cfg.GetString("condor.scheduler") == "ssh" {
+			return nil, errors.New("condor.status_monitor.source can't be userlog when condor.scheduler is ssh")
+		}
+	}
+	if addr := cfg.GetString("condor.admin.listen_addr"); addr != "" && cfg.GetString("condor.admin.token") == "" && !isLoopbackAddr(addr) {
+		return nil, fmt.Errorf("condor.admin.token must be set when condor.admin.listen_addr (%s) isn't a loopback address", addr)
+	}
+	if _, err := NewQuotaPolicy(cfg); err != nil {
+		return nil, err
+	}
+	return NewHeldJobPolicy(cfg)
+}
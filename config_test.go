@@ -27,3 +27,43 @@ func TestCopyConfig(t *testing.T) {
 	}
 
 }
+
+func TestValidateConfigUserLogSource(t *testing.T) {
+	cfg := viper.New()
+	SetDefaults(cfg)
+	cfg.Set("condor.status_monitor.enabled", true)
+	cfg.Set("condor.status_monitor.source", "userlog")
+	if _, err := validateConfig(cfg); err != nil {
+		t.Errorf("the user log source was rejected for the local scheduler: %v", err)
+	}
+
+	cfg.Set("condor.scheduler", "ssh")
+	if _, err := validateConfig(cfg); err == nil {
+		t.Error("the user log source was accepted for the ssh scheduler")
+	}
+
+	cfg.Set("condor.scheduler", "local")
+	cfg.Set("condor.schedd_name", "schedd.example.org")
+	if _, err := validateConfig(cfg); err == nil {
+		t.Error("the user log source was accepted for spooled jobs")
+	}
+}
+
+func TestValidateConfigAdminToken(t *testing.T) {
+	cfg := viper.New()
+	SetDefaults(cfg)
+	cfg.Set("condor.admin.listen_addr", "127.0.0.1:8080")
+	if _, err := validateConfig(cfg); err != nil {
+		t.Errorf("a loopback admin address was rejected without a token: %v", err)
+	}
+
+	cfg.Set("condor.admin.listen_addr", ":8080")
+	if _, err := validateConfig(cfg); err == nil {
+		t.Error("a public admin address was accepted without a token")
+	}
+
+	cfg.Set("condor.admin.token", "s3cret")
+	if _, err := validateConfig(cfg); err != nil {
+		t.Errorf("a public admin address was rejected with a token: %v", err)
+	}
+}
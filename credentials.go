@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// irodsConfigName is the name of the file in each job's submission directory
+// that contains the iRODS connection settings, including the password.
+const irodsConfigName = "irods-config"
+
+// CredentialProvider supplies the iRODS password that's written to each job's
+// irods-config file.
+type CredentialProvider interface {
+	Password() (string, error)
+}
+
+// NewCredentialProvider returns the CredentialProvider selected by
+// irods.password.source.
+func NewCredentialProvider(cfg *viper.Viper) (CredentialProvider, error) {
+	switch source := cfg.GetString("irods.password.source"); source {
+	case "config":
+		return &configCredentials{cfg: cfg}, nil
+	case "file":
+		fname := cfg.GetString("irods.password.file")
+		if fname == "" {
+			return nil, errors.New("irods.password.file must be set when irods.password.source is file")
+		}
+		return &fileCredentials{path: fname}, nil
+	case "env":
+		return &envCredentials{name: cfg.GetString("irods.password.env")}, nil
+	case "http":
+		return newHTTPCredentials(cfg)
+	default:
+		return nil, fmt.Errorf("unrecognized irods.password.source: %s", source)
+	}
+}
+
+// configCredentials reads the password from irods.pass.
+type configCredentials struct {
+	cfg *viper.Viper
+}
+
+func (c *configCredentials) Password() (string, error) {
+	return c.cfg.GetString("irods.pass"), nil
+}
+
+// fileCredentials reads the password from a file, such as a mounted
+// Kubernetes secret. The file is read every time so that rotated passwords
+// are picked up.
+type fileCredentials struct {
+	path string
+}
+
+func (c *fileCredentials) Password() (string, error) {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the iRODS password from %s", c.path)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// envCredentials reads the password from an environment variable.
+type envCredentials struct {
+	name string
+}
+
+func (c *envCredentials) Password() (string, error) {
+	password, ok := os.LookupEnv(c.name)
+	if !ok {
+		return "", fmt.Errorf("the environment variable %s isn't set", c.name)
+	}
+	return password, nil
+}
+
+// httpCredentials fetches the password from an HTTP secret store, such as
+// Vault. The response must be a JSON object; the password is found by
+// following the dot-separated field names in irods.password.field. The
+// password is cached for irods.password.cache_ttl.
+type httpCredentials struct {
+	url       string
+	tokenFile string // sent as a bearer token if set
+	field     []string
+	ttl       time.Duration
+	client    *http.Client
+
+	mutex    sync.Mutex
+	password string
+	expires  time.Time
+}
+
+func newHTTPCredentials(cfg *viper.Viper) (*httpCredentials, error) {
+	url := cfg.GetString("irods.password.url")
+	if url == "" {
+		return nil, errors.New("irods.password.url must be set when irods.password.source is http")
+	}
+	ttl, err := time.ParseDuration(cfg.GetString("irods.password.cache_ttl"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse irods.password.cache_ttl")
+	}
+	timeout, err := time.ParseDuration(cfg.GetString("irods.password.timeout"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse irods.password.timeout")
+	}
+	return &httpCredentials{
+		url:       url,
+		tokenFile: cfg.GetString("irods.password.token_file"),
+		field:     strings.Split(cfg.GetString("irods.password.field"), "."),
+		ttl:       ttl,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (c *httpCredentials) Password() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.password != "" && time.Now().Before(c.expires) {
+		return c.password, nil
+	}
+	password, err := c.fetch()
+	if err != nil {
+		return "", err
+	}
+	c.password = password
+	c.expires = time.Now().Add(c.ttl)
+	return password, nil
+}
+
+// fetch requests the password from the secret store.
+func (c *httpCredentials) fetch() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create the request for %s", c.url)
+	}
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read the secret store token from %s", c.tokenFile)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to request the iRODS password from %s", c.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the secret store at %s responded with %s", c.url, resp.Status)
+	}
+
+	var value interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&value); err != nil {
+		return "", errors.Wrapf(err, "failed to decode the response from %s", c.url)
+	}
+	for _, name := range c.field {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("the response from %s has no %s field", c.url, name)
+		}
+		value = obj[name]
+	}
+	password, ok := value.(string)
+	if !ok || password == "" {
+		return "", fmt.Errorf("the response from %s doesn't contain a password in %s", c.url, strings.Join(c.field, "."))
+	}
+	return password, nil
+}
+
+// writeSecretFile writes a file that only the launcher's user can read. Any
+// existing file is removed first because WriteFile keeps the mode of files
+// that already exist.
+func writeSecretFile(fname string, data []byte) error {
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove %s", fname)
+	}
+	return errors.Wrapf(ioutil.WriteFile(fname, data, 0600), "failed to write to file %s", fname)
+}
+
+// removeIRODSConfig removes the irods-config file from a job's submission
+// directory, along with the copy of it on the submit host if the scheduler
+// made one. It's called once the job has finished, or when it won't run. The
+// file is needed until then because HTCondor transfers it again whenever the
+// job is rescheduled.
+func removeIRODSConfig(scheduler Scheduler, dir string) {
+	if dir == "" {
+		return
+	}
+	if u, ok := scheduler.(unstager); ok {
+		if err := u.Unstage(dir, irodsConfigName); err != nil {
+			log.Errorf("%+v\n", err)
+		}
+	}
+	fname := path.Join(dir, irodsConfigName)
+	err := os.Remove(fname)
+	switch {
+	case err == nil:
+		log.Infof("removed %s", fname)
+	case !os.IsNotExist(err):
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to remove %s", fname))
+	}
+}
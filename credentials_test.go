@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestFileCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from-a-file\n")
+	f.Close()
+
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("irods.password.source", "file")
+	cfg.Set("irods.password.file", f.Name())
+	provider, err := NewCredentialProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, err := provider.Password(); err != nil || password != "from-a-file" {
+		t.Errorf("Password returned (%q, %v)", password, err)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("irods.password.source", "env")
+	cfg.Set("irods.password.env", "CONDOR_LAUNCHER_TEST_PASSWORD")
+	provider, err := NewCredentialProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Unsetenv("CONDOR_LAUNCHER_TEST_PASSWORD")
+	if _, err = provider.Password(); err == nil {
+		t.Error("a password was returned for an unset environment variable")
+	}
+	os.Setenv("CONDOR_LAUNCHER_TEST_PASSWORD", "from-the-env")
+	defer os.Unsetenv("CONDOR_LAUNCHER_TEST_PASSWORD")
+	if password, err := provider.Password(); err != nil || password != "from-the-env" {
+		t.Errorf("Password returned (%q, %v)", password, err)
+	}
+}
+
+func TestHTTPCredentials(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer s3cr3t-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"data": {"password": "from-the-store"}}}`))
+	}))
+	defer server.Close()
+
+	tokenFile, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("s3cr3t-token\n")
+	tokenFile.Close()
+
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("irods.password.source", "http")
+	cfg.Set("irods.password.url", server.URL+"/v1/secret/data/irods")
+	cfg.Set("irods.password.field", "data.data.password")
+	provider, err := NewCredentialProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.Password(); err == nil {
+		t.Error("a password was returned without a token")
+	}
+
+	cfg.Set("irods.password.token_file", tokenFile.Name())
+	if provider, err = NewCredentialProvider(cfg); err != nil {
+		t.Fatal(err)
+	}
+	requests = 0
+	for i := 0; i < 2; i++ {
+		if password, err := provider.Password(); err != nil || password != "from-the-store" {
+			t.Errorf("Password returned (%q, %v)", password, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("the password was requested %d times instead of being cached", requests)
+	}
+
+	cfg.Set("irods.password.field", "data.password")
+	if provider, err = NewCredentialProvider(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.Password(); err == nil {
+		t.Error("a password was returned from a missing field")
+	}
+}
+
+func TestStoreConfigCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irods-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := test.InitConfig(t)
+	cl := New(cfg, newtmessenger(), newtsys(), newtscheduler())
+	cl.credentials = &fileCredentials{path: filepath.Join(dir, "missing")}
+	j := test.InitTests(t, cfg)
+	if err = cl.storeConfig(j, dir); err == nil {
+		t.Error("the irods-config file was written without a password")
+	}
+
+	// An existing file keeps its mode unless it's replaced.
+	fname := filepath.Join(dir, irodsConfigName)
+	if err = ioutil.WriteFile(fname, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CONDOR_LAUNCHER_TEST_PASSWORD", "from-the-env")
+	defer os.Unsetenv("CONDOR_LAUNCHER_TEST_PASSWORD")
+	cl.credentials = &envCredentials{name: "CONDOR_LAUNCHER_TEST_PASSWORD"}
+	if err = cl.storeConfig(j, dir); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the irods-config file has mode %o instead of 0600", info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "porklock.irods-pass = from-the-env") {
+		t.Errorf("the irods-config file doesn't contain the password:\n%s", data)
+	}
+}
+
+func TestStatusMonitorRemovesIRODSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irods-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	scheduler := newtscheduler()
+	monitor := NewStatusMonitor(scheduler, newtmessenger(), NewMemoryJournal())
+	job := &model.Job{InvocationID: "07b04ce2-7757-4b21-9e15-0b4c2f44be26", Submitter: "test", CondorLogPath: dir}
+	fname := path.Join(jobLogsDirectory(job), irodsConfigName)
+	if err = os.MkdirAll(path.Dir(fname), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fname, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	monitor.Track(job, "1")
+
+	// The file is transferred again if the job is evicted and rescheduled.
+	ad := JobAd{"IpcUuid": job.InvocationID, "ClusterId": "1", "JobStatus": jobStatusRunning}
+	scheduler.queue = []JobAd{ad}
+	monitor.Poll()
+	ad["JobStatus"] = jobStatusIdle
+	monitor.Poll()
+	if _, err = os.Stat(fname); err != nil {
+		t.Errorf("the irods-config file was removed before the job finished: %v", err)
+	}
+
+	ad["JobStatus"] = jobStatusCompleted
+	ad["ExitCode"] = "0"
+	monitor.Poll()
+	if _, err = os.Stat(fname); !os.IsNotExist(err) {
+		t.Error("the irods-config file wasn't removed after the job finished")
+	}
+}
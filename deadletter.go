@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+// DeadLetter records a message that the launcher gave up on, along with the
+// reason it was given up on and enough of the original delivery to replay it.
+type DeadLetter struct {
+	Error          string     `json:"error"`
+	DeadLetteredAt time.Time  `json:"dead_lettered_at"`
+	Timestamp      time.Time  `json:"timestamp"` // when the message was originally published
+	Exchange       string     `json:"exchange"`
+	RoutingKey     string     `json:"routing_key"`
+	Redelivered    bool       `json:"redelivered"`
+	MessageID      string     `json:"message_id,omitempty"`
+	ContentType    string     `json:"content_type,omitempty"`
+	Headers        amqp.Table `json:"headers,omitempty"`
+	Body           []byte     `json:"body"`
+}
+
+// newDeadLetter returns a *DeadLetter for a delivery that failed with err.
+func newDeadLetter(d amqp.Delivery, err error) *DeadLetter {
+	return &DeadLetter{
+		Error:          err.Error(),
+		DeadLetteredAt: time.Now(),
+		Timestamp:      d.Timestamp,
+		Exchange:       d.Exchange,
+		RoutingKey:     d.RoutingKey,
+		Redelivered:    d.Redelivered,
+		MessageID:      d.MessageId,
+		ContentType:    d.ContentType,
+		Headers:        d.Headers,
+		Body:           d.Body,
+	}
+}
+
+// DeadLetterSink stores messages that the launcher gave up on.
+type DeadLetterSink interface {
+	DeadLetter(*DeadLetter) error
+}
+
+// ExchangeSink publishes dead letters to an AMQP exchange.
+type ExchangeSink struct {
+	publisher  Messenger // set up to publish to the dead-letter exchange
+	routingKey string
+}
+
+// NewExchangeSink returns a new *ExchangeSink. The Messenger must already be
+// set up to publish to the dead-letter exchange.
+func NewExchangeSink(publisher Messenger, routingKey string) *ExchangeSink {
+	return &ExchangeSink{publisher: publisher, routingKey: routingKey}
+}
+
+// DeadLetter publishes a dead letter.
+func (s *ExchangeSink) DeadLetter(dl *DeadLetter) error {
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the dead letter")
+	}
+	return errors.Wrapf(s.publisher.Publish(s.routingKey, body), "failed to publish a dead letter with the key %s", s.routingKey)
+}
+
+// Close closes the connection to the dead-letter exchange.
+func (s *ExchangeSink) Close() {
+	s.publisher.Close()
+}
+
+// QuarantineSink writes dead letters to files in a local directory.
+type QuarantineSink struct {
+	dir string
+}
+
+// NewQuarantineSink returns a new *QuarantineSink that writes to dir.
+func NewQuarantineSink(dir string) *QuarantineSink {
+	return &QuarantineSink{dir: dir}
+}
+
+// quarantineFileName returns the name of the file a dead letter is written
+// to. Names sort in the order the messages were quarantined.
+func quarantineFileName(dl *DeadLetter) string {
+	sum := sha256.Sum256(dl.Body)
+	return fmt.Sprintf("%s-%s.json", dl.DeadLetteredAt.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(sum[:6]))
+}
+
+// DeadLetter writes a dead letter to the quarantine directory.
+func (s *QuarantineSink) DeadLetter(dl *DeadLetter) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create the quarantine directory %s", s.dir)
+	}
+	body, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the dead letter")
+	}
+
+	// Write to a temporary file first so that replays never see a partial
+	// message.
+	tmp, err := ioutil.TempFile(s.dir, ".quarantine-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a file in %s", s.dir)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write to %s", tmp.Name())
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tmp.Name())
+	}
+
+	fname := filepath.Join(s.dir, quarantineFileName(dl))
+	return errors.Wrapf(os.Rename(tmp.Name(), fname), "failed to write %s", fname)
+}
+
+// deadLetter hands a delivery that the launcher is giving up on to each of
+// the configured dead-letter sinks. It returns false if there are no sinks or
+// any of them failed, in which case the delivery should be handled as it was
+// before dead-lettering was added.
+func (cl *CondorLauncher) deadLetter(d amqp.Delivery, reason string, cause error) bool {
+	if len(cl.deadLetterSinks) == 0 {
+		return false
+	}
+	dl := newDeadLetter(d, cause)
+	stored := true
+	for _, sink := range cl.deadLetterSinks {
+		if err := sink.DeadLetter(dl); err != nil {
+			log.Errorf("%+v\n", errors.Wrap(err, "failed to dead-letter a message"))
+			stored = false
+		}
+	}
+	if stored {
+		deadLetters.WithLabelValues(reason).Inc()
+	}
+	return stored
+}
+
+// newDeadLetterSinks returns the dead-letter sinks listed in the config.
+// Messages go to the exchange named by condor.dead_letter.exchange and to the
+// directory named by condor.dead_letter.quarantine_dir, if they're set.
+func newDeadLetterSinks(cfg *viper.Viper) ([]DeadLetterSink, error) {
+	var sinks []DeadLetterSink
+
+	if exchange := cfg.GetString("condor.dead_letter.exchange"); exchange != "" {
+		client, err := messaging.NewClient(cfg.GetString("amqp.uri"), true)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create the dead-letter AMQP client")
+		}
+		if err = client.SetupPublishing(exchange); err != nil {
+			return nil, errors.Wrapf(err, "failed to set up publishing to the dead-letter exchange %s", exchange)
+		}
+		sinks = append(sinks, NewExchangeSink(client, cfg.GetString("condor.dead_letter.routing_key")))
+	}
+
+	if dir := cfg.GetString("condor.dead_letter.quarantine_dir"); dir != "" {
+		sinks = append(sinks, NewQuarantineSink(dir))
+	}
+
+	return sinks, nil
+}
+
+// replayFile publishes the message in a quarantine file again and renames the
+// file so that it isn't replayed twice.
+func replayFile(publisher Messenger, fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", fname)
+	}
+	dl := &DeadLetter{}
+	if err = json.Unmarshal(data, dl); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", fname)
+	}
+
+	key := dl.RoutingKey
+	if key == "" {
+		key = messaging.LaunchesKey
+	}
+	if err = publisher.Publish(key, dl.Body); err != nil {
+		return errors.Wrapf(err, "failed to replay %s", fname)
+	}
+
+	return errors.Wrapf(os.Rename(fname, fname+".replayed"), "failed to mark %s as replayed", fname)
+}
+
+// quarantineFiles expands the paths given to the replay command. Directories
+// are replaced with the quarantine files they contain.
+func quarantineFiles(paths []string) ([]string, error) {
+	var retval []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to stat %s", p)
+		}
+		if !info.IsDir() {
+			retval = append(retval, p)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(p, "*.json"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s", p)
+		}
+		for _, m := range matches {
+			if !strings.HasPrefix(filepath.Base(m), ".") {
+				retval = append(retval, m)
+			}
+		}
+	}
+	return retval, nil
+}
+
+// replayQuarantined replays each of the given quarantine files, returning the
+// number that were replayed. It stops at the first failure.
+func replayQuarantined(publisher Messenger, paths []string) (int, error) {
+	files, err := quarantineFiles(paths)
+	if err != nil {
+		return 0, err
+	}
+	for i, f := range files {
+		if err = replayFile(publisher, f); err != nil {
+			return i, err
+		}
+		log.Infof("replayed %s", f)
+	}
+	return len(files), nil
+}
+
+// runReplay implements the replay subcommand, which publishes quarantined
+// messages to the launcher's exchange again.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	cfgPath := flags.String("config", "", "Path to the config file. Required.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: condor-launcher replay --config <path> [file or directory]...")
+		fmt.Fprintln(os.Stderr, "Replays the quarantine directory from the config if no paths are given.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *cfgPath == "" {
+		fmt.Println("Error: --config must be set.")
+		flags.Usage()
+		os.Exit(-1)
+	}
+
+	cfg, err := loadConfig(*cfgPath)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		dir := cfg.GetString("condor.dead_letter.quarantine_dir")
+		if dir == "" {
+			log.Fatal("no paths were given and condor.dead_letter.quarantine_dir isn't set")
+		}
+		paths = []string{dir}
+	}
+
+	client, err := messaging.NewClient(cfg.GetString("amqp.uri"), true)
+	if err != nil {
+		log.Fatalf("%+v\n", errors.Wrap(err, "failed to create new AMQP client"))
+	}
+	defer client.Close()
+	if err = client.SetupPublishing(cfg.GetString("amqp.exchange.name")); err != nil {
+		log.Fatalf("%+v\n", errors.Wrap(err, "failed to set up publishing"))
+	}
+
+	n, err := replayQuarantined(client, paths)
+	log.Infof("replayed %d quarantined messages", n)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
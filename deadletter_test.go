@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestQuarantineAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := test.InitConfig(t)
+	cl := New(cfg, newtmessenger(), newtsys(), newtscheduler())
+	cl.deadLetterSinks = []DeadLetterSink{NewQuarantineSink(dir)}
+
+	ack := &tacknowledger{}
+	published := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	delivery := amqp.Delivery{
+		Acknowledger: ack,
+		Body:         []byte(`{"command": "launch", "job": `),
+		RoutingKey:   messaging.LaunchesKey,
+		Timestamp:    published,
+		Headers:      amqp.Table{"origin": "test"},
+	}
+	cl.handleLaunchRequests()(delivery)
+
+	if !ack.acked {
+		t.Errorf("the dead-lettered delivery wasn't acked: %#v", ack)
+	}
+	files, err := quarantineFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d files were quarantined instead of 1", len(files))
+	}
+
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := &DeadLetter{}
+	if err = json.Unmarshal(data, dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Error == "" || !dl.Timestamp.Equal(published) || dl.Headers["origin"] != "test" || string(dl.Body) != string(delivery.Body) {
+		t.Errorf("unexpected dead letter: %#v", dl)
+	}
+
+	client := newtmessenger()
+	n, err := replayQuarantined(client, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d messages were replayed instead of 1", n)
+	}
+	if bodies := client.published[messaging.LaunchesKey]; len(bodies) != 1 || string(bodies[0]) != string(delivery.Body) {
+		t.Errorf("the replayed messages were %q", bodies)
+	}
+
+	// Replayed files are renamed so that they aren't replayed again.
+	if _, err = os.Stat(files[0] + ".replayed"); err != nil {
+		t.Error(err)
+	}
+	if files, _ = quarantineFiles([]string{dir}); len(files) != 0 {
+		t.Errorf("the replayed files are still in the quarantine: %v", files)
+	}
+}
+
+func TestExchangeSink(t *testing.T) {
+	client := newtmessenger()
+	sink := NewExchangeSink(client, "dead-letters")
+	err := sink.DeadLetter(newDeadLetter(amqp.Delivery{Body: []byte("bad")}, errors.New("unparseable")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := client.published["dead-letters"]
+	if len(bodies) != 1 {
+		t.Fatalf("%d dead letters were published instead of 1", len(bodies))
+	}
+	dl := &DeadLetter{}
+	if err = json.Unmarshal(bodies[0], dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Error != "unparseable" || string(dl.Body) != "bad" {
+		t.Errorf("unexpected dead letter: %#v", dl)
+	}
+}
+
+func TestDeadLetterWithoutSinks(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cl := New(cfg, newtmessenger(), newtsys(), newtscheduler())
+
+	ack := &tacknowledger{}
+	cl.handleLaunchRequests()(amqp.Delivery{Acknowledger: ack, Body: []byte("{")})
+	if !ack.rejected || !ack.requeued {
+		t.Errorf("the malformed delivery wasn't requeued: %#v", ack)
+	}
+	if matches, _ := filepath.Glob("*.json"); len(matches) != 0 {
+		t.Errorf("files were quarantined without a quarantine directory: %v", matches)
+	}
+}
+
+func TestDeadLetterInvalidJob(t *testing.T) {
+	cfg := test.InitConfig(t)
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), newtscheduler())
+	cl.deadLetterSinks = []DeadLetterSink{NewExchangeSink(client, "dead-letters")}
+
+	j := test.InitTests(t, cfg)
+	j.Steps = nil
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if !ack.acked {
+		t.Errorf("the invalid launch request wasn't acked: %#v", ack)
+	}
+	bodies := client.published["dead-letters"]
+	if len(bodies) != 1 {
+		t.Fatalf("%d dead letters were published instead of 1", len(bodies))
+	}
+	dl := &DeadLetter{}
+	if err := json.Unmarshal(bodies[0], dl); err != nil {
+		t.Fatal(err)
+	}
+	if string(dl.Body) != string(delivery.Body) || !strings.Contains(dl.Error, "steps") {
+		t.Errorf("unexpected dead letter: %#v", dl)
+	}
+}
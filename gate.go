@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Gate blocks the callers of Wait while it's paused. A Gate can be paused for
+// several reasons at once, and it only opens again once every reason has been
+// cleared.
+type Gate struct {
+	mutex   sync.Mutex
+	reasons map[string]bool
+	open    chan struct{} // closed while the gate is open
+}
+
+// NewGate returns a new *Gate that's open.
+func NewGate() *Gate {
+	open := make(chan struct{})
+	close(open)
+	return &Gate{
+		reasons: make(map[string]bool),
+		open:    open,
+	}
+}
+
+// Pause closes the gate for the given reason.
+func (g *Gate) Pause(reason string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.reasons) == 0 {
+		g.open = make(chan struct{})
+	}
+	g.reasons[reason] = true
+}
+
+// Resume clears the given reason, opening the gate if no others remain.
+func (g *Gate) Resume(reason string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.reasons[reason] {
+		return
+	}
+	delete(g.reasons, reason)
+	if len(g.reasons) == 0 {
+		close(g.open)
+	}
+}
+
+// Reasons returns the sorted reasons the gate is paused for. It's empty if
+// the gate is open.
+func (g *Gate) Reasons() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	retval := make([]string, 0, len(g.reasons))
+	for reason := range g.reasons {
+		retval = append(retval, reason)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+// Wait blocks until the gate is open.
+func (g *Gate) Wait() {
+	g.mutex.Lock()
+	open := g.open
+	g.mutex.Unlock()
+	<-open
+}
+
+// Limiter limits the number of callers that hold it at once. The limit can be
+// changed while it's in use; callers that already hold it keep it.
+type Limiter struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	limit  int // zero means there's no limit
+	active int
+}
+
+// NewLimiter returns a new *Limiter. A limit of zero means there's no limit.
+func NewLimiter(limit int) *Limiter {
+	l := &Limiter{limit: limit}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// Acquire blocks until the number of holders is below the limit.
+func (l *Limiter) Acquire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.limit > 0 && l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// Release gives up a hold acquired with Acquire.
+func (l *Limiter) Release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	l.cond.Broadcast()
+}
+
+// SetLimit changes the limit.
+func (l *Limiter) SetLimit(limit int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func waitReturns(g *Gate) bool {
+	done := make(chan struct{})
+	go func() {
+		g.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func TestGate(t *testing.T) {
+	g := NewGate()
+	if !waitReturns(g) {
+		t.Fatal("Wait blocked on a new gate")
+	}
+
+	g.Pause("b")
+	g.Pause("a")
+	if actual := g.Reasons(); !reflect.DeepEqual(actual, []string{"a", "b"}) {
+		t.Errorf("Reasons returned %v instead of [a b]", actual)
+	}
+	if waitReturns(g) {
+		t.Fatal("Wait returned while the gate was paused")
+	}
+
+	g.Resume("a")
+	g.Resume("c")
+	if waitReturns(g) {
+		t.Fatal("Wait returned before every reason was cleared")
+	}
+
+	g.Resume("b")
+	if !waitReturns(g) {
+		t.Fatal("Wait blocked after the gate was resumed")
+	}
+	if len(g.Reasons()) != 0 {
+		t.Errorf("the resumed gate is still paused for %v", g.Reasons())
+	}
+}
+
+func acquireReturns(l *Limiter) bool {
+	done := make(chan struct{})
+	go func() {
+		l.Acquire()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		// Let the blocked caller go so that it doesn't hold the limiter later.
+		go func() {
+			<-done
+			l.Release()
+		}()
+		return false
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1)
+	if !acquireReturns(l) {
+		t.Fatal("Acquire blocked on an unused limiter")
+	}
+	if acquireReturns(l) {
+		t.Fatal("Acquire returned while the limiter was at its limit")
+	}
+
+	l.SetLimit(0)
+	if !acquireReturns(l) {
+		t.Fatal("Acquire blocked without a limit")
+	}
+}
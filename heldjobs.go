@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// The actions that can be taken for a held job.
+const (
+	heldActionRelease = "release"
+	heldActionWait    = "wait"
+	heldActionRemove  = "remove"
+)
+
+// heldJobAttrs lists the job attributes needed to apply a HeldJobPolicy.
+// HoldReason is last because it's free text.
+var heldJobAttrs = []string{
+	"IpcUuid",
+	"ClusterId",
+	"HoldReasonCode",
+	"HoldReasonSubCode",
+	"NumHolds",
+	"EnteredCurrentStatus",
+	"HoldReason",
+}
+
+// HeldJobRule is a single entry in the condor.held_jobs.policies list. A rule
+// matches a held job if its HoldReasonCode and HoldReasonSubCode are in the
+// listed codes. An empty list matches any code.
+type HeldJobRule struct {
+	HoldReasonCodes    []int  `mapstructure:"hold_reason_codes"`
+	HoldReasonSubCodes []int  `mapstructure:"hold_reason_subcodes"`
+	Action             string `mapstructure:"action"`
+	MaxReleases        int    `mapstructure:"max_releases"` // for the release action
+	GracePeriod        string `mapstructure:"grace_period"` // for the wait action
+
+	gracePeriod time.Duration
+}
+
+// validate checks the settings of a rule and parses its grace period.
+func (r *HeldJobRule) validate() error {
+	switch r.Action {
+	case heldActionRelease:
+		if r.MaxReleases < 1 {
+			return fmt.Errorf("max_releases must be at least 1 for the %s action", r.Action)
+		}
+	case heldActionWait:
+		d, err := time.ParseDuration(r.GracePeriod)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse the grace_period %q", r.GracePeriod)
+		}
+		r.gracePeriod = d
+	case heldActionRemove:
+	default:
+		return fmt.Errorf("unrecognized action %q", r.Action)
+	}
+	return nil
+}
+
+// containsCode returns true if codes is empty or contains code.
+func containsCode(codes []int, code int) bool {
+	if len(codes) == 0 {
+		return true
+	}
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the rule applies to a job held with the given
+// codes.
+func (r *HeldJobRule) matches(code, subcode int) bool {
+	return containsCode(r.HoldReasonCodes, code) && containsCode(r.HoldReasonSubCodes, subcode)
+}
+
+// HeldJobPolicy decides what to do with jobs in the held state. The rules are
+// checked in order and the first one that matches is applied. Jobs that don't
+// match any rule are removed.
+type HeldJobPolicy struct {
+	rules []HeldJobRule
+}
+
+// NewHeldJobPolicy returns a *HeldJobPolicy containing the rules listed in
+// condor.held_jobs.policies.
+func NewHeldJobPolicy(cfg *viper.Viper) (*HeldJobPolicy, error) {
+	var rules []HeldJobRule
+	if err := cfg.UnmarshalKey("condor.held_jobs.policies", &rules); err != nil {
+		return nil, errors.Wrap(err, "failed to read condor.held_jobs.policies")
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid entry %d in condor.held_jobs.policies", i)
+		}
+	}
+	return &HeldJobPolicy{rules: rules}, nil
+}
+
+// heldJobDecision is the outcome of applying a HeldJobPolicy to a held job.
+type heldJobDecision struct {
+	action string
+	reason string // why the action was chosen
+}
+
+// adInt parses an integer attribute of a job ad. Missing and undefined
+// attributes are treated as zero.
+func adInt(ad JobAd, attr string) int {
+	i, err := strconv.Atoi(ad[attr])
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+// heldDuration returns how long a held job has been in the held state.
+func heldDuration(ad JobAd, now time.Time) time.Duration {
+	since, err := strconv.ParseInt(ad["EnteredCurrentStatus"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return now.Sub(time.Unix(since, 0))
+}
+
+// Decide determines what should be done with a held job.
+func (p *HeldJobPolicy) Decide(ad JobAd, now time.Time) heldJobDecision {
+	code := adInt(ad, "HoldReasonCode")
+	subcode := adInt(ad, "HoldReasonSubCode")
+
+	for _, r := range p.rules {
+		if !r.matches(code, subcode) {
+			continue
+		}
+		switch r.Action {
+		case heldActionRelease:
+			// NumHolds includes the current hold.
+			releases := adInt(ad, "NumHolds") - 1
+			if releases >= r.MaxReleases {
+				return heldJobDecision{heldActionRemove, fmt.Sprintf("it was already released %d times", releases)}
+			}
+			return heldJobDecision{heldActionRelease, fmt.Sprintf("release %d of %d", releases+1, r.MaxReleases)}
+		case heldActionWait:
+			held := heldDuration(ad, now)
+			if held >= r.gracePeriod {
+				return heldJobDecision{heldActionRemove, fmt.Sprintf("it was held for longer than %s", r.gracePeriod)}
+			}
+			return heldJobDecision{heldActionWait, fmt.Sprintf("held for %s of %s", held.Truncate(time.Second), r.gracePeriod)}
+		default:
+			return heldJobDecision{heldActionRemove, fmt.Sprintf("hold code %d/%d", code, subcode)}
+		}
+	}
+
+	return heldJobDecision{heldActionRemove, "no held job policy matched"}
+}
+
+// heldMessage describes the action taken for a held job in a job update.
+func heldMessage(ad JobAd, d heldJobDecision) string {
+	var verb string
+	switch d.action {
+	case heldActionRelease:
+		verb = "released"
+	case heldActionRemove:
+		verb = "removed"
+	default:
+		verb = "left in the queue"
+	}
+	reason := strings.TrimSpace(ad["HoldReason"])
+	if reason == "" || reason == "undefined" {
+		reason = "no hold reason was given"
+	}
+	return fmt.Sprintf("Condor ID %s was held (%s) and was %s (%s)", ad["ClusterId"], reason, verb, d.reason)
+}
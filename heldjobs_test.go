@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/messaging.v6"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+var heldJobsConfig = []byte(`
+condor:
+  held_jobs:
+    policies:
+      - hold_reason_codes: [13]
+        action: release
+        max_releases: 2
+      - hold_reason_codes: [34]
+        hold_reason_subcodes: [0]
+        action: wait
+        grace_period: 1h
+      - hold_reason_codes: [1]
+        action: remove
+`)
+
+func newHeldJobPolicy(t *testing.T) *HeldJobPolicy {
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadConfig(bytes.NewBuffer(heldJobsConfig)); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewHeldJobPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func heldAd(invocationID string, code, subcode, numHolds int, since time.Time) JobAd {
+	return JobAd{
+		"IpcUuid":              invocationID,
+		"ClusterId":            "10000",
+		"HoldReasonCode":       strconv.Itoa(code),
+		"HoldReasonSubCode":    strconv.Itoa(subcode),
+		"NumHolds":             strconv.Itoa(numHolds),
+		"EnteredCurrentStatus": strconv.FormatInt(since.Unix(), 10),
+		"HoldReason":           "Error from slot1@host: something went wrong",
+	}
+}
+
+func TestHeldJobPolicyDecide(t *testing.T) {
+	policy := newHeldJobPolicy(t)
+	now := time.Now()
+
+	cases := []struct {
+		ad     JobAd
+		action string
+	}{
+		{heldAd("a", 13, 0, 1, now), heldActionRelease},
+		{heldAd("a", 13, 2, 2, now), heldActionRelease},
+		{heldAd("a", 13, 0, 3, now), heldActionRemove},
+		{heldAd("a", 34, 0, 1, now.Add(-time.Minute)), heldActionWait},
+		{heldAd("a", 34, 0, 1, now.Add(-2*time.Hour)), heldActionRemove},
+		{heldAd("a", 34, 1, 1, now), heldActionRemove},
+		{heldAd("a", 1, 0, 1, now), heldActionRemove},
+		{heldAd("a", 12, 0, 1, now), heldActionRemove},
+	}
+	for _, c := range cases {
+		d := policy.Decide(c.ad, now)
+		if d.action != c.action {
+			t.Errorf("Decide(%#v) chose %s (%s) instead of %s", c.ad, d.action, d.reason, c.action)
+		}
+	}
+}
+
+func TestNewHeldJobPolicyInvalid(t *testing.T) {
+	cases := []map[string]interface{}{
+		{"action": "ignore"},
+		{"action": "release"},
+		{"action": "wait", "grace_period": "a while"},
+	}
+	for _, c := range cases {
+		cfg := viper.New()
+		cfg.Set("condor.held_jobs.policies", []interface{}{c})
+		if _, err := NewHeldJobPolicy(cfg); err == nil {
+			t.Errorf("NewHeldJobPolicy accepted the rule %#v", c)
+		}
+	}
+}
+
+func TestHandleHeldJobs(t *testing.T) {
+	const (
+		releaseID = "0b1f5a8e-5a4e-4c59-9a39-8c5c1a0e6a01"
+		waitID    = "0b1f5a8e-5a4e-4c59-9a39-8c5c1a0e6a02"
+		removeID  = "0b1f5a8e-5a4e-4c59-9a39-8c5c1a0e6a03"
+	)
+
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+	cl.heldPolicy = newHeldJobPolicy(t)
+
+	now := time.Now()
+	scheduler.queue = []JobAd{
+		heldAd(releaseID, 13, 0, 1, now),
+		heldAd(waitID, 34, 0, 1, now),
+		heldAd(removeID, 1, 0, 1, now),
+	}
+	if err := cl.journal.Record(JournalEntry{InvocationID: releaseID, State: messaging.SubmittedState}); err != nil {
+		t.Fatal(err)
+	}
+
+	handleHeldJobs(cl)
+
+	// Without a status monitor nothing else is published for the released
+	// job, so the journal shouldn't keep it.
+	if entry, ok := cl.journal.Entry(releaseID); ok {
+		t.Errorf("the released job is still in the journal: %+v", entry)
+	}
+
+	if len(scheduler.released) != 1 || scheduler.released[0] != ipcUUIDConstraint(releaseID) {
+		t.Errorf("unexpected releases: %v", scheduler.released)
+	}
+	if len(scheduler.removed) != 1 || scheduler.removed[0] != ipcUUIDConstraint(removeID) {
+		t.Errorf("unexpected removals: %v", scheduler.removed)
+	}
+	if len(client.updates) != 2 {
+		t.Fatalf("%d updates were published instead of 2", len(client.updates))
+	}
+	for _, u := range client.updates {
+		if !strings.Contains(u.Message, "something went wrong") {
+			t.Errorf("the update for %s doesn't contain the hold reason: %s", u.Job.InvocationID, u.Message)
+		}
+		switch u.Job.InvocationID {
+		case releaseID:
+			if u.State != messaging.SubmittedState || !strings.Contains(u.Message, "released") {
+				t.Errorf("unexpected update for the released job: %s %s", u.State, u.Message)
+			}
+		case removeID:
+			if u.State != messaging.FailedState || !strings.Contains(u.Message, "removed") {
+				t.Errorf("unexpected update for the removed job: %s %s", u.State, u.Message)
+			}
+		default:
+			t.Errorf("an update was published for %s", u.Job.InvocationID)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/userlog"
+)
+
+// The final states the janitor distinguishes when applying retention periods.
+const (
+	janitorSucceeded = "succeeded"
+	janitorFailed    = "failed"
+)
+
+// submissionDir is a job submission directory found by the janitor.
+type submissionDir struct {
+	dir          string // the job directory, which contains the logs directory
+	invocationID string
+	modified     time.Time // when anything in the directory last changed
+	size         int64
+}
+
+// Janitor removes old job submission directories from condor.log_path, along
+// with their copies on the submit host if the scheduler made any. A directory
+// is only considered if its logs directory contains the job JSON written by
+// the launcher, and it's never removed while the job is in the queue or the
+// launcher is still working on it.
+type Janitor struct {
+	logPath    string
+	archiveDir string                   // finished directories are archived here first if it's set
+	retention  map[string]time.Duration // by final state; zero means they're kept
+	maxBytes   int64                    // zero means there's no disk budget
+	scheduler  Scheduler
+	journal    *Journal
+}
+
+// NewJanitor returns a *Janitor configured by the condor.janitor settings.
+func NewJanitor(cfg *viper.Viper, scheduler Scheduler, journal *Journal) (*Janitor, error) {
+	retention := make(map[string]time.Duration)
+	for _, state := range []string{janitorSucceeded, janitorFailed} {
+		key := "condor.janitor.retention." + state
+		d, err := time.ParseDuration(cfg.GetString(key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", key)
+		}
+		retention[state] = d
+	}
+	return &Janitor{
+		logPath:    cfg.GetString("condor.log_path"),
+		archiveDir: cfg.GetString("condor.janitor.archive_dir"),
+		retention:  retention,
+		maxBytes:   cfg.GetInt64("condor.janitor.max_bytes"),
+		scheduler:  scheduler,
+		journal:    journal,
+	}, nil
+}
+
+// readInvocationID returns the invocation ID in the job JSON in a logs
+// directory.
+func readInvocationID(logsDir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(logsDir, "job"))
+	if err != nil {
+		return "", err
+	}
+	var job model.Job
+	if err = json.Unmarshal(data, &job); err != nil {
+		return "", errors.Wrapf(err, "failed to parse the job in %s", logsDir)
+	}
+	if err = validateInvocationID(job.InvocationID); err != nil {
+		return "", errors.Wrapf(err, "the job in %s has an invalid invocation ID", logsDir)
+	}
+	return job.InvocationID, nil
+}
+
+// dirUsage returns the total size of the files in dir and the latest time
+// any of them was modified.
+func dirUsage(dir string) (int64, time.Time, error) {
+	var (
+		size     int64
+		modified time.Time
+	)
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	return size, modified, err
+}
+
+// findSubmissionDirs returns the submission directories in the log path.
+func (j *Janitor) findSubmissionDirs() ([]submissionDir, error) {
+	matches, err := filepath.Glob(filepath.Join(j.logPath, "*", "*", "logs", "job"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the submission directories in %s", j.logPath)
+	}
+	var retval []submissionDir
+	for _, m := range matches {
+		logsDir := filepath.Dir(m)
+		invocationID, err := readInvocationID(logsDir)
+		if err != nil {
+			log.Warnf("skipping %s: %s", logsDir, err)
+			continue
+		}
+		size, modified, err := dirUsage(filepath.Dir(logsDir))
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to measure %s", logsDir))
+			continue
+		}
+		retval = append(retval, submissionDir{
+			dir:          filepath.Dir(logsDir),
+			invocationID: invocationID,
+			modified:     modified,
+			size:         size,
+		})
+	}
+	return retval, nil
+}
+
+// activeJobs returns the invocation IDs of the jobs that are in the queue or
+// that the launcher is still working on. The journal is read before the queue
+// so that a job submitted in between is found in one or the other.
+func (j *Janitor) activeJobs() (map[string]bool, error) {
+	retval := make(map[string]bool)
+	for _, entry := range j.journal.Entries() {
+		if !isTerminalState(entry.State) {
+			retval[entry.InvocationID] = true
+		}
+	}
+	ads, err := j.scheduler.QueryByConstraint(activeJobsConstraint, "IpcUuid")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the jobs in the queue")
+	}
+	for _, ad := range ads {
+		retval[ad["IpcUuid"]] = true
+	}
+	return retval, nil
+}
+
+// RemoveCredentials removes the irods-config files from the submission
+// directories of the jobs that have left the queue. The status monitor
+// removes them as the jobs finish, so this is only needed without it.
+func (j *Janitor) RemoveCredentials() {
+	matches, err := filepath.Glob(filepath.Join(j.logPath, "*", "*", "logs", irodsConfigName))
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to list the irods-config files in %s", j.logPath))
+		return
+	}
+	if len(matches) == 0 {
+		return
+	}
+	active, err := j.activeJobs()
+	if err != nil {
+		log.Errorf("%+v\n", err)
+		return
+	}
+	for _, m := range matches {
+		logsDir := filepath.Dir(m)
+		invocationID, err := readInvocationID(logsDir)
+		if err != nil {
+			log.Warnf("skipping %s: %s", logsDir, err)
+			continue
+		}
+		if !active[invocationID] {
+			log.Infof("removing the irods-config file for job %s, which has left the queue", invocationID)
+			removeIRODSConfig(j.scheduler, logsDir)
+		}
+	}
+}
+
+// finalState returns janitorSucceeded if the user log in a submission
+// directory shows that the job exited with a zero exit code, and
+// janitorFailed otherwise.
+func finalState(dir string) string {
+	f, err := os.Open(filepath.Join(dir, "logs", "condor.log"))
+	if err != nil {
+		return janitorFailed
+	}
+	defer f.Close()
+	events, err := userlog.Parse(f)
+	if err != nil {
+		return janitorFailed
+	}
+	state := janitorFailed
+	for _, ev := range events {
+		if t, ok := ev.(*userlog.TerminatedEvent); ok {
+			if t.Normal && t.ExitCode == 0 {
+				state = janitorSucceeded
+			} else {
+				state = janitorFailed
+			}
+		}
+	}
+	return state
+}
+
+// archive writes the contents of a submission directory to a gzipped tarball
+// in the archive directory. The irods-config file is left out.
+func (j *Janitor) archive(sd submissionDir) error {
+	rel, err := filepath.Rel(j.logPath, sd.dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to determine where to archive %s", sd.dir)
+	}
+	fname := filepath.Join(j.archiveDir, rel+".tar.gz")
+	if err = os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create the directory for %s", fname)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), ".archive")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create the archive for %s", sd.dir)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(sd.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == irodsConfigName || !(info.Mode().IsRegular() || info.IsDir()) {
+			return nil
+		}
+		name, err := filepath.Rel(filepath.Dir(sd.dir), p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to archive %s", sd.dir)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), fname), "failed to archive %s", sd.dir)
+}
+
+// remove archives a submission directory if archiving is enabled and then
+// removes it, along with the user's directory if it's left empty. The copy on
+// the submit host is removed first so that it isn't left behind if that
+// fails.
+func (j *Janitor) remove(sd submissionDir, reason string) error {
+	if j.archiveDir != "" {
+		if err := j.archive(sd); err != nil {
+			return err
+		}
+	}
+	if u, ok := j.scheduler.(unstager); ok {
+		if err := u.RemoveStaged(sd.dir); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(sd.dir); err != nil {
+		return errors.Wrapf(err, "failed to remove %s", sd.dir)
+	}
+	os.Remove(filepath.Dir(sd.dir)) // fails unless the user's directory is empty
+	log.Infof("removed the submission directory %s for job %s (%s)", sd.dir, sd.invocationID, reason)
+	submissionDirsRemoved.WithLabelValues(reason).Inc()
+	return nil
+}
+
+// Run removes the finished submission directories that are older than their
+// retention period, and then the oldest finished directories until the disk
+// budget is met.
+func (j *Janitor) Run(now time.Time) {
+	dirs, err := j.findSubmissionDirs()
+	if err != nil {
+		log.Errorf("%+v\n", err)
+		return
+	}
+	// Nothing is removed unless the queue can be checked.
+	active, err := j.activeJobs()
+	if err != nil {
+		log.Errorf("%+v\n", err)
+		return
+	}
+
+	var (
+		total     int64
+		remaining []submissionDir
+	)
+	for _, sd := range dirs {
+		if active[sd.invocationID] {
+			total += sd.size
+			continue
+		}
+		retention := j.retention[finalState(sd.dir)]
+		if retention > 0 && now.Sub(sd.modified) > retention {
+			if err = j.remove(sd, "retention"); err == nil {
+				continue
+			}
+			log.Errorf("%+v\n", err)
+		}
+		total += sd.size
+		remaining = append(remaining, sd)
+	}
+
+	if j.maxBytes <= 0 || total <= j.maxBytes {
+		return
+	}
+	sort.Slice(remaining, func(a, b int) bool {
+		return remaining[a].modified.Before(remaining[b].modified)
+	})
+	for _, sd := range remaining {
+		if total <= j.maxBytes {
+			break
+		}
+		if err = j.remove(sd, "disk_budget"); err != nil {
+			log.Errorf("%+v\n", err)
+			continue
+		}
+		total -= sd.size
+	}
+	if total > j.maxBytes {
+		log.Warnf("the submission directories use %d bytes, which is over the budget of %d bytes", total, j.maxBytes)
+	}
+}
+
+// startCredentialSweep starts up the code that periodically removes the
+// irods-config files of the jobs that have left the queue.
+func startCredentialSweep(j *Janitor, interval time.Duration) *Ticker {
+	return startTicker(interval, j.RemoveCredentials)
+}
+
+// startJanitor starts up the code that periodically cleans up the submission
+// directories.
+func startJanitor(j *Janitor, interval time.Duration) *Ticker {
+	return startTicker(interval, func() {
+		j.Run(time.Now())
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+const terminatedLog = `005 (10000.000.000) 2019-06-05 15:20:00 Job terminated.
+	(1) Normal termination (return value %d)
+		Usr 0 00:00:00, Sys 0 00:00:00  -  Run Remote Usage
+		Usr 0 00:00:00, Sys 0 00:00:00  -  Run Local Usage
+		Usr 0 00:00:00, Sys 0 00:00:00  -  Total Remote Usage
+		Usr 0 00:00:00, Sys 0 00:00:00  -  Total Local Usage
+	0  -  Run Bytes Sent By Job
+	0  -  Run Bytes Received By Job
+	0  -  Total Bytes Sent By Job
+	0  -  Total Bytes Received By Job
+...
+`
+
+// writeSubmissionDir creates a submission directory under logPath for a job
+// that exited with the given code, or that hasn't finished if the code is
+// negative. Everything in it is given the modification time modified.
+func writeSubmissionDir(t *testing.T, logPath, name, invocationID string, exitCode int, modified time.Time) string {
+	dir := filepath.Join(logPath, "test", name)
+	files := map[string]string{
+		"job":          fmt.Sprintf(`{"uuid": %q}`, invocationID),
+		"iplant.cmd":   "queue\n",
+		"irods-config": "porklock.irods-pass = secret\n",
+	}
+	if exitCode >= 0 {
+		files["condor.log"] = fmt.Sprintf(terminatedLog, exitCode)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		fname := filepath.Join(dir, "logs", name)
+		if err := ioutil.WriteFile(fname, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fname, modified, modified)
+	}
+	os.Chtimes(filepath.Join(dir, "logs"), modified, modified)
+	os.Chtimes(dir, modified, modified)
+	return dir
+}
+
+func newTestJanitor(t *testing.T, logPath string, scheduler Scheduler, journal *Journal) *Janitor {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("condor.log_path", logPath)
+	j, err := NewJanitor(cfg, scheduler, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func exists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+func TestJanitorRetention(t *testing.T) {
+	logPath, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logPath)
+
+	now := time.Now()
+	old := now.Add(-10 * 24 * time.Hour)
+	succeeded := writeSubmissionDir(t, logPath, "succeeded", "07b04ce2-7757-4b21-9e15-0b4c2f44be26", 0, old)
+	failed := writeSubmissionDir(t, logPath, "failed", "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", 1, old)
+	queued := writeSubmissionDir(t, logPath, "queued", "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2", -1, old)
+	launching := writeSubmissionDir(t, logPath, "launching", "8b0a6f4e-5c7d-4e0f-9a61-2b3c4d5e6f70", -1, old)
+	recent := writeSubmissionDir(t, logPath, "recent", "5e7f8a9b-0c1d-4e2f-8a3b-4c5d6e7f8a9b", 0, now)
+	other := filepath.Join(logPath, "test", "other", "logs")
+	if err = os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := newtscheduler()
+	scheduler.queue = []JobAd{{"IpcUuid": "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2"}}
+	journal := NewMemoryJournal()
+	journal.Record(JournalEntry{InvocationID: "8b0a6f4e-5c7d-4e0f-9a61-2b3c4d5e6f70", State: launchingState})
+
+	newTestJanitor(t, logPath, scheduler, journal).Run(now)
+
+	if exists(succeeded) {
+		t.Error("the directory of a job that succeeded a week and a half ago wasn't removed")
+	}
+	for _, dir := range []string{failed, queued, launching, recent, other} {
+		if !exists(dir) {
+			t.Errorf("%s was removed", dir)
+		}
+	}
+}
+
+func TestJanitorDiskBudget(t *testing.T) {
+	logPath, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logPath)
+
+	now := time.Now()
+	oldest := writeSubmissionDir(t, logPath, "oldest", "07b04ce2-7757-4b21-9e15-0b4c2f44be26", 1, now.Add(-3*time.Hour))
+	queued := writeSubmissionDir(t, logPath, "queued", "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2", -1, now.Add(-2*time.Hour))
+	newest := writeSubmissionDir(t, logPath, "newest", "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", 0, now.Add(-time.Hour))
+
+	scheduler := newtscheduler()
+	scheduler.queue = []JobAd{{"IpcUuid": "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2"}}
+	j := newTestJanitor(t, logPath, scheduler, NewMemoryJournal())
+	var total int64
+	for _, dir := range []string{oldest, queued, newest} {
+		size, _, err := dirUsage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += size
+	}
+	j.maxBytes = total - 1
+
+	j.Run(now)
+	if exists(oldest) {
+		t.Error("the oldest directory wasn't removed to meet the disk budget")
+	}
+	if !exists(queued) || !exists(newest) {
+		t.Error("more directories than necessary were removed to meet the disk budget")
+	}
+
+	j.maxBytes = 1
+	j.Run(now)
+	if !exists(queued) {
+		t.Error("the directory of a queued job was removed to meet the disk budget")
+	}
+}
+
+func TestJanitorArchive(t *testing.T) {
+	logPath, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logPath)
+
+	now := time.Now()
+	dir := writeSubmissionDir(t, logPath, "archived", "07b04ce2-7757-4b21-9e15-0b4c2f44be26", 0, now.Add(-30*24*time.Hour))
+	j := newTestJanitor(t, logPath, newtscheduler(), NewMemoryJournal())
+	j.archiveDir = filepath.Join(logPath, "archive")
+	j.Run(now)
+
+	if exists(dir) {
+		t.Fatal("the archived directory wasn't removed")
+	}
+	f, err := os.Open(filepath.Join(j.archiveDir, "test", "archived.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"archived", "archived/logs", "archived/logs/condor.log", "archived/logs/iplant.cmd", "archived/logs/job"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("the archive contained %v instead of %v", names, expected)
+	}
+}
+
+func TestJanitorActiveJobs(t *testing.T) {
+	journal := NewMemoryJournal()
+	journal.Record(JournalEntry{InvocationID: "running", State: messaging.RunningState})
+	journal.Record(JournalEntry{InvocationID: "done", State: messaging.SucceededState})
+	j := &Janitor{scheduler: newtscheduler(), journal: journal}
+	active, err := j.activeJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !active["running"] || active["done"] {
+		t.Errorf("activeJobs returned %v", active)
+	}
+}
+
+func TestJanitorRemoveCredentials(t *testing.T) {
+	logPath, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logPath)
+
+	now := time.Now()
+	queued := writeSubmissionDir(t, logPath, "queued", "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2", -1, now)
+	launching := writeSubmissionDir(t, logPath, "launching", "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", -1, now)
+	finished := writeSubmissionDir(t, logPath, "finished", "07b04ce2-7757-4b21-9e15-0b4c2f44be26", 0, now)
+
+	scheduler := newtscheduler()
+	scheduler.queue = []JobAd{{"IpcUuid": "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2"}}
+	journal := NewMemoryJournal()
+	journal.Record(JournalEntry{InvocationID: "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", State: launchingState})
+	newTestJanitor(t, logPath, scheduler, journal).RemoveCredentials()
+
+	for dir, kept := range map[string]bool{queued: true, launching: true, finished: false} {
+		if exists(filepath.Join(dir, "logs", irodsConfigName)) != kept {
+			t.Errorf("the irods-config file in %s was kept: %t", dir, !kept)
+		}
+	}
+	if !exists(filepath.Join(finished, "logs", "job")) {
+		t.Error("the rest of the finished job's submission directory was removed")
+	}
+}
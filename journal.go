@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// launchingState is recorded in the journal when the launcher starts working
+// on a launch request. It's never published.
+const launchingState messaging.JobState = "Launching"
+
+// forgottenState is recorded in the journal when the launcher stops keeping
+// track of a launch before it finishes, which happens once the job has been
+// submitted if there's no status monitor. It's never published.
+const forgottenState messaging.JobState = "Forgotten"
+
+// journalCompactionRecords is the number of records that can be written to
+// the journal before it's compacted. The journal is only compacted once it
+// holds several times as many records as launches in flight.
+const journalCompactionRecords = 1000
+
+// JournalEntry records what the launcher knows about a single launch. When
+// entries are recorded, empty fields leave the existing values alone.
+type JournalEntry struct {
+	InvocationID  string             `json:"invocation_id"`
+	SubmissionDir string             `json:"submission_dir,omitempty"`
+	ClusterID     string             `json:"cluster_id,omitempty"`
+	State         messaging.JobState `json:"state,omitempty"`
+	Job           *model.Job         `json:"job,omitempty"`
+	Deadline      *time.Time         `json:"deadline,omitempty"` // when the job reaches its time limit
+	Time          time.Time          `json:"time"`
+}
+
+// merge copies the non-empty fields of other into e.
+func (e *JournalEntry) merge(other *JournalEntry) {
+	if other.SubmissionDir != "" {
+		e.SubmissionDir = other.SubmissionDir
+	}
+	if other.ClusterID != "" {
+		e.ClusterID = other.ClusterID
+	}
+	if other.State != "" {
+		e.State = other.State
+	}
+	if other.Job != nil {
+		e.Job = other.Job
+	}
+	if other.Deadline != nil {
+		e.Deadline = other.Deadline
+	}
+	e.Time = other.Time
+}
+
+// Journal is an append-only log of the launches the launcher is working on.
+// Each record is written as a line of JSON and synced to disk before Record
+// returns. Launches are dropped from the journal once a terminal state has
+// been recorded for them or they've been forgotten, and the file is compacted
+// as records accumulate.
+type Journal struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File // nil if the journal is only kept in memory
+	written int      // the records in the file
+	entries map[string]*JournalEntry
+}
+
+// NewMemoryJournal returns a *Journal that isn't written to disk.
+func NewMemoryJournal() *Journal {
+	return &Journal{entries: make(map[string]*JournalEntry)}
+}
+
+// OpenJournal opens the journal at the given path, creating it if necessary.
+// The existing records are replayed and the file is compacted so that it only
+// contains the launches that are still in flight.
+func OpenJournal(path string) (*Journal, error) {
+	j := NewMemoryJournal()
+	j.path = path
+
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	if err := j.reopen(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// reopen compacts the journal file and opens it for appending. The caller
+// must hold the lock or have exclusive access to the journal.
+func (j *Journal) reopen() error {
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	if err := j.compact(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open the journal %s", j.path)
+	}
+	j.file = f
+	j.written = len(j.entries)
+
+	return nil
+}
+
+// apply merges a record into the in-memory state of the journal.
+func (j *Journal) apply(record *JournalEntry) {
+	if isTerminalState(record.State) || record.State == forgottenState {
+		delete(j.entries, record.InvocationID)
+		return
+	}
+	entry, ok := j.entries[record.InvocationID]
+	if !ok {
+		entry = &JournalEntry{InvocationID: record.InvocationID}
+		j.entries[record.InvocationID] = entry
+	}
+	entry.merge(record)
+}
+
+// replay reads the records in the journal file. Lines that can't be parsed,
+// such as one that was only partially written before a crash, are skipped.
+func (j *Journal) replay() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to open the journal %s", j.path)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := &JournalEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil || record.InvocationID == "" {
+			log.Warnf("skipping an unreadable record in the journal %s", j.path)
+			continue
+		}
+		j.apply(record)
+	}
+	if err = scanner.Err(); err != nil {
+		return errors.Wrapf(err, "failed to read the journal %s", j.path)
+	}
+
+	return nil
+}
+
+// compact replaces the journal file with one containing a single record for
+// each launch that's still in flight.
+func (j *Journal) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a temporary file to compact %s", j.path)
+	}
+	defer os.Remove(tmp.Name())
+
+	encoder := json.NewEncoder(tmp)
+	for _, entry := range j.sortedEntries() {
+		if err = encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return errors.Wrapf(err, "failed to write to %s", tmp.Name())
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to sync %s", tmp.Name())
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tmp.Name())
+	}
+	if err = os.Chmod(tmp.Name(), 0600); err != nil {
+		return errors.Wrapf(err, "failed to set the permissions of %s", tmp.Name())
+	}
+
+	return errors.Wrapf(os.Rename(tmp.Name(), j.path), "failed to replace %s", j.path)
+}
+
+// Record adds a record to the journal.
+func (j *Journal) Record(record JournalEntry) error {
+	record.Time = time.Now()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.apply(&record)
+	if j.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(&record)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode the journal record for %s", record.InvocationID)
+	}
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return errors.Wrapf(err, "failed to write to the journal %s", j.path)
+	}
+	if err = j.file.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync the journal %s", j.path)
+	}
+
+	j.written++
+	if j.written >= journalCompactionRecords && j.written >= 4*len(j.entries) {
+		return j.reopen()
+	}
+	return nil
+}
+
+// sortedEntries returns copies of the in-flight entries sorted by invocation
+// ID. The caller must hold the lock or have exclusive access to the journal.
+func (j *Journal) sortedEntries() []JournalEntry {
+	retval := make([]JournalEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		retval = append(retval, *entry)
+	}
+	sort.Slice(retval, func(a, b int) bool {
+		return retval[a].InvocationID < retval[b].InvocationID
+	})
+	return retval
+}
+
+// Entries returns the launches that are still in flight.
+func (j *Journal) Entries() []JournalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.sortedEntries()
+}
+
+// Entry returns the journal entry for a single launch.
+func (j *Journal) Entry(invocationID string) (JournalEntry, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry, ok := j.entries[invocationID]
+	if !ok {
+		return JournalEntry{}, false
+	}
+	return *entry, true
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// recordJournal adds a record to the launcher's journal, logging any errors.
+func (cl *CondorLauncher) recordJournal(record JournalEntry) {
+	if err := cl.journal.Record(record); err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to record the %s state of job %s", record.State, record.InvocationID))
+	}
+}
+
+// journalJob returns the job to include in updates for a journal entry.
+func (cl *CondorLauncher) journalJob(entry JournalEntry) *model.Job {
+	if entry.Job != nil {
+		return entry.Job
+	}
+	fauxJob := model.New(cl.config())
+	fauxJob.InvocationID = entry.InvocationID
+	return fauxJob
+}
+
+// findJobAd looks for the ad of a job in the queue and then in the history.
+func findJobAd(scheduler Scheduler, invocationID string, attrs ...string) (JobAd, error) {
+	constraint := ipcUUIDConstraint(invocationID)
+
+	ads, err := scheduler.QueryByConstraint(constraint, attrs...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check the queue for job %s", invocationID)
+	}
+	if len(ads) == 0 {
+		ads, err = scheduler.History(constraint, 1, attrs...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check the history for job %s", invocationID)
+		}
+	}
+	if len(ads) == 0 {
+		return nil, nil
+	}
+
+	return ads[0], nil
+}
+
+// publishJournaled publishes an update for a journaled launch and records the
+// new state. Without a status monitor nothing else is published for a job
+// that's still active, so the launch is forgotten instead.
+func (cl *CondorLauncher) publishJournaled(entry JournalEntry, state messaging.JobState, msg string) {
+	err := cl.client.PublishJobUpdate(&messaging.UpdateMessage{
+		Job:     cl.journalJob(entry),
+		State:   state,
+		Message: msg,
+	})
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to publish the %s update for job %s", state, entry.InvocationID))
+		return
+	}
+	if cl.monitor == nil && !isTerminalState(state) {
+		state = forgottenState
+	}
+	cl.recordJournal(JournalEntry{InvocationID: entry.InvocationID, State: state})
+}
+
+// reconcile compares the launches in the journal with the scheduler and
+// publishes the updates that were missed while the launcher wasn't running.
+// Launches that are still active are handed to the status monitor, or
+// forgotten if there isn't one.
+func (cl *CondorLauncher) reconcile() {
+	entries := cl.journal.Entries()
+	log.Infof("reconciling %d journaled launches", len(entries))
+
+	for _, entry := range entries {
+		ad, err := findJobAd(cl.scheduler, entry.InvocationID, monitorAttrs...)
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to reconcile job %s", entry.InvocationID))
+			continue
+		}
+
+		if ad == nil {
+			// Nothing was submitted. The launch request wasn't acknowledged,
+			// so the broker will deliver it again and the entry is replaced
+			// when it's handled.
+			if entry.State == launchingState {
+				log.Warnf("job %s wasn't found in the queue or the history; waiting for the launch request to be redelivered",
+					entry.InvocationID)
+				continue
+			}
+			log.Warnf("job %s (Condor ID %q) wasn't found in the queue or the history; marking it as failed",
+				entry.InvocationID, entry.ClusterID)
+			cl.publishJournaled(entry, messaging.FailedState,
+				fmt.Sprintf("Condor ID %s is no longer in the queue or the history", entry.ClusterID))
+			continue
+		}
+
+		clusterID := ad["ClusterId"]
+		if entry.State == launchingState {
+			log.Infof("publishing the missed Submitted update for job %s", entry.InvocationID)
+			cl.publishJournaled(entry, messaging.SubmittedState, fmt.Sprintf("Launched Condor ID %s", clusterID))
+			entry.State = messaging.SubmittedState
+		}
+
+		state, msg, ok := jobStateFromAd(ad)
+		if ok && state != entry.State {
+			log.Infof("publishing the missed %s update for job %s", state, entry.InvocationID)
+			cl.publishJournaled(entry, state, msg)
+			entry.State = state
+		}
+
+		// The job may have finished while the launcher was down.
+		if isTerminalState(entry.State) {
+			removeIRODSConfig(cl.scheduler, entry.SubmissionDir)
+		}
+		if isTerminalState(entry.State) {
+			continue
+		}
+		if cl.monitor == nil {
+			cl.recordJournal(JournalEntry{InvocationID: entry.InvocationID, State: forgottenState})
+			continue
+		}
+		if cl.timeLimits != nil {
+			cl.restoreTimeLimit(entry)
+		}
+		cl.monitor.trackInState(cl.journalJob(entry), clusterID, entry.State)
+	}
+}
+
+// restoreTimeLimit starts tracking the time limit of a journaled launch again.
+// Jobs that started running while the launcher was down get their full time
+// limit from now.
+func (cl *CondorLauncher) restoreTimeLimit(entry JournalEntry) {
+	if entry.Deadline != nil {
+		cl.timeLimits.Restore(entry.InvocationID, *entry.Deadline)
+		return
+	}
+	if entry.Job == nil || !cl.timeLimits.Track(entry.Job) {
+		return
+	}
+	if entry.State == messaging.RunningState {
+		if deadline, ok := cl.timeLimits.Start(entry.InvocationID, time.Now()); ok {
+			recordDeadline(cl.journal, entry.InvocationID, deadline)
+		}
+	}
+}
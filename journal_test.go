@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journalPath := filepath.Join(dir, "journal")
+
+	j, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []JournalEntry{
+		{InvocationID: "a", SubmissionDir: "/tmp/a", State: launchingState, Job: &model.Job{InvocationID: "a"}},
+		{InvocationID: "a", ClusterID: "1"},
+		{InvocationID: "a", State: messaging.SubmittedState},
+		{InvocationID: "b", SubmissionDir: "/tmp/b", State: launchingState},
+		{InvocationID: "b", ClusterID: "2"},
+		{InvocationID: "b", State: messaging.SucceededState},
+	}
+	for _, record := range records {
+		if err = j.Record(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// Simulate a record that was only partially written.
+	f, err := os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"invocation_id": "c", "sta`)
+	f.Close()
+
+	j, err = OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	entries := j.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("the journal contains %d launches instead of 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.InvocationID != "a" ||
+		entry.SubmissionDir != "/tmp/a" ||
+		entry.ClusterID != "1" ||
+		entry.State != messaging.SubmittedState ||
+		entry.Job == nil {
+		t.Errorf("unexpected journal entry: %#v", entry)
+	}
+
+	info, err := os.Stat(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the journal has mode %o instead of 0600", info.Mode().Perm())
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+	cl.monitor = NewStatusMonitor(scheduler, client, cl.journal)
+
+	// "submitted" crashed before the Submitted update was published and is
+	// now running, "finished" completed while the launcher was down,
+	// "missing" never made it to the queue, and "lost" was submitted but has
+	// since disappeared from the history.
+	cl.journal.Record(JournalEntry{InvocationID: "submitted", State: launchingState})
+	cl.journal.Record(JournalEntry{InvocationID: "finished", ClusterID: "2", State: messaging.SubmittedState})
+	cl.journal.Record(JournalEntry{InvocationID: "missing", State: launchingState})
+	cl.journal.Record(JournalEntry{InvocationID: "lost", ClusterID: "3", State: messaging.SubmittedState})
+	scheduler.queue = []JobAd{
+		{"IpcUuid": "submitted", "ClusterId": "1", "JobStatus": jobStatusRunning, "ExitCode": "undefined"},
+	}
+	scheduler.history = []JobAd{
+		{"IpcUuid": "finished", "ClusterId": "2", "JobStatus": jobStatusCompleted, "ExitCode": "0"},
+	}
+
+	cl.reconcile()
+
+	var published []string
+	for _, u := range client.updates {
+		published = append(published, u.Job.InvocationID+" "+string(u.State))
+	}
+	expected := []string{
+		"finished " + string(messaging.SucceededState),
+		"lost " + string(messaging.FailedState),
+		"submitted " + string(messaging.SubmittedState),
+		"submitted " + string(messaging.RunningState),
+	}
+	if len(published) != len(expected) {
+		t.Fatalf("reconcile published %v instead of %v", published, expected)
+	}
+	for i := range expected {
+		if published[i] != expected[i] {
+			t.Errorf("update %d was %q instead of %q", i, published[i], expected[i])
+		}
+	}
+
+	// The launch request for "missing" will be redelivered.
+	entries := cl.journal.Entries()
+	if len(entries) != 2 ||
+		entries[0].InvocationID != "missing" || entries[0].State != launchingState ||
+		entries[1].InvocationID != "submitted" || entries[1].State != messaging.RunningState {
+		t.Errorf("unexpected journal entries after reconciliation: %#v", entries)
+	}
+	if tj, ok := cl.monitor.snapshot()["submitted"]; !ok || tj.state != messaging.RunningState {
+		t.Errorf("the running job is not being monitored in the Running state: %#v", tj)
+	}
+}
+
+func TestReconcileWithoutMonitor(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+
+	cl.journal.Record(JournalEntry{InvocationID: "submitted", State: launchingState})
+	scheduler.queue = []JobAd{
+		{"IpcUuid": "submitted", "ClusterId": "1", "JobStatus": jobStatusIdle},
+	}
+
+	cl.reconcile()
+
+	if len(client.updates) != 1 || client.updates[0].State != messaging.SubmittedState {
+		t.Errorf("reconcile published %v instead of a single Submitted update", client.updates)
+	}
+	if entries := cl.journal.Entries(); len(entries) != 0 {
+		t.Errorf("the journal kept %#v without a status monitor", entries)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journalPath := filepath.Join(dir, "journal")
+
+	j, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if err = j.Record(JournalEntry{InvocationID: "kept", State: launchingState}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < journalCompactionRecords; i++ {
+		id := fmt.Sprintf("job-%d", i)
+		if err = j.Record(JournalEntry{InvocationID: id, State: launchingState}); err != nil {
+			t.Fatal(err)
+		}
+		if err = j.Record(JournalEntry{InvocationID: id, State: forgottenState}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines >= journalCompactionRecords {
+		t.Errorf("the journal contains %d records after it should have been compacted", lines)
+	}
+	if entries := j.Entries(); len(entries) != 1 || entries[0].InvocationID != "kept" {
+		t.Errorf("unexpected journal entries after compaction: %#v", entries)
+	}
+
+	// Records written after compaction are still replayed.
+	if err = j.Record(JournalEntry{InvocationID: "kept", ClusterID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if j, err = OpenJournal(journalPath); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if entry, ok := j.Entry("kept"); !ok || entry.ClusterID != "1" || entry.State != launchingState {
+		t.Errorf("unexpected journal entry after reopening: %#v", entry)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/cyverse-de/messaging.v6"
+)
+
+// metricsRegistry contains the launcher's metrics. It's served at /metrics by
+// the admin API through metricsHandler.
+var metricsRegistry = prometheus.NewRegistry()
+
+// metricsHandler serves the metrics in metricsRegistry.
+var metricsHandler http.Handler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// newCounter registers and returns a counter without labels.
+func newCounter(name, help string) prometheus.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	metricsRegistry.MustRegister(c)
+	return c
+}
+
+// newCounterVec registers and returns a counter with the given labels.
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(c)
+	return c
+}
+
+// newHistogramVec registers and returns a histogram with the given buckets
+// and labels.
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	metricsRegistry.MustRegister(h)
+	return h
+}
+
+// condorCommandBuckets are the buckets for the durations of the HTCondor
+// commands, in seconds. They extend the default buckets since the commands can
+// take much longer than a typical request.
+var condorCommandBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	launchRequests = newCounterVec(
+		"condor_launcher_launch_requests_total",
+		"Launch requests received, by execution target.",
+		"execution_target",
+	)
+	launchesSucceeded = newCounterVec(
+		"condor_launcher_launches_succeeded_total",
+		"Launch requests that resulted in a submitted job, by execution target.",
+		"execution_target",
+	)
+	launchesFailed = newCounterVec(
+		"condor_launcher_launches_failed_total",
+		"Launch attempts that failed, by execution target.",
+		"execution_target",
+	)
+	stops = newCounterVec(
+		"condor_launcher_stops_total",
+		"Jobs stopped on request, by result.",
+		"result",
+	)
+	heldJobsFound = newCounter(
+		"condor_launcher_held_jobs_found_total",
+		"Held jobs found by the held job sweeps.",
+	)
+	heldJobsHandled = newCounterVec(
+		"condor_launcher_held_jobs_handled_total",
+		"Held jobs handled by the held job sweeps, by the action taken.",
+		"action",
+	)
+	invalidJobs = newCounterVec(
+		"condor_launcher_invalid_jobs_total",
+		"Launch requests for jobs that failed validation, by execution target.",
+		"execution_target",
+	)
+	unmarshalFailures = newCounterVec(
+		"condor_launcher_unmarshal_failures_total",
+		"AMQP messages that couldn't be unmarshalled, by message type.",
+		"message",
+	)
+	deadLetters = newCounterVec(
+		"condor_launcher_dead_letters_total",
+		"Messages handed to the dead-letter sinks, by reason.",
+		"reason",
+	)
+	publishFailures = newCounter(
+		"condor_launcher_publish_failures_total",
+		"Job updates that couldn't be published.",
+	)
+	timeLimitsExceeded = newCounterVec(
+		"condor_launcher_time_limits_exceeded_total",
+		"Jobs that ran past their time limits, by whether they were removed.",
+		"result",
+	)
+	templateReloads = newCounterVec(
+		"condor_launcher_template_reloads_total",
+		"Changed template overrides that were reloaded, by result.",
+		"result",
+	)
+	launchesDeferred = newCounterVec(
+		"condor_launcher_launches_deferred_total",
+		"Launch requests sent to the back of the queue, by reason.",
+		"reason",
+	)
+	quotaExceeded = newCounterVec(
+		"condor_launcher_quota_exceeded_total",
+		"Launch requests that would have exceeded a quota, by quota kind and action.",
+		"kind",
+		"action",
+	)
+	backpressurePauses = newCounter(
+		"condor_launcher_backpressure_pauses_total",
+		"Times launches were paused because of the number of idle jobs in the queue.",
+	)
+	submissionDirsRemoved = newCounterVec(
+		"condor_launcher_submission_dirs_removed_total",
+		"Job submission directories removed by the janitor, by reason.",
+		"reason",
+	)
+	submitFailures = newCounterVec(
+		"condor_launcher_submit_failures_total",
+		"Failed condor_submit attempts, by kind of failure.",
+		"kind",
+	)
+	spooledOutputRetrievals = newCounterVec(
+		"condor_launcher_spooled_output_retrievals_total",
+		"Attempts to retrieve the output of jobs spooled to a remote schedd, by result.",
+		"result",
+	)
+	configReloads = newCounterVec(
+		"condor_launcher_config_reloads_total",
+		"Changes to the config file that were reloaded, by result.",
+		"result",
+	)
+	condorCommandDuration = newHistogramVec(
+		"condor_launcher_condor_command_duration_seconds",
+		"Time taken by the HTCondor commands, by command and exit status.",
+		condorCommandBuckets,
+		"command", "exit_status",
+	)
+)
+
+// exitStatus returns the exit status of a command that returned err,
+// "timeout" if it was killed for running too long, or "error" if the command
+// couldn't be run at all.
+func exitStatus(err error) string {
+	if err == nil {
+		return "0"
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return "timeout"
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return strconv.Itoa(ws.ExitStatus())
+		}
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return strconv.Itoa(exitErr.ExitStatus())
+	}
+	return "error"
+}
+
+// observeCommand records the duration and exit status of an HTCondor command.
+func observeCommand(cmdPath string, start time.Time, err error) {
+	condorCommandDuration.WithLabelValues(path.Base(cmdPath), exitStatus(err)).Observe(time.Since(start).Seconds())
+}
+
+// meteredMessenger is a Messenger that counts the job updates that couldn't
+// be published.
+type meteredMessenger struct {
+	Messenger
+}
+
+// PublishJobUpdate publishes a job update, counting failures.
+func (m *meteredMessenger) PublishJobUpdate(update *messaging.UpdateMessage) error {
+	err := m.Messenger.PublishJobUpdate(update)
+	if err != nil {
+		publishFailures.Inc()
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+// tfailingmessenger is a Messenger whose job updates can't be published.
+type tfailingmessenger struct {
+	*tmessenger
+}
+
+func (m *tfailingmessenger) PublishJobUpdate(u *messaging.UpdateMessage) error {
+	return errors.New("the broker is down")
+}
+
+// observations returns the number of observations recorded by a histogram.
+func observations(t *testing.T, o prometheus.Observer) uint64 {
+	var m dto.Metric
+	if err := o.(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestExitStatus(t *testing.T) {
+	if actual := exitStatus(nil); actual != "0" {
+		t.Errorf("exitStatus(nil) returned %s instead of 0", actual)
+	}
+	if actual := exitStatus(exec.Command("sh", "-c", "exit 3").Run()); actual != "3" {
+		t.Errorf("exitStatus returned %s instead of 3", actual)
+	}
+	if actual := exitStatus(exec.Command("/does/not/exist").Run()); actual != "error" {
+		t.Errorf("exitStatus returned %s instead of error", actual)
+	}
+}
+
+func TestMeteredMessenger(t *testing.T) {
+	before := testutil.ToFloat64(publishFailures)
+	m := &meteredMessenger{&tfailingmessenger{newtmessenger()}}
+	if err := m.PublishJobUpdate(&messaging.UpdateMessage{Job: &model.Job{}}); err == nil {
+		t.Error("the publishing error was swallowed")
+	}
+	if actual := testutil.ToFloat64(publishFailures) - before; actual != 1 {
+		t.Errorf("%g publishing failures were counted instead of 1", actual)
+	}
+}
+
+func TestCondorCommandMetrics(t *testing.T) {
+	before := observations(t, condorCommandDuration.WithLabelValues("condor_rm", "0"))
+	if _, err := newTestScheduler(t).Remove(`IpcUuid =?= "foo"`); err != nil {
+		t.Fatal(err)
+	}
+	if actual := observations(t, condorCommandDuration.WithLabelValues("condor_rm", "0")) - before; actual != 1 {
+		t.Errorf("%d condor_rm runs were observed instead of 1", actual)
+	}
+
+	w := adminRequest(t, newAdminAPI(New(test.InitConfig(t), newtmessenger(), newtsys(), newtscheduler())), http.MethodGet, "/metrics")
+	if !strings.Contains(w.Body.String(), `condor_launcher_condor_command_duration_seconds_count{command="condor_rm",exit_status="0"}`) {
+		t.Errorf("the condor_rm duration is missing from the metrics:\n%s", w.Body.String())
+	}
+}
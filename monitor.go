@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/classad"
+	"github.com/cyverse-de/condor-launcher/userlog"
+)
+
+// HTCondor JobStatus values.
+const (
+	jobStatusIdle               = "1"
+	jobStatusRunning            = "2"
+	jobStatusRemoved            = "3"
+	jobStatusCompleted          = "4"
+	jobStatusHeld               = "5"
+	jobStatusTransferringOutput = "6"
+	jobStatusSuspended          = "7"
+)
+
+// activeJobsConstraint matches every job in the queue that was submitted by
+// the launcher.
+var activeJobsConstraint = classad.IsNot(classad.Attr("IpcUuid"), classad.Undefined).String()
+
+// monitorAttrs lists the job attributes the StatusMonitor needs.
+var monitorAttrs = []string{"IpcUuid", "ClusterId", "JobStatus", "ExitCode"}
+
+// maxMissedPolls is the number of polls in a row that can find a tracked job
+// in neither the queue nor the history before it's marked as failed.
+const maxMissedPolls = 5
+
+// trackedJob contains what the StatusMonitor knows about a job it's watching.
+type trackedJob struct {
+	job       *model.Job
+	clusterID string
+	state     messaging.JobState
+	missed    int // the polls in a row that haven't found the job
+}
+
+// StatusMonitor watches the jobs submitted by the launcher and publishes job
+// updates when they start running and when they finish. Job states are either
+// polled from the scheduler or read from each job's user log.
+type StatusMonitor struct {
+	scheduler  Scheduler
+	client     Messenger
+	journal    *Journal
+	watcher    *userlog.Watcher // nil unless the user logs are being followed
+	timeLimits *TimeLimits      // nil unless time limits are being enforced
+	mutex      sync.Mutex
+	jobs       map[string]*trackedJob
+}
+
+// NewStatusMonitor returns a new *StatusMonitor.
+func NewStatusMonitor(scheduler Scheduler, client Messenger, journal *Journal) *StatusMonitor {
+	return &StatusMonitor{
+		scheduler: scheduler,
+		client:    client,
+		journal:   journal,
+		jobs:      make(map[string]*trackedJob),
+	}
+}
+
+// FollowUserLogs makes the monitor read job states from the user log in each
+// tracked job's submission directory instead of polling the scheduler. The
+// logs are checked for new events on the given interval.
+func (m *StatusMonitor) FollowUserLogs(interval time.Duration) {
+	m.watcher = userlog.NewWatcher(interval, m.handleLogEvent, func(invocationID string, err error) {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to read the user log for job %s", invocationID))
+	})
+	m.watcher.Start()
+}
+
+// EnforceTimeLimits makes the monitor start the time limit of each job when
+// the job starts running, and stop tracking it when the job finishes.
+func (m *StatusMonitor) EnforceTimeLimits(timeLimits *TimeLimits) {
+	m.timeLimits = timeLimits
+}
+
+// Track starts watching a job that has just been submitted.
+func (m *StatusMonitor) Track(job *model.Job, clusterID string) {
+	m.trackInState(job, clusterID, messaging.SubmittedState)
+}
+
+// trackInState starts watching a job whose last published state is known.
+func (m *StatusMonitor) trackInState(job *model.Job, clusterID string, state messaging.JobState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.jobs[job.InvocationID] = &trackedJob{
+		job:       job,
+		clusterID: clusterID,
+		state:     state,
+	}
+	if m.watcher != nil {
+		m.watcher.Add(job.InvocationID, path.Join(jobLogsDirectory(job), "condor.log"))
+	}
+}
+
+// Requeue records that a tracked job has gone back to the queue, for example
+// after being released from the held state, so that the Running update is
+// published again when it restarts.
+func (m *StatusMonitor) Requeue(invocationID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if tj, ok := m.jobs[invocationID]; ok {
+		tj.state = messaging.SubmittedState
+	}
+}
+
+// Forget stops watching a job. Used when something other than the monitor
+// has published the job's final update, for example when it's stopped.
+func (m *StatusMonitor) Forget(invocationID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.forget(invocationID)
+}
+
+// forget stops watching a job. The caller must hold the lock.
+func (m *StatusMonitor) forget(invocationID string) {
+	delete(m.jobs, invocationID)
+	if m.watcher != nil {
+		m.watcher.Remove(invocationID)
+	}
+	if m.timeLimits != nil {
+		m.timeLimits.Forget(invocationID)
+	}
+}
+
+// snapshot returns a copy of the tracked jobs so that the scheduler can be
+// queried without holding the lock.
+func (m *StatusMonitor) snapshot() map[string]trackedJob {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	retval := make(map[string]trackedJob, len(m.jobs))
+	for invocationID, tj := range m.jobs {
+		retval[invocationID] = *tj
+	}
+	return retval
+}
+
+// jobStateFromAd determines the job state that corresponds to a job ad along
+// with a message describing it. The last return value is false if the ad
+// doesn't correspond to a state that should be published.
+func jobStateFromAd(ad JobAd) (messaging.JobState, string, bool) {
+	clusterID := ad["ClusterId"]
+	switch ad["JobStatus"] {
+	case jobStatusRunning, jobStatusTransferringOutput:
+		return messaging.RunningState, fmt.Sprintf("Condor ID %s is running", clusterID), true
+	case jobStatusCompleted:
+		exitCode, err := strconv.Atoi(ad["ExitCode"])
+		if err != nil {
+			return messaging.FailedState, fmt.Sprintf("Condor ID %s terminated without an exit code", clusterID), true
+		}
+		if exitCode != 0 {
+			return messaging.FailedState, fmt.Sprintf("Condor ID %s exited with code %d", clusterID, exitCode), true
+		}
+		return messaging.SucceededState, fmt.Sprintf("Condor ID %s completed successfully", clusterID), true
+	case jobStatusRemoved:
+		return messaging.FailedState, fmt.Sprintf("Condor ID %s was removed", clusterID), true
+	default:
+		return "", "", false
+	}
+}
+
+// isTerminalState returns true if no further updates follow the given state.
+func isTerminalState(state messaging.JobState) bool {
+	return state == messaging.SucceededState || state == messaging.FailedState
+}
+
+// Poll queries the scheduler for the jobs being watched and publishes an
+// update for every job whose state has changed.
+func (m *StatusMonitor) Poll() {
+	tracked := m.snapshot()
+	if len(tracked) == 0 {
+		return
+	}
+
+	queued, err := m.scheduler.QueryByConstraint(activeJobsConstraint, monitorAttrs...)
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to query the status of the launched jobs"))
+		return
+	}
+	ads := make(map[string]JobAd, len(queued))
+	for _, ad := range queued {
+		ads[ad["IpcUuid"]] = ad
+	}
+
+	for invocationID, tj := range tracked {
+		ad, ok := ads[invocationID]
+		if !ok {
+			if ad, err = m.lookupHistory(invocationID); err != nil {
+				log.Errorf("%+v\n", err)
+				continue
+			}
+			if ad == nil {
+				m.missing(invocationID, tj.clusterID)
+				continue
+			}
+		}
+		m.update(invocationID, ad)
+	}
+}
+
+// lookupHistory finds the ad for a job that has left the queue. The ad is nil
+// if the job isn't in the history.
+func (m *StatusMonitor) lookupHistory(invocationID string) (JobAd, error) {
+	ads, err := m.scheduler.History(ipcUUIDConstraint(invocationID), 1, monitorAttrs...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up job %s in the history", invocationID)
+	}
+	if len(ads) == 0 {
+		return nil, nil
+	}
+	return ads[0], nil
+}
+
+// missing records that a poll found a tracked job in neither the queue nor
+// the history. The job is marked as failed once that has happened
+// maxMissedPolls times in a row.
+func (m *StatusMonitor) missing(invocationID, clusterID string) {
+	m.mutex.Lock()
+	tj, tracked := m.jobs[invocationID]
+	if tracked {
+		tj.missed++
+	}
+	m.mutex.Unlock()
+	if !tracked {
+		return
+	}
+
+	log.Warnf("job %s is neither in the queue nor in the history", invocationID)
+	if tj.missed >= maxMissedPolls {
+		msg := fmt.Sprintf("Condor ID %s is no longer in the queue or the history", clusterID)
+		m.transition(invocationID, messaging.FailedState, msg, 0, false)
+	}
+}
+
+// update publishes a job update if the ad indicates that the state of a
+// tracked job has changed.
+func (m *StatusMonitor) update(invocationID string, ad JobAd) {
+	m.mutex.Lock()
+	if tj, tracked := m.jobs[invocationID]; tracked {
+		tj.missed = 0
+	}
+	m.mutex.Unlock()
+
+	state, msg, ok := jobStateFromAd(ad)
+	if !ok {
+		return
+	}
+	exitCode, err := strconv.Atoi(ad["ExitCode"])
+	m.transition(invocationID, state, msg, exitCode, err == nil)
+}
+
+// trackedJobDir returns the submission directory of a tracked job, or an
+// empty string if only its invocation ID is known.
+func trackedJobDir(job *model.Job) string {
+	if job.Submitter == "" {
+		return ""
+	}
+	return jobLogsDirectory(job)
+}
+
+// jobStateFromEvent determines the job state that corresponds to a user log
+// event along with a message describing it. The exit code is only meaningful
+// for terminated events. The last return value is false if the event doesn't
+// correspond to a state that should be published.
+func jobStateFromEvent(ev userlog.Event) (messaging.JobState, string, int, bool) {
+	switch e := ev.(type) {
+	case *userlog.ExecuteEvent:
+		return messaging.RunningState, fmt.Sprintf("Condor ID %d is running on %s", e.Cluster, e.Host), 0, true
+	case *userlog.TerminatedEvent:
+		if !e.Normal {
+			return messaging.FailedState, fmt.Sprintf("Condor ID %d was terminated by signal %d", e.Cluster, e.Signal), 0, true
+		}
+		if e.ExitCode != 0 {
+			return messaging.FailedState, fmt.Sprintf("Condor ID %d exited with code %d", e.Cluster, e.ExitCode), e.ExitCode, true
+		}
+		return messaging.SucceededState, fmt.Sprintf("Condor ID %d completed successfully", e.Cluster), 0, true
+	case *userlog.AbortedEvent:
+		return messaging.FailedState, fmt.Sprintf("Condor ID %d was removed %s", e.Cluster, e.Reason), 0, true
+	default:
+		return "", "", 0, false
+	}
+}
+
+// handleLogEvent publishes a job update if a user log event indicates that
+// the state of a tracked job has changed.
+func (m *StatusMonitor) handleLogEvent(invocationID string, ev userlog.Event) {
+	state, msg, exitCode, ok := jobStateFromEvent(ev)
+	if !ok {
+		return
+	}
+	_, terminated := ev.(*userlog.TerminatedEvent)
+	m.transition(invocationID, state, msg, exitCode, terminated)
+}
+
+// transition records the new state of a tracked job and publishes an update
+// for it. Nothing happens if the job isn't tracked or is already in that
+// state.
+func (m *StatusMonitor) transition(invocationID string, state messaging.JobState, msg string, exitCode int, hasExitCode bool) {
+	m.mutex.Lock()
+	tj, tracked := m.jobs[invocationID]
+	if !tracked || tj.state == state {
+		m.mutex.Unlock()
+		return
+	}
+	tj.state = state
+	if hasExitCode {
+		tj.job.ExitCode = exitCode
+	}
+	if isTerminalState(state) {
+		m.forget(invocationID)
+	}
+	m.mutex.Unlock()
+
+	// The irods-config file is kept until the job finishes, since HTCondor
+	// transfers it again if the job is evicted and rescheduled.
+	if isTerminalState(state) {
+		removeIRODSConfig(m.scheduler, trackedJobDir(tj.job))
+	}
+
+	log.Infof("job %s is now in the %s state", invocationID, state)
+	if state == messaging.RunningState && m.timeLimits != nil {
+		if deadline, ok := m.timeLimits.Start(invocationID, time.Now()); ok {
+			log.Infof("job %s must finish by %s", invocationID, deadline.Format(time.RFC3339))
+			recordDeadline(m.journal, invocationID, deadline)
+		}
+	}
+	err := m.client.PublishJobUpdate(&messaging.UpdateMessage{
+		Job:     tj.job,
+		State:   state,
+		Message: msg,
+	})
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to publish the %s job update for %s", state, invocationID))
+		return
+	}
+	if err = m.journal.Record(JournalEntry{InvocationID: invocationID, State: state}); err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to record the %s state of job %s", state, invocationID))
+	}
+}
+
+// Stop stops following the user logs, if they're being followed.
+func (m *StatusMonitor) Stop() {
+	if m.watcher != nil {
+		m.watcher.Stop()
+	}
+}
+
+// startStatusMonitor starts up the code that periodically polls the status of
+// the tracked jobs.
+func startStatusMonitor(monitor *StatusMonitor, interval time.Duration) *Ticker {
+	return startTicker(interval, monitor.Poll)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/userlog"
+)
+
+func TestJobStateFromAd(t *testing.T) {
+	cases := []struct {
+		ad      JobAd
+		state   messaging.JobState
+		publish bool
+	}{
+		{JobAd{"JobStatus": jobStatusIdle}, "", false},
+		{JobAd{"JobStatus": jobStatusHeld}, "", false},
+		{JobAd{"JobStatus": jobStatusRunning}, messaging.RunningState, true},
+		{JobAd{"JobStatus": jobStatusTransferringOutput}, messaging.RunningState, true},
+		{JobAd{"JobStatus": jobStatusCompleted, "ExitCode": "0"}, messaging.SucceededState, true},
+		{JobAd{"JobStatus": jobStatusCompleted, "ExitCode": "1"}, messaging.FailedState, true},
+		{JobAd{"JobStatus": jobStatusCompleted, "ExitCode": "undefined"}, messaging.FailedState, true},
+		{JobAd{"JobStatus": jobStatusRemoved}, messaging.FailedState, true},
+	}
+	for _, c := range cases {
+		state, _, publish := jobStateFromAd(c.ad)
+		if state != c.state || publish != c.publish {
+			t.Errorf("jobStateFromAd(%#v) returned (%s, %t) instead of (%s, %t)", c.ad, state, publish, c.state, c.publish)
+		}
+	}
+}
+
+func TestStatusMonitorPoll(t *testing.T) {
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	monitor := NewStatusMonitor(scheduler, client, NewMemoryJournal())
+
+	running := &model.Job{InvocationID: "running"}
+	finished := &model.Job{InvocationID: "finished"}
+	idle := &model.Job{InvocationID: "idle"}
+	monitor.Track(running, "1")
+	monitor.Track(finished, "2")
+	monitor.Track(idle, "3")
+
+	scheduler.queue = []JobAd{
+		{"IpcUuid": "running", "ClusterId": "1", "JobStatus": jobStatusRunning, "ExitCode": "undefined"},
+		{"IpcUuid": "idle", "ClusterId": "3", "JobStatus": jobStatusIdle, "ExitCode": "undefined"},
+	}
+	scheduler.history = []JobAd{
+		{"IpcUuid": "finished", "ClusterId": "2", "JobStatus": jobStatusCompleted, "ExitCode": "2"},
+	}
+
+	monitor.Poll()
+
+	if len(client.updates) != 2 {
+		t.Fatalf("Poll published %d updates instead of 2", len(client.updates))
+	}
+	states := make(map[string]*messaging.UpdateMessage)
+	for _, u := range client.updates {
+		states[u.Job.InvocationID] = u
+	}
+	if u := states["running"]; u == nil || u.State != messaging.RunningState {
+		t.Errorf("the running job was not reported as running: %#v", u)
+	}
+	if u := states["finished"]; u == nil || u.State != messaging.FailedState || u.Job.ExitCode != 2 {
+		t.Errorf("the finished job was not reported as failed with exit code 2: %#v", u)
+	}
+
+	// A second poll shouldn't publish anything new, and the finished job
+	// should no longer be tracked.
+	monitor.Poll()
+	if len(client.updates) != 2 {
+		t.Errorf("the second Poll published %d updates instead of 0", len(client.updates)-2)
+	}
+	if _, ok := monitor.snapshot()["finished"]; ok {
+		t.Error("the finished job is still being tracked")
+	}
+}
+
+func TestStatusMonitorPollMissingJob(t *testing.T) {
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	monitor := NewStatusMonitor(scheduler, client, NewMemoryJournal())
+	monitor.Track(&model.Job{InvocationID: "lost"}, "1")
+	monitor.Track(&model.Job{InvocationID: "found"}, "2")
+
+	// A job that turns up again starts over.
+	for i := 0; i < maxMissedPolls-1; i++ {
+		monitor.Poll()
+	}
+	scheduler.queue = []JobAd{{"IpcUuid": "found", "ClusterId": "2", "JobStatus": jobStatusIdle}}
+	monitor.Poll()
+	scheduler.queue = nil
+
+	if len(client.updates) != 1 || client.updates[0].Job.InvocationID != "lost" || client.updates[0].State != messaging.FailedState {
+		t.Fatalf("a single Failed update for the lost job wasn't published: %#v", client.updates)
+	}
+	tracked := monitor.snapshot()
+	if _, ok := tracked["lost"]; ok {
+		t.Error("the lost job is still being tracked")
+	}
+	if _, ok := tracked["found"]; !ok {
+		t.Error("the job that was found again is no longer being tracked")
+	}
+}
+
+func TestStatusMonitorForget(t *testing.T) {
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	monitor := NewStatusMonitor(scheduler, client, NewMemoryJournal())
+
+	monitor.Track(&model.Job{InvocationID: "stopped"}, "1")
+	monitor.Forget("stopped")
+	scheduler.queue = []JobAd{
+		{"IpcUuid": "stopped", "ClusterId": "1", "JobStatus": jobStatusRemoved},
+	}
+
+	monitor.Poll()
+	if len(client.updates) != 0 {
+		t.Errorf("Poll published %d updates for a forgotten job", len(client.updates))
+	}
+}
+
+func TestStatusMonitorHandleLogEvent(t *testing.T) {
+	client := newtmessenger()
+	monitor := NewStatusMonitor(newtscheduler(), client, NewMemoryJournal())
+	monitor.Track(&model.Job{InvocationID: "job"}, "10000")
+
+	header := userlog.Header{Cluster: 10000}
+	monitor.handleLogEvent("job", &userlog.SubmitEvent{Header: header})
+	monitor.handleLogEvent("job", &userlog.ExecuteEvent{Header: header, Host: "10.0.0.2:9618"})
+	monitor.handleLogEvent("job", &userlog.ExecuteEvent{Header: header, Host: "10.0.0.3:9618"})
+	monitor.handleLogEvent("job", &userlog.TerminatedEvent{Header: header, Normal: true, ExitCode: 0})
+
+	if len(client.updates) != 2 {
+		t.Fatalf("%d updates were published instead of 2", len(client.updates))
+	}
+	if client.updates[0].State != messaging.RunningState {
+		t.Errorf("the first update was %s instead of %s", client.updates[0].State, messaging.RunningState)
+	}
+	if client.updates[1].State != messaging.SucceededState {
+		t.Errorf("the second update was %s instead of %s", client.updates[1].State, messaging.SucceededState)
+	}
+	if _, ok := monitor.snapshot()["job"]; ok {
+		t.Error("the completed job is still being tracked")
+	}
+}
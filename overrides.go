@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	jobs "gopkg.in/cyverse-de/job-templates.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/classad"
+)
+
+// The names of the files in condor.templates.dir that override the built-in
+// templates. The submit templates are executed with a *submitTemplateData,
+// the config templates with the launcher's config, and the iRODS config
+// template with an *IRODSConfig.
+const (
+	condorSubmitTemplateName    = "condor-submit.tmpl"
+	condorConfigTemplateName    = "condor-config.tmpl"
+	interappsSubmitTemplateName = "interapps-submit.tmpl"
+	interappsConfigTemplateName = "interapps-config.tmpl"
+	osgSubmitTemplateName       = "osg-submit.tmpl"
+	irodsConfigTemplateName     = "irods-config.tmpl"
+)
+
+// overrideTemplateNames lists every template that can be overridden.
+var overrideTemplateNames = []string{
+	condorSubmitTemplateName,
+	condorConfigTemplateName,
+	interappsSubmitTemplateName,
+	interappsConfigTemplateName,
+	osgSubmitTemplateName,
+	irodsConfigTemplateName,
+}
+
+// overrideTemplateFuncs are the functions available to template overrides.
+// The job fields under .Raw in the submit templates are checked for control
+// characters, but they still need to be quoted or have their macros escaped
+// wherever they're placed in a submit description.
+var overrideTemplateFuncs = template.FuncMap{
+	// quote returns a ClassAd string literal for use in a +Attribute command.
+	"quote": func(s string) string {
+		return escapeMacros(classad.Quote(s))
+	},
+	// macro escapes the $(...) macro references in a submit command value.
+	"macro":       escapeMacros,
+	"condorBytes": jobs.CondorBytes,
+}
+
+// submissionTemplateNames returns the names of the submit description and job
+// config templates for an execution target. The config name is empty if the
+// target's config isn't generated from a template.
+func submissionTemplateNames(target string) (string, string) {
+	switch target {
+	case "osg":
+		return osgSubmitTemplateName, ""
+	case "interapps":
+		return interappsSubmitTemplateName, interappsConfigTemplateName
+	default:
+		return condorSubmitTemplateName, condorConfigTemplateName
+	}
+}
+
+// submitTemplateData is what the submit description overrides are executed
+// with. The job fields are escaped the same way as for the built-in templates,
+// so they can be placed in the same spots: strings from the first step go
+// between quotes and the other fields go after the = of a command. Raw is the
+// job as it was submitted, for templates that escape its fields themselves.
+type submitTemplateData struct {
+	*model.Job
+	Raw *model.Job
+}
+
+// overrideTemplate is a template override along with the text it was parsed
+// from.
+type overrideTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+// TemplateOverrides loads template overrides from a directory. When a file in
+// the directory changes, the override is parsed again. If it fails to parse,
+// the last version that parsed is kept. If it's removed, the built-in
+// template is used again.
+type TemplateOverrides struct {
+	dir       string
+	mutex     sync.RWMutex
+	templates map[string]*overrideTemplate
+	watcher   *DirWatcher // nil unless the directory is being watched
+}
+
+// parseOverride parses the text of a template override.
+func parseOverride(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(overrideTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// LoadTemplateOverrides loads the template overrides in dir. An error is
+// returned if any of them fail to parse.
+func LoadTemplateOverrides(dir string) (*TemplateOverrides, error) {
+	o := &TemplateOverrides{
+		dir:       dir,
+		templates: make(map[string]*overrideTemplate),
+	}
+	for _, name := range overrideTemplateNames {
+		fname := filepath.Join(dir, name)
+		text, err := ioutil.ReadFile(fname)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the template %s", fname)
+		}
+		tmpl, err := parseOverride(name, string(text))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse the template %s", fname)
+		}
+		o.templates[name] = &overrideTemplate{text: string(text), tmpl: tmpl}
+		log.Infof("using the template %s", fname)
+	}
+	return o, nil
+}
+
+// Lookup returns the override for a template, or nil if it isn't overridden.
+func (o *TemplateOverrides) Lookup(name string) *template.Template {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	if t, ok := o.templates[name]; ok {
+		return t.tmpl
+	}
+	return nil
+}
+
+// reload reads a template override again if it has changed.
+func (o *TemplateOverrides) reload(name string) {
+	fname := filepath.Join(o.dir, name)
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		o.mutex.Lock()
+		_, existed := o.templates[name]
+		delete(o.templates, name)
+		o.mutex.Unlock()
+		if existed {
+			log.Warnf("the template %s was removed; using the built-in template", fname)
+		}
+		return
+	}
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to read the template %s", fname))
+		templateReloads.WithLabelValues("failed").Inc()
+		return
+	}
+
+	text := string(data)
+	o.mutex.RLock()
+	current, ok := o.templates[name]
+	o.mutex.RUnlock()
+	if ok && current.text == text {
+		return
+	}
+
+	tmpl, err := parseOverride(name, text)
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to parse the changed template %s; keeping the last version that parsed", fname))
+		templateReloads.WithLabelValues("failed").Inc()
+		return
+	}
+	o.mutex.Lock()
+	o.templates[name] = &overrideTemplate{text: text, tmpl: tmpl}
+	o.mutex.Unlock()
+	log.Infof("reloaded the template %s", fname)
+	templateReloads.WithLabelValues("succeeded").Inc()
+}
+
+// reloadAll reads every template override again if it has changed.
+func (o *TemplateOverrides) reloadAll() {
+	for _, name := range overrideTemplateNames {
+		o.reload(name)
+	}
+}
+
+// Watch starts reloading the template overrides when the files in the
+// directory change. Every override is checked on each change.
+func (o *TemplateOverrides) Watch() error {
+	watcher, err := WatchDir(o.dir, o.reloadAll)
+	if err != nil {
+		return err
+	}
+	o.watcher = watcher
+	return nil
+}
+
+// Stop stops watching the template overrides.
+func (o *TemplateOverrides) Stop() {
+	if o.watcher != nil {
+		o.watcher.Stop()
+	}
+}
+
+// executeOverride replaces fname with the output of a template override. It
+// returns false without doing anything if the template isn't overridden.
+func (o *TemplateOverrides) executeOverride(name string, data interface{}, fname string, mode os.FileMode) (bool, error) {
+	tmpl := o.Lookup(name)
+	if tmpl == nil {
+		return false, nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return true, errors.Wrapf(err, "failed to apply data to the %s template", name)
+	}
+	return true, errors.Wrapf(ioutil.WriteFile(fname, buf.Bytes(), mode), "failed to write %s", fname)
+}
+
+// applySubmissionOverrides replaces the submit description and job config
+// written for a job with the output of the overrides for its execution
+// target, if there are any. The escaped copy of the job comes from
+// escapeSubmitFields.
+func (o *TemplateOverrides) applySubmissionOverrides(s, escaped *model.Job, cfg *viper.Viper, submissionPath string) error {
+	submitName, configName := submissionTemplateNames(s.ExecutionTarget)
+	data := &submitTemplateData{Job: escaped, Raw: s}
+	if _, err := o.executeOverride(submitName, data, submissionPath, 0644); err != nil {
+		return err
+	}
+	if configName == "" {
+		return nil
+	}
+	_, err := o.executeOverride(configName, cfg, filepath.Join(filepath.Dir(submissionPath), "config"), 0644)
+	return err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+// overridesDir creates a directory containing the given template overrides.
+func overridesDir(t *testing.T, templates map[string]string) string {
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range templates {
+		writeOverride(t, dir, name, text)
+	}
+	return dir
+}
+
+func writeOverride(t *testing.T, dir, name, text string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// executeLookup executes a template override with the given data.
+func executeLookup(t *testing.T, o *TemplateOverrides, name string, data interface{}) string {
+	tmpl := o.Lookup(name)
+	if tmpl == nil {
+		t.Fatalf("%s isn't overridden", name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestLoadTemplateOverridesInvalid(t *testing.T) {
+	dir := overridesDir(t, map[string]string{condorSubmitTemplateName: "{{ .Submitter "})
+	defer os.RemoveAll(dir)
+
+	if _, err := LoadTemplateOverrides(dir); err == nil {
+		t.Error("a template that doesn't parse was loaded")
+	}
+}
+
+func TestTemplateOverridesReload(t *testing.T) {
+	dir := overridesDir(t, map[string]string{irodsConfigTemplateName: "host = {{ .IRODSHost }}\n"})
+	defer os.RemoveAll(dir)
+
+	o, err := LoadTemplateOverrides(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Lookup(condorSubmitTemplateName) != nil {
+		t.Error("a template that isn't in the directory was overridden")
+	}
+	data := &IRODSConfig{IRODSHost: "irods.example.org", IRODSPort: "1247"}
+
+	writeOverride(t, dir, irodsConfigTemplateName, "host = {{ .IRODSHost ")
+	o.reload(irodsConfigTemplateName)
+	if actual := executeLookup(t, o, irodsConfigTemplateName, data); actual != "host = irods.example.org\n" {
+		t.Errorf("the last good template wasn't kept: %q", actual)
+	}
+
+	writeOverride(t, dir, irodsConfigTemplateName, "port = {{ .IRODSPort }}\n")
+	o.reload(irodsConfigTemplateName)
+	if actual := executeLookup(t, o, irodsConfigTemplateName, data); actual != "port = 1247\n" {
+		t.Errorf("the changed template wasn't reloaded: %q", actual)
+	}
+
+	os.Remove(filepath.Join(dir, irodsConfigTemplateName))
+	o.reload(irodsConfigTemplateName)
+	if o.Lookup(irodsConfigTemplateName) != nil {
+		t.Error("a removed template is still overridden")
+	}
+}
+
+func TestTemplateOverridesWatch(t *testing.T) {
+	dir := overridesDir(t, map[string]string{irodsConfigTemplateName: "host = {{ .IRODSHost }}\n"})
+	defer os.RemoveAll(dir)
+
+	o, err := LoadTemplateOverrides(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer o.Stop()
+
+	writeOverride(t, dir, irodsConfigTemplateName, "zone = {{ .IRODSZone }}\n")
+	data := &IRODSConfig{IRODSZone: "test"}
+	deadline := time.Now().Add(5 * time.Second)
+	for executeLookup(t, o, irodsConfigTemplateName, data) != "zone = test\n" {
+		if time.Now().After(deadline) {
+			t.Fatal("the changed template wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRenderWithTemplateOverrides(t *testing.T) {
+	dir := overridesDir(t, map[string]string{
+		condorSubmitTemplateName: "+IpcUsername = {{ quote .Raw.Submitter }}\n" +
+			"request_memory = {{ condorBytes 2097152 }}\nqueue\n",
+		condorConfigTemplateName: `irods_base: "{{ .GetString "irods.base" }}"` + "\n",
+		irodsConfigTemplateName:  "irods-host = {{ .IRODSHost }}\n",
+	})
+	defer os.RemoveAll(dir)
+	outDir := filepath.Join(dir, "out")
+
+	cl := New(test.InitConfig(t), newtmessenger(), newtsys(), newtscheduler())
+	var err error
+	if cl.templates, err = LoadTemplateOverrides(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = renderJobFile(cl, "test/test_submission.json", outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"iplant.cmd":   "+IpcUsername = \"test_this_is_a_test\"\nrequest_memory = 2MB\nqueue\n",
+		"config":       "irods_base: \"/path/to/irodsbase\"\n",
+		"irods-config": "irods-host = hostname\n",
+	}
+	for name, contents := range expected {
+		actual, err := ioutil.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != contents {
+			t.Errorf("%s contained:\n%s\ninstead of:\n%s", name, actual, contents)
+		}
+	}
+}
+
+func TestOverrideTemplateFuncs(t *testing.T) {
+	dir := overridesDir(t, map[string]string{condorSubmitTemplateName: `+IpcExe = {{ quote .A }}` + "\n" + `arguments = {{ macro .B }}`})
+	defer os.RemoveAll(dir)
+
+	o, err := LoadTemplateOverrides(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := executeLookup(t, o, condorSubmitTemplateName, map[string]string{"A": `a" + "b`, "B": "$(HOME)"})
+	for _, expected := range []string{`+IpcExe = "a\" + \"b"`, "arguments = $(DOLLAR)(HOME)"} {
+		if !strings.Contains(actual, expected) {
+			t.Errorf("%q doesn't contain %q", actual, expected)
+		}
+	}
+}
+
+func TestSubmitOverrideEscaping(t *testing.T) {
+	dir := overridesDir(t, map[string]string{
+		condorSubmitTemplateName: `{{ with index .Steps 0 }}+IpcExePath = "{{ .Component.Location }}"{{ end }}` + "\n" +
+			`{{ with index .Raw.Steps 0 }}+RawExePath = {{ quote .Component.Location }}{{ end }}` + "\n" +
+			"accounting_group = {{ .Group }}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	o, err := LoadTemplateOverrides(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := loadTestJob(t, "test/test_submission.json")
+	j.Steps[0].Component.Location = `/usr/bin/"$(HOME)"`
+	j.Group = "$(ENV(HOME))"
+	fname := filepath.Join(dir, "iplant.cmd")
+	if err = o.applySubmissionOverrides(j, escapeSubmitFields(j), test.InitConfig(t), fname); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `+IpcExePath = "/usr/bin/\"$(DOLLAR)(HOME)\""` + "\n" +
+		`+RawExePath = "/usr/bin/\"$(DOLLAR)(HOME)\""` + "\n" +
+		"accounting_group = $(DOLLAR)(ENV(HOME))\n"
+	if string(actual) != expected {
+		t.Errorf("the submit description was:\n%s\ninstead of:\n%s", actual, expected)
+	}
+}
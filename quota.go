@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/classad"
+)
+
+// The actions that can be taken when a launch would put a user or group over
+// its quota.
+const (
+	quotaActionFail  = "fail"
+	quotaActionDefer = "defer"
+)
+
+// QuotaPolicy contains the limits on the number of active jobs a user or
+// group can have. A limit of zero means there's no limit.
+type QuotaPolicy struct {
+	defaultLimit int
+	users        map[string]int // keyed by lower-cased username
+	groups       map[string]int // keyed by lower-cased group name
+	action       string
+}
+
+// NewQuotaPolicy returns the *QuotaPolicy described by the condor.quotas
+// settings.
+func NewQuotaPolicy(cfg *viper.Viper) (*QuotaPolicy, error) {
+	p := &QuotaPolicy{
+		defaultLimit: cfg.GetInt("condor.quotas.default_limit"),
+		users:        make(map[string]int),
+		groups:       make(map[string]int),
+		action:       cfg.GetString("condor.quotas.action"),
+	}
+	if p.action != quotaActionFail && p.action != quotaActionDefer {
+		return nil, fmt.Errorf("unrecognized condor.quotas.action: %s", p.action)
+	}
+	if p.defaultLimit < 0 {
+		return nil, errors.New("condor.quotas.default_limit can't be negative")
+	}
+	for key, limits := range map[string]map[string]int{"condor.quotas.users": p.users, "condor.quotas.groups": p.groups} {
+		var m map[string]int
+		if err := cfg.UnmarshalKey(key, &m); err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", key)
+		}
+		for name, limit := range m {
+			if limit < 0 {
+				return nil, fmt.Errorf("the limit for %s in %s can't be negative", name, key)
+			}
+			limits[strings.ToLower(name)] = limit
+		}
+	}
+	return p, nil
+}
+
+// userLimit returns the limit on the number of active jobs a user can have.
+func (p *QuotaPolicy) userLimit(user string) int {
+	if limit, ok := p.users[strings.ToLower(user)]; ok {
+		return limit
+	}
+	return p.defaultLimit
+}
+
+// QuotaExceededError is returned when launching a job would put a user or
+// group over its quota.
+type QuotaExceededError struct {
+	Kind   string // "user" or "group"
+	Name   string
+	Active int
+	Limit  int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s %s already has %d active jobs, which is the limit of %d", e.Kind, e.Name, e.Active, e.Limit)
+}
+
+// userGroupRegexp matches the quoted group names in an IpcUserGroups list.
+var userGroupRegexp = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// parseUserGroups parses the value of an IpcUserGroups attribute.
+func parseUserGroups(value string) []string {
+	var retval []string
+	for _, quoted := range userGroupRegexp.FindAllString(value, -1) {
+		group, err := strconv.Unquote(quoted)
+		if err != nil {
+			group = strings.Trim(quoted, `"`)
+		}
+		retval = append(retval, group)
+	}
+	return retval
+}
+
+// activeJob is a job that counts against its submitter's quota.
+type activeJob struct {
+	user   string
+	groups []string
+}
+
+// Quotas limits the number of active jobs each user and group can have. Jobs
+// in the queue are counted along with the launches that haven't been
+// submitted yet.
+type Quotas struct {
+	mutex     sync.Mutex
+	scheduler Scheduler
+	policy    *QuotaPolicy
+	inflight  map[string]activeJob // keyed by invocation ID
+}
+
+// NewQuotas returns a new *Quotas.
+func NewQuotas(scheduler Scheduler, policy *QuotaPolicy) *Quotas {
+	return &Quotas{
+		scheduler: scheduler,
+		policy:    policy,
+		inflight:  make(map[string]activeJob),
+	}
+}
+
+// SetPolicy changes the quotas.
+func (q *Quotas) SetPolicy(policy *QuotaPolicy) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.policy = policy
+}
+
+// Action returns what's done with launches that would exceed a quota.
+func (q *Quotas) Action() string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.policy.action
+}
+
+// quotaConstraint matches the jobs in the queue that were submitted by the
+// user, if checkUser is true, or that belong to one of the groups. Only those
+// jobs can count against the quotas that apply to a launch.
+func quotaConstraint(user string, checkUser bool, groups []string) string {
+	var owners []classad.Expr
+	if checkUser {
+		owners = append(owners, classad.Equal(classad.Attr("IpcUsername"), classad.String(user)))
+	}
+	for _, group := range groups {
+		owners = append(owners, classad.Member(classad.String(group), classad.Attr("IpcUserGroups")))
+	}
+	return classad.And(
+		classad.IsNot(classad.Attr("IpcUuid"), classad.Undefined),
+		classad.Or(owners...),
+	).String()
+}
+
+// activeJobs returns the jobs in the queue that match the constraint, other
+// than the given one, along with the in-flight launches. The caller must hold
+// the lock.
+func (q *Quotas) activeJobs(invocationID, constraint string) ([]activeJob, error) {
+	ads, err := q.scheduler.QueryByConstraint(constraint, "IpcUuid", "IpcUsername", "IpcUserGroups")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to count the active jobs")
+	}
+	var retval []activeJob
+	for _, ad := range ads {
+		// The job may have been submitted before the launch request was
+		// redelivered.
+		if ad["IpcUuid"] == invocationID {
+			continue
+		}
+		if _, ok := q.inflight[ad["IpcUuid"]]; ok {
+			continue
+		}
+		retval = append(retval, activeJob{user: ad["IpcUsername"], groups: parseUserGroups(ad["IpcUserGroups"])})
+	}
+	for id, job := range q.inflight {
+		if id != invocationID {
+			retval = append(retval, job)
+		}
+	}
+	return retval, nil
+}
+
+// Reserve counts a job against its submitter's quotas until it's released. A
+// *QuotaExceededError is returned if that would put the submitter or one of
+// their groups over its quota. Only the jobs in the queue that belong to the
+// submitter or one of their limited groups are listed, and the queue isn't
+// checked at all if none of the quotas apply.
+func (q *Quotas) Reserve(job *model.Job) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	userLimit := q.policy.userLimit(job.Submitter)
+	var groups []string
+	for _, group := range job.UserGroups {
+		if q.policy.groups[strings.ToLower(group)] > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	if userLimit > 0 || len(groups) > 0 {
+		active, err := q.activeJobs(job.InvocationID, quotaConstraint(job.Submitter, userLimit > 0, groups))
+		if err != nil {
+			return err
+		}
+
+		if userLimit > 0 {
+			count := 0
+			for _, a := range active {
+				if strings.EqualFold(a.user, job.Submitter) {
+					count++
+				}
+			}
+			if count >= userLimit {
+				return &QuotaExceededError{Kind: "user", Name: job.Submitter, Active: count, Limit: userLimit}
+			}
+		}
+
+		for _, group := range groups {
+			limit := q.policy.groups[strings.ToLower(group)]
+			count := 0
+			for _, a := range active {
+				for _, g := range a.groups {
+					if strings.EqualFold(g, group) {
+						count++
+						break
+					}
+				}
+			}
+			if count >= limit {
+				return &QuotaExceededError{Kind: "group", Name: group, Active: count, Limit: limit}
+			}
+		}
+	}
+
+	q.inflight[job.InvocationID] = activeJob{user: job.Submitter, groups: job.UserGroups}
+	return nil
+}
+
+// Release stops counting a reserved job as in flight. It's called once the
+// job has been submitted, after which it's counted in the queue, or once the
+// launch has failed.
+func (q *Quotas) Release(invocationID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.inflight, invocationID)
+}
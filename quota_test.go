@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func newTestQuotaPolicy(t *testing.T, settings map[string]interface{}) *QuotaPolicy {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	for k, v := range settings {
+		cfg.Set(k, v)
+	}
+	p, err := NewQuotaPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestNewQuotaPolicyInvalid(t *testing.T) {
+	for key, value := range map[string]interface{}{
+		"condor.quotas.action":        "ignore",
+		"condor.quotas.default_limit": -1,
+		"condor.quotas.users":         map[string]interface{}{"alice": -5},
+	} {
+		cfg := test.InitConfig(t)
+		SetDefaults(cfg)
+		cfg.Set(key, value)
+		if _, err := NewQuotaPolicy(cfg); err == nil {
+			t.Errorf("an invalid %s was accepted", key)
+		}
+	}
+}
+
+func TestParseUserGroups(t *testing.T) {
+	actual := parseUserGroups(`{"groups:foo","groups:b\"ar"}`)
+	expected := []string{"groups:foo", `groups:b"ar`}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("parseUserGroups returned %q instead of %q", actual, expected)
+	}
+	if len(parseUserGroups("undefined")) != 0 {
+		t.Error("groups were parsed from an undefined attribute")
+	}
+}
+
+func TestQuotasReserveUser(t *testing.T) {
+	scheduler := newtscheduler()
+	scheduler.queue = []JobAd{
+		{"IpcUuid": "07b04ce2-7757-4b21-9e15-0b4c2f44be26", "IpcUsername": "alice"},
+		{"IpcUuid": "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2", "IpcUsername": "bob"},
+	}
+	q := NewQuotas(scheduler, newTestQuotaPolicy(t, map[string]interface{}{
+		"condor.quotas.default_limit": 2,
+		"condor.quotas.users":         map[string]interface{}{"bob": 1},
+	}))
+
+	// The job that's already in the queue doesn't count against itself.
+	if err := q.Reserve(&model.Job{InvocationID: "07b04ce2-7757-4b21-9e15-0b4c2f44be26", Submitter: "alice"}); err != nil {
+		t.Errorf("a redelivered launch was counted against its own quota: %s", err)
+	}
+	q.Release("07b04ce2-7757-4b21-9e15-0b4c2f44be26")
+
+	if err := q.Reserve(&model.Job{InvocationID: "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", Submitter: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	err := q.Reserve(&model.Job{InvocationID: "8b0a6f4e-5c7d-4e0f-9a61-2b3c4d5e6f70", Submitter: "alice"})
+	quotaErr, ok := err.(*QuotaExceededError)
+	if !ok || quotaErr.Kind != "user" || quotaErr.Active != 2 {
+		t.Errorf("the in-flight launch wasn't counted against alice's quota: %v", err)
+	}
+
+	q.Release("d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11")
+	if err = q.Reserve(&model.Job{InvocationID: "8b0a6f4e-5c7d-4e0f-9a61-2b3c4d5e6f70", Submitter: "alice"}); err != nil {
+		t.Errorf("the released launch was still counted against alice's quota: %s", err)
+	}
+
+	if err = q.Reserve(&model.Job{InvocationID: "5e7f8a9b-0c1d-4e2f-8a3b-4c5d6e7f8a9b", Submitter: "bob"}); err == nil {
+		t.Error("bob's own limit wasn't applied")
+	}
+}
+
+func TestQuotasReserveIgnoresCase(t *testing.T) {
+	scheduler := newtscheduler()
+	scheduler.queue = []JobAd{
+		{"IpcUuid": "07b04ce2-7757-4b21-9e15-0b4c2f44be26", "IpcUsername": "Alice", "IpcUserGroups": `{"Groups:Lab"}`},
+	}
+	q := NewQuotas(scheduler, newTestQuotaPolicy(t, map[string]interface{}{
+		"condor.quotas.default_limit": 1,
+		"condor.quotas.groups":        map[string]interface{}{"groups:lab": 1},
+	}))
+
+	err := q.Reserve(&model.Job{InvocationID: "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", Submitter: "alice"})
+	if quotaErr, ok := err.(*QuotaExceededError); !ok || quotaErr.Kind != "user" {
+		t.Errorf("the user quota wasn't applied regardless of case: %v", err)
+	}
+	err = q.Reserve(&model.Job{InvocationID: "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", Submitter: "bob", UserGroups: []string{"groups:lab"}})
+	if quotaErr, ok := err.(*QuotaExceededError); !ok || quotaErr.Kind != "group" {
+		t.Errorf("the group quota wasn't applied regardless of case: %v", err)
+	}
+}
+
+func TestQuotaConstraint(t *testing.T) {
+	actual := quotaConstraint("alice", true, []string{"groups:lab"})
+	expected := `(IpcUuid =!= undefined) && ((IpcUsername == "alice") || (member("groups:lab", IpcUserGroups)))`
+	if actual != expected {
+		t.Errorf("quotaConstraint returned\n%s\ninstead of\n%s", actual, expected)
+	}
+	actual = quotaConstraint("alice", false, []string{"groups:lab"})
+	expected = `(IpcUuid =!= undefined) && (member("groups:lab", IpcUserGroups))`
+	if actual != expected {
+		t.Errorf("quotaConstraint returned\n%s\ninstead of\n%s", actual, expected)
+	}
+}
+
+func TestQuotasReserveGroup(t *testing.T) {
+	scheduler := newtscheduler()
+	scheduler.queue = []JobAd{
+		{"IpcUuid": "07b04ce2-7757-4b21-9e15-0b4c2f44be26", "IpcUsername": "alice", "IpcUserGroups": `{"groups:lab"}`},
+	}
+	q := NewQuotas(scheduler, newTestQuotaPolicy(t, map[string]interface{}{
+		"condor.quotas.groups": map[string]interface{}{"groups:lab": 1},
+	}))
+
+	err := q.Reserve(&model.Job{InvocationID: "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", Submitter: "bob", UserGroups: []string{"groups:other", "groups:lab"}})
+	if quotaErr, ok := err.(*QuotaExceededError); !ok || quotaErr.Kind != "group" || quotaErr.Name != "groups:lab" {
+		t.Errorf("the group quota wasn't applied: %v", err)
+	}
+	if err = q.Reserve(&model.Job{InvocationID: "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11", Submitter: "bob"}); err != nil {
+		t.Errorf("a job outside the group was limited: %s", err)
+	}
+}
+
+func TestHandleLaunchRequestsOverQuota(t *testing.T) {
+	for _, action := range []string{quotaActionFail, quotaActionDefer} {
+		cfg := test.InitConfig(t)
+		SetDefaults(cfg)
+		cfg.Set("condor.rate_limits.defer_delay", "1ms")
+		scheduler := newtscheduler()
+		client := newtmessenger()
+		cl := New(cfg, client, newtsys(), scheduler)
+
+		j := test.InitTests(t, cfg)
+		scheduler.queue = []JobAd{{"IpcUuid": "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2", "IpcUsername": j.Submitter}}
+		cl.quotas = NewQuotas(scheduler, newTestQuotaPolicy(t, map[string]interface{}{
+			"condor.quotas.default_limit": 1,
+			"condor.quotas.action":        action,
+		}))
+
+		delivery, ack := launchDelivery(t, j)
+		cl.handleLaunchRequests()(delivery)
+
+		if len(scheduler.submitted) != 0 {
+			t.Errorf("%s: the job over its quota was submitted", action)
+		}
+		if !ack.settled() || !ack.acked {
+			t.Errorf("%s: the launch request wasn't acknowledged", action)
+		}
+		switch action {
+		case quotaActionFail:
+			if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState ||
+				!strings.Contains(client.updates[0].Message, "which is the limit of 1") {
+				t.Errorf("a Failed update wasn't published for the job over its quota: %#v", client.updates)
+			}
+		case quotaActionDefer:
+			if len(client.updates) != 0 || len(client.published[messaging.LaunchesKey]) != 1 {
+				t.Errorf("the launch request over its quota wasn't deferred: %#v", client.updates)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RateLimit is the rate at which a token bucket refills, in tokens per
+// second, and the number of tokens it holds when it's full. A zero Rate means
+// there's no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateLimitFromConfig reads the rate limit under prefix.
+func rateLimitFromConfig(cfg *viper.Viper, prefix string) RateLimit {
+	return RateLimit{
+		Rate:  cfg.GetFloat64(prefix + ".rate"),
+		Burst: cfg.GetInt(prefix + ".burst"),
+	}
+}
+
+// tokenBucket is a token bucket rate limiter. It starts out full.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// refill adds the tokens that have accumulated since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+		b.last = now
+	}
+}
+
+// take takes a token if one is available and returns zero. Otherwise it
+// returns how long it will be until one is.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if b.limit.Rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// full returns true if the bucket has refilled completely, meaning it can be
+// dropped and created again without changing its behavior.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// LaunchRateLimiter limits the rate at which jobs are launched, both overall
+// and for each user.
+type LaunchRateLimiter struct {
+	mutex   sync.Mutex
+	global  *tokenBucket
+	perUser RateLimit
+	users   map[string]*tokenBucket
+}
+
+// NewLaunchRateLimiter returns a new *LaunchRateLimiter.
+func NewLaunchRateLimiter(global, perUser RateLimit) *LaunchRateLimiter {
+	l := &LaunchRateLimiter{}
+	l.SetLimits(global, perUser)
+	return l
+}
+
+// SetLimits changes the rate limits. Every bucket starts out full again.
+func (l *LaunchRateLimiter) SetLimits(global, perUser RateLimit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.global = newTokenBucket(global, time.Now())
+	l.perUser = perUser
+	l.users = make(map[string]*tokenBucket)
+}
+
+// takeUser takes one of a user's tokens, returning how long it will be until
+// one is available if there aren't any.
+func (l *LaunchRateLimiter) takeUser(user string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.users[user]
+	if !ok {
+		// Drop the buckets that have refilled so that the map doesn't grow
+		// with every user who has ever launched a job.
+		for u, ub := range l.users {
+			if ub.full(now) {
+				delete(l.users, u)
+			}
+		}
+		b = newTokenBucket(l.perUser, now)
+		l.users[user] = b
+	}
+	return b.take(now)
+}
+
+// takeGlobal takes one of the global tokens, returning how long it will be
+// until one is available if there aren't any.
+func (l *LaunchRateLimiter) takeGlobal(now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.global.take(now)
+}
+
+// WaitUser waits for one of a user's tokens. It returns false without taking
+// one if that would mean waiting for longer than max.
+func (l *LaunchRateLimiter) WaitUser(user string, max time.Duration) bool {
+	for {
+		d := l.takeUser(user, time.Now())
+		if d == 0 {
+			return true
+		}
+		if d > max {
+			return false
+		}
+		time.Sleep(d)
+	}
+}
+
+// WaitGlobal waits for one of the global tokens.
+func (l *LaunchRateLimiter) WaitGlobal() {
+	for {
+		d := l.takeGlobal(time.Now())
+		if d == 0 {
+			return
+		}
+		time.Sleep(d)
+	}
+}
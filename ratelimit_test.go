@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(RateLimit{Rate: 2, Burst: 2}, now)
+	for i := 0; i < 2; i++ {
+		if d := b.take(now); d != 0 {
+			t.Fatalf("token %d wasn't available in a full bucket: %s", i, d)
+		}
+	}
+	if d := b.take(now); d != 500*time.Millisecond {
+		t.Errorf("the empty bucket would refill in %s instead of 500ms", d)
+	}
+	if d := b.take(now.Add(500 * time.Millisecond)); d != 0 {
+		t.Errorf("the bucket didn't refill: %s", d)
+	}
+	if b.full(now.Add(time.Second)) {
+		t.Error("the bucket was full before it had time to refill")
+	}
+	if !b.full(now.Add(time.Hour)) {
+		t.Error("the bucket refilled past its burst size")
+	}
+
+	unlimited := newTokenBucket(RateLimit{}, now)
+	for i := 0; i < 100; i++ {
+		if d := unlimited.take(now); d != 0 {
+			t.Fatalf("an unlimited bucket ran out of tokens: %s", d)
+		}
+	}
+}
+
+func TestLaunchRateLimiterPerUser(t *testing.T) {
+	l := NewLaunchRateLimiter(RateLimit{}, RateLimit{Rate: 0.001, Burst: 1})
+	if !l.WaitUser("alice", 0) {
+		t.Fatal("alice's first launch was limited")
+	}
+	if l.WaitUser("alice", time.Millisecond) {
+		t.Error("alice's second launch wasn't limited")
+	}
+	if !l.WaitUser("bob", 0) {
+		t.Error("bob's launch was limited by alice's")
+	}
+}
+
+func TestHandleLaunchRequestsDefersRateLimitedUser(t *testing.T) {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("condor.rate_limits.defer_delay", "50ms")
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+	cl.rateLimits.SetLimits(RateLimit{}, RateLimit{Rate: 0.001, Burst: 1})
+
+	first := test.InitTests(t, cfg)
+	delivery, ack := launchDelivery(t, first)
+	cl.handleLaunchRequests()(delivery)
+	if !ack.acked || len(scheduler.submitted) != 1 {
+		t.Fatalf("the first launch wasn't submitted: %v", scheduler.submitted)
+	}
+
+	second := test.InitTests(t, cfg)
+	second.InvocationID = "d9d4f4a4-2ad7-4a4b-9a0f-bd2a4e1a0c11"
+	delivery, ack = launchDelivery(t, second)
+	start := time.Now()
+	cl.handleLaunchRequests()(delivery)
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("the handler held the deferred launch request for %s", elapsed)
+	}
+	if len(scheduler.submitted) != 1 {
+		t.Errorf("the rate limited launch was submitted: %v", scheduler.submitted)
+	}
+	if !ack.settled() || !ack.acked {
+		t.Error("the deferred launch request wasn't acknowledged")
+	}
+	if published := client.published[messaging.LaunchesKey]; len(published) != 1 || string(published[0]) != string(delivery.Body) {
+		t.Errorf("the deferred launch request wasn't published again: %q", published)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// restartConfigKeys lists the settings, and the prefixes of groups of
+// settings, that are only read when the launcher starts. Changes to them are
+// logged and otherwise ignored until the launcher is restarted.
+var restartConfigKeys = []string{
+	"amqp.uri",
+	"amqp.exchange",
+	"condor.scheduler",
+	"condor.schedd_name",
+	"condor.pool",
+	"condor.transfer_data_interval",
+	"condor.ssh",
+	"condor.journal_path",
+	"condor.admin.listen_addr",
+	"condor.status_monitor",
+	"condor.held_jobs.interval",
+	"condor.shutdown_timeout",
+	"condor.dead_letter",
+	"condor.time_limits",
+	"condor.templates.dir",
+	"condor.janitor",
+	"condor.backpressure",
+	"condor.quotas.enabled",
+}
+
+// requiresRestart returns true if a setting is only read at startup.
+func requiresRestart(key string) bool {
+	for _, k := range restartConfigKeys {
+		if key == k || strings.HasPrefix(key, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// settingKeys adds the names of the settings in value to keys. Sections of
+// the config file are returned by viper as maps, which are descended into.
+func settingKeys(keys map[string]bool, key string, value interface{}) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			settingKeys(keys, key+"."+strings.ToLower(k), v)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			settingKeys(keys, key+"."+strings.ToLower(fmt.Sprint(k)), v)
+		}
+	default:
+		keys[key] = true
+	}
+}
+
+// changedConfigKeys returns the names of the settings that differ between two
+// configs, sorted.
+func changedConfigKeys(old, new *viper.Viper) []string {
+	keys := make(map[string]bool)
+	for _, cfg := range []*viper.Viper{old, new} {
+		for _, k := range cfg.AllKeys() {
+			settingKeys(keys, k, cfg.Get(k))
+		}
+	}
+	var retval []string
+	for k := range keys {
+		if !reflect.DeepEqual(old.Get(k), new.Get(k)) {
+			retval = append(retval, k)
+		}
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+// ConfigReloader applies changes to the launcher's config file while it's
+// running. The iRODS settings and password source, the job config, the
+// HTCondor environment and command timeouts, the held job policies, the
+// launch rate limits, the quotas and the prefetch limits take effect for the
+// next launch or stop request. Everything else needs a restart.
+type ConfigReloader struct {
+	path     string
+	cl       *CondorLauncher
+	prefetch map[string]int // the prefetch limits the consumers were created with
+	mutex    sync.Mutex     // reloads are triggered by both the watcher and SIGHUP
+	watcher  *DirWatcher    // nil unless the config file is being watched
+}
+
+// NewConfigReloader returns a *ConfigReloader that reloads the launcher's
+// config from path.
+func NewConfigReloader(path string, cl *CondorLauncher) *ConfigReloader {
+	cfg := cl.config()
+	r := &ConfigReloader{
+		path: path,
+		cl:   cl,
+		prefetch: map[string]int{
+			"amqp.prefetch.launches": cfg.GetInt("amqp.prefetch.launches"),
+			"amqp.prefetch.stops":    cfg.GetInt("amqp.prefetch.stops"),
+		},
+	}
+	r.setLimit(cl.launchLimit, "amqp.prefetch.launches", cfg)
+	r.setLimit(cl.stopLimit, "amqp.prefetch.stops", cfg)
+	return r
+}
+
+// setLimit limits the requests handled at once to the prefetch setting in
+// cfg. The broker won't deliver more than the prefetch limit the consumer was
+// created with, so raising it only takes full effect after a restart.
+func (r *ConfigReloader) setLimit(l *Limiter, key string, cfg *viper.Viper) {
+	limit := cfg.GetInt(key)
+	if startup := r.prefetch[key]; startup > 0 && (limit == 0 || limit > startup) {
+		log.Warnf("%s was raised above %d; the new limit won't take full effect until the launcher is restarted", key, startup)
+	}
+	l.SetLimit(limit)
+}
+
+// Reload reads the config file again and applies any changes. If the new
+// config is invalid, the current one is kept and an error is returned.
+func (r *ConfigReloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// The file can be briefly missing or empty while it's being replaced, and
+	// the defaults would be loaded in its place.
+	if info, err := os.Stat(r.path); err != nil || info.Size() == 0 {
+		log.Warnf("not reloading %s because it's missing or empty", r.path)
+		return nil
+	}
+
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reload %s", r.path)
+	}
+	policy, err := validateConfig(cfg)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reload %s; keeping the current config", r.path)
+	}
+	credentials, err := NewCredentialProvider(cfg)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reload %s; keeping the current config", r.path)
+	}
+	quotas, err := NewQuotaPolicy(cfg)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reload %s; keeping the current config", r.path)
+	}
+	timeouts, err := commandTimeoutsFromConfig(cfg)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reload %s; keeping the current config", r.path)
+	}
+
+	current := r.cl.config()
+	var applied []string
+	for _, key := range changedConfigKeys(current, cfg) {
+		if requiresRestart(key) {
+			log.Warnf("%s changed in %s, but the change won't take effect until the launcher is restarted", key, r.path)
+			cfg.Set(key, current.Get(key))
+			continue
+		}
+		applied = append(applied, key)
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+
+	r.cl.cfgMutex.Lock()
+	r.cl.cfg = cfg
+	r.cl.heldPolicy = policy
+	r.cl.credentials = credentials
+	r.cl.cfgMutex.Unlock()
+
+	if s, ok := r.cl.scheduler.(interface {
+		SetEnvironment(condorPath, condorConfig string)
+	}); ok {
+		s.SetEnvironment(cfg.GetString("condor.path_env_var"), cfg.GetString("condor.condor_config"))
+	}
+	if s, ok := r.cl.scheduler.(interface {
+		SetTimeouts(timeouts CommandTimeouts)
+	}); ok {
+		s.SetTimeouts(timeouts)
+	}
+	r.setLimit(r.cl.launchLimit, "amqp.prefetch.launches", cfg)
+	r.setLimit(r.cl.stopLimit, "amqp.prefetch.stops", cfg)
+	for _, key := range applied {
+		if strings.HasPrefix(key, "condor.quotas.") && r.cl.quotas != nil {
+			r.cl.quotas.SetPolicy(quotas)
+			break
+		}
+	}
+	for _, key := range applied {
+		if strings.HasPrefix(key, "condor.rate_limits.") {
+			r.cl.rateLimits.SetLimits(
+				rateLimitFromConfig(cfg, "condor.rate_limits.global"),
+				rateLimitFromConfig(cfg, "condor.rate_limits.per_user"),
+			)
+			break
+		}
+	}
+
+	// Only the names are logged because the values include credentials.
+	log.Infof("reloaded %s; changed settings: %s", r.path, strings.Join(applied, ", "))
+	configReloads.WithLabelValues("succeeded").Inc()
+	return nil
+}
+
+// reloadAndLog reloads the config, logging any error.
+func (r *ConfigReloader) reloadAndLog() {
+	if err := r.Reload(); err != nil {
+		log.Errorf("%+v\n", err)
+		configReloads.WithLabelValues("failed").Inc()
+	}
+}
+
+// Watch starts reloading the config when anything in its directory changes.
+func (r *ConfigReloader) Watch() error {
+	watcher, err := WatchDir(filepath.Dir(r.path), r.reloadAndLog)
+	if err != nil {
+		return err
+	}
+	r.watcher = watcher
+	return nil
+}
+
+// Stop stops watching the config file.
+func (r *ConfigReloader) Stop() {
+	if r.watcher != nil {
+		r.watcher.Stop()
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// NewSSHScheduler returns an *HTCondorScheduler that runs the HTCondor
+// command-line tools on the remote submit host described by the condor.ssh
+// settings. The tools are found in the $PATH set by condor.path_env_var, or
+// in the submit host's default $PATH if it's empty.
+func NewSSHScheduler(cfg *viper.Viper) (*HTCondorScheduler, error) {
+	runner, err := newSSHRunner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newHTCondorScheduler(
+		runner,
+		"condor_submit",
+		"condor_rm",
+		"condor_q",
+		"condor_history",
+		"condor_release",
+		cfg.GetString("condor.path_env_var"),
+		cfg.GetString("condor.condor_config"),
+	), nil
+}
+
+// sshRunner runs commands on a remote submit host over SSH. Submission
+// directories are copied to the submit host over SFTP before they're
+// submitted, under condor.ssh.remote_dir if it's set or at the same path
+// otherwise. Files written to the copies afterwards, such as the HTCondor
+// user logs, stay on the submit host. The irods-config files are removed from
+// both copies once the job finishes or won't run.
+type sshRunner struct {
+	addr      string
+	config    *ssh.ClientConfig
+	localDir  string // condor.log_path
+	remoteDir string // where condor.log_path is copied to on the submit host
+
+	mutex  sync.Mutex
+	client *ssh.Client // nil until the first command or after a failure
+}
+
+func newSSHRunner(cfg *viper.Viper) (*sshRunner, error) {
+	addr := cfg.GetString("condor.ssh.host")
+	if addr == "" {
+		return nil, errors.New("condor.ssh.host must be set when condor.scheduler is ssh")
+	}
+	if !strings.Contains(addr, ":") {
+		addr += ":22"
+	}
+
+	keyFile := cfg.GetString("condor.ssh.key_file")
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the SSH key from %s", keyFile)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the SSH key in %s", keyFile)
+	}
+
+	// The host key is required because this version of the ssh package
+	// accepts any host key if it isn't checked.
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cfg.GetString("condor.ssh.host_key")))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse condor.ssh.host_key")
+	}
+
+	timeout, err := time.ParseDuration(cfg.GetString("condor.ssh.connect_timeout"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse condor.ssh.connect_timeout")
+	}
+
+	return &sshRunner{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User: cfg.GetString("condor.ssh.user"),
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				if !bytes.Equal(key.Marshal(), hostKey.Marshal()) {
+					return fmt.Errorf("the host key of %s doesn't match condor.ssh.host_key", hostname)
+				}
+				return nil
+			},
+			Timeout: timeout,
+		},
+		localDir:  cfg.GetString("condor.log_path"),
+		remoteDir: cfg.GetString("condor.ssh.remote_dir"),
+	}, nil
+}
+
+// connect returns the connection to the submit host, connecting if there
+// isn't one.
+func (r *sshRunner) connect() (*ssh.Client, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.client != nil {
+		return r.client, nil
+	}
+	client, err := ssh.Dial("tcp", r.addr, r.config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", r.addr)
+	}
+	r.client = client
+	return client, nil
+}
+
+// reset closes a connection that failed so that the next command reconnects.
+func (r *sshRunner) reset(client *ssh.Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.client == client {
+		r.client.Close()
+		r.client = nil
+	}
+}
+
+// shellQuote quotes a string for the submit host's shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remoteCommand returns the command line that runs a command from dir with
+// the environment variables in env. Empty variables are left out so that the
+// submit host's defaults are used.
+func remoteCommand(dir string, env []string, name string, args ...string) string {
+	var words []string
+	if dir != "" {
+		words = append(words, "cd", shellQuote(dir), "&&")
+	}
+	words = append(words, "exec", "env")
+	for _, e := range env {
+		if !strings.HasSuffix(e, "=") {
+			words = append(words, shellQuote(e))
+		}
+	}
+	words = append(words, shellQuote(name))
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// Run runs a command on the submit host. If ctx is done first, the command
+// is killed and ctx.Err() is returned.
+func (r *sshRunner) Run(ctx context.Context, dir string, env []string, name string, args ...string) ([]byte, error) {
+	client, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		r.reset(client)
+		return nil, errors.Wrapf(err, "failed to start a session on %s", r.addr)
+	}
+	defer session.Close()
+
+	var output []byte
+	done := make(chan struct{})
+	go func() {
+		output, err = session.CombinedOutput(remoteCommand(dir, env, name, args...))
+		close(done)
+	}()
+	select {
+	case <-done:
+		return output, err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		return output, ctx.Err()
+	}
+}
+
+// remotePath returns the path on the submit host that a local submission
+// directory is copied to.
+func (r *sshRunner) remotePath(dir string) (string, error) {
+	if r.remoteDir == "" {
+		return dir, nil
+	}
+	rel, err := filepath.Rel(r.localDir, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s isn't in condor.log_path", dir)
+	}
+	return path.Join(r.remoteDir, filepath.ToSlash(rel)), nil
+}
+
+// mkdirAll creates a directory on the submit host along with its parents.
+func mkdirAll(client *sftp.Client, dir string) error {
+	if info, err := client.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s isn't a directory", dir)
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := mkdirAll(client, parent); err != nil {
+			return err
+		}
+	}
+	if err := client.Mkdir(dir); err != nil {
+		// Another launch may have created it in the meantime.
+		if info, statErr := client.Stat(dir); statErr != nil || !info.IsDir() {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll removes a directory on the submit host along with everything in
+// it. It isn't an error if the directory doesn't exist.
+func removeAll(client *sftp.Client, dir string) error {
+	info, err := client.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := client.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = removeAll(client, path.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return client.Remove(dir)
+}
+
+// copyFile copies a local file to the submit host. The permissions are set
+// before anything is written so that the irods-config file is never readable
+// by other users.
+func copyFile(client *sftp.Client, local, remote string, mode os.FileMode) error {
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := client.Create(remote)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err = client.Chmod(remote, mode.Perm()); err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// sftpClient starts an SFTP session on the submit host. The caller should
+// close it.
+func (r *sshRunner) sftpClient() (*sftp.Client, error) {
+	client, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		r.reset(client)
+		return nil, errors.Wrapf(err, "failed to start an SFTP session on %s", r.addr)
+	}
+	return sc, nil
+}
+
+// Stage copies a submission directory to the submit host.
+func (r *sshRunner) Stage(dir string) (string, error) {
+	remote, err := r.remotePath(dir)
+	if err != nil {
+		return "", err
+	}
+	sc, err := r.sftpClient()
+	if err != nil {
+		return "", err
+	}
+	defer sc.Close()
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(remote, filepath.ToSlash(rel))
+		switch {
+		case info.IsDir():
+			return mkdirAll(sc, target)
+		case info.Mode().IsRegular():
+			return copyFile(sc, p, target, info.Mode())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to copy %s to %s on %s", dir, remote, r.addr)
+	}
+	return remote, nil
+}
+
+// Unstage removes a file from the copy of a submission directory on the
+// submit host. It isn't an error if the file doesn't exist.
+func (r *sshRunner) Unstage(dir, name string) error {
+	remote, err := r.remotePath(dir)
+	if err != nil {
+		return err
+	}
+	sc, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	fname := path.Join(remote, name)
+	if err = sc.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove %s on %s", fname, r.addr)
+	}
+	return nil
+}
+
+// Restage copies a single file of a submission directory to the copy on the
+// submit host again, replacing the copy of the file if there is one.
+func (r *sshRunner) Restage(dir, name string) error {
+	remote, err := r.remotePath(dir)
+	if err != nil {
+		return err
+	}
+	local := filepath.Join(dir, name)
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	sc, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	fname := path.Join(remote, name)
+	if err = copyFile(sc, local, fname, info.Mode()); err != nil {
+		return errors.Wrapf(err, "failed to copy %s to %s on %s", local, fname, r.addr)
+	}
+	return nil
+}
+
+// RemoveStaged removes the copy of a directory from the submit host, along
+// with its parent directory if that's left empty. It isn't an error if there
+// isn't a copy.
+func (r *sshRunner) RemoveStaged(dir string) error {
+	remote, err := r.remotePath(dir)
+	if err != nil {
+		return err
+	}
+	sc, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	if err = removeAll(sc, remote); err != nil {
+		return errors.Wrapf(err, "failed to remove %s on %s", remote, r.addr)
+	}
+	sc.Remove(path.Dir(remote)) // fails unless the user's directory is empty
+	return nil
+}
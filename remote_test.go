@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+// tsshd is a stand-in for the sshd on a submit host. It runs commands with
+// the local shell and serves SFTP from the local filesystem.
+type tsshd struct {
+	listener net.Listener
+	hostKey  ssh.PublicKey
+
+	mutex    sync.Mutex
+	commands []string
+}
+
+// newECDSAKey generates a key and returns it PEM-encoded along with its
+// ssh.Signer.
+func newECDSAKey(t *testing.T) ([]byte, ssh.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), signer
+}
+
+// startTestSSHServer starts a *tsshd that only accepts clientKey.
+func startTestSSHServer(t *testing.T, clientKey ssh.PublicKey) *tsshd {
+	_, hostSigner := newECDSAKey(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &tsshd{listener: listener, hostKey: hostSigner.PublicKey()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *tsshd) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for nc := range channels {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+// session handles the requests for a session channel: a single exec or sftp
+// subsystem request, followed by signals.
+func (s *tsshd) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	var cmd *exec.Cmd
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			command := string(req.Payload[4:])
+			s.mutex.Lock()
+			s.commands = append(s.commands, command)
+			s.mutex.Unlock()
+
+			cmd = exec.Command("/bin/sh", "-c", command)
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			req.Reply(cmd.Start() == nil, nil)
+			go func(cmd *exec.Cmd) {
+				status := uint32(0)
+				if err := cmd.Wait(); err != nil {
+					status = 255
+					if exitErr, ok := err.(*exec.ExitError); ok {
+						if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Exited() {
+							status = uint32(ws.ExitStatus())
+						}
+					}
+				}
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, status)
+				channel.SendRequest("exit-status", false, payload)
+				channel.Close()
+			}(cmd)
+		case "subsystem":
+			req.Reply(string(req.Payload[4:]) == "sftp", nil)
+			go func() {
+				if server, err := sftp.NewServer(channel); err == nil {
+					server.Serve()
+				}
+				channel.Close()
+			}()
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *tsshd) Close() {
+	s.listener.Close()
+}
+
+// newTestSSHScheduler returns an *HTCondorScheduler connected to a new
+// *tsshd. The scheduler mirrors the local log directory into the remote
+// directory. The caller should close the server and remove the directories.
+func newTestSSHScheduler(t *testing.T) (*HTCondorScheduler, *tsshd, *viper.Viper) {
+	test.InitPath(t)
+	keyPEM, clientSigner := newECDSAKey(t)
+	server := startTestSSHServer(t, clientSigner.PublicKey())
+
+	dir, err := ioutil.TempDir("", "condor-launcher-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "id_ecdsa")
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("condor.scheduler", "ssh")
+	cfg.Set("condor.log_path", path.Join(dir, "local"))
+	cfg.Set("condor.path_env_var", "")
+	cfg.Set("condor.ssh.host", server.listener.Addr().String())
+	cfg.Set("condor.ssh.user", "condor")
+	cfg.Set("condor.ssh.key_file", keyFile)
+	cfg.Set("condor.ssh.host_key", string(ssh.MarshalAuthorizedKey(server.hostKey)))
+	cfg.Set("condor.ssh.remote_dir", path.Join(dir, "remote"))
+
+	s, err := NewSSHScheduler(cfg)
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, server, cfg
+}
+
+func TestRemoteCommand(t *testing.T) {
+	actual := remoteCommand("/tmp/it's here", []string{"PATH=", "CONDOR_CONFIG=/etc/condor"}, "condor_rm", "-constraint", `IpcUuid == "a"`)
+	expected := `cd '/tmp/it'\''s here' && exec env 'CONDOR_CONFIG=/etc/condor' 'condor_rm' '-constraint' 'IpcUuid == "a"'`
+	if actual != expected {
+		t.Errorf("remoteCommand returned\n%s\ninstead of\n%s", actual, expected)
+	}
+}
+
+func TestSSHSchedulerSubmit(t *testing.T) {
+	s, server, cfg := newTestSSHScheduler(t)
+	defer server.Close()
+	base := path.Dir(cfg.GetString("condor.log_path"))
+	defer os.RemoveAll(base)
+
+	local := path.Join(cfg.GetString("condor.log_path"), "ipcdev", "job-07b04ce2-7757-4b21-9e15-0b4c2f44be26", "logs")
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]os.FileMode{"iplant.cmd": 0644, irodsConfigName: 0600}
+	for name, mode := range files {
+		if err := ioutil.WriteFile(path.Join(local, name), []byte(name+" contents"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err := s.Submit(path.Join(local, "iplant.cmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "10000" {
+		t.Errorf("Submit returned %s instead of 10000", id)
+	}
+
+	remote := path.Join(cfg.GetString("condor.ssh.remote_dir"), "ipcdev", "job-07b04ce2-7757-4b21-9e15-0b4c2f44be26", "logs")
+	for name, mode := range files {
+		fname := path.Join(remote, name)
+		contents, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != name+" contents" {
+			t.Errorf("%s contains %q", fname, contents)
+		}
+		if info, err := os.Stat(fname); err != nil || info.Mode().Perm() != mode {
+			t.Errorf("%s wasn't copied with mode %s", fname, mode)
+		}
+	}
+
+	removeIRODSConfig(s, local)
+	for _, dir := range []string{local, remote} {
+		if _, err = os.Stat(path.Join(dir, irodsConfigName)); !os.IsNotExist(err) {
+			t.Errorf("the irods-config file in %s wasn't removed: %v", dir, err)
+		}
+	}
+	if err = s.Unstage(local, irodsConfigName); err != nil {
+		t.Errorf("Unstage failed for a file that was already removed: %v", err)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	expected := "cd " + shellQuote(remote) + " && exec env " + shellQuote("CONDOR_CONFIG="+cfg.GetString("condor.condor_config")) + " 'condor_submit' 'iplant.cmd'"
+	if len(server.commands) != 1 || server.commands[0] != expected {
+		t.Errorf("the commands run on the submit host were %q instead of %q", server.commands, expected)
+	}
+}
+
+func TestSSHSchedulerReleaseRestagesIRODSConfig(t *testing.T) {
+	s, server, cfg := newTestSSHScheduler(t)
+	defer server.Close()
+	base := path.Dir(cfg.GetString("condor.log_path"))
+	defer os.RemoveAll(base)
+
+	j := test.InitTests(t, cfg)
+	local := path.Join(cfg.GetString("condor.log_path"), "ipcdev", "job-"+j.InvocationID, "logs")
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cl := New(cfg, newtmessenger(), newtsys(), s)
+	cl.heldPolicy = newHeldJobPolicy(t)
+	if err := cl.storeConfig(j, local); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.runner.(stager).Stage(local); err != nil {
+		t.Fatal(err)
+	}
+	removeIRODSConfig(s, local)
+	if err := cl.journal.Record(JournalEntry{InvocationID: j.InvocationID, Job: j, SubmissionDir: local}); err != nil {
+		t.Fatal(err)
+	}
+
+	cl.handleHeldJob(heldAd(j.InvocationID, 13, 0, 1, time.Now()), time.Now())
+
+	remote := path.Join(cfg.GetString("condor.ssh.remote_dir"), "ipcdev", "job-"+j.InvocationID, "logs")
+	fname := path.Join(remote, irodsConfigName)
+	expected, err := ioutil.ReadFile(path.Join(local, irodsConfigName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("the irods-config file wasn't copied to the submit host again: %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("%s contains %q instead of %q", fname, actual, expected)
+	}
+	if info, err := os.Stat(fname); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("%s wasn't copied with mode 0600", fname)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if n := len(server.commands); n == 0 || !strings.Contains(server.commands[n-1], "'condor_release'") {
+		t.Errorf("the job wasn't released after the file was copied: %q", server.commands)
+	}
+}
+
+func TestSSHSchedulerQueries(t *testing.T) {
+	s, server, cfg := newTestSSHScheduler(t)
+	defer server.Close()
+	defer os.RemoveAll(path.Dir(cfg.GetString("condor.log_path")))
+
+	ads, err := s.QueryByConstraint("true", "IpcUuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads) == 0 || ads[0]["IpcUuid"] != "63c5523d-d8a5-49bc-addc-99a73566cd89" {
+		t.Errorf("QueryByConstraint returned %v", ads)
+	}
+
+	totals, err := s.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totals.Idle != 7 {
+		t.Errorf("Totals returned %+v", totals)
+	}
+
+	if _, err = s.Remove(`IpcUuid == "07b04ce2-7757-4b21-9e15-0b4c2f44be26"`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSSHSchedulerTimeout(t *testing.T) {
+	s, server, cfg := newTestSSHScheduler(t)
+	defer server.Close()
+	defer os.RemoveAll(path.Dir(cfg.GetString("condor.log_path")))
+
+	// The submit host is the local host, so a local script can be run.
+	script, dir := writeTestScript(t, "condor_q", sleepCommand(t))
+	defer os.RemoveAll(dir)
+	s.condorQ = script
+	s.SetTimeouts(CommandTimeouts{Q: 100 * time.Millisecond})
+
+	start := time.Now()
+	_, err := s.QueryByConstraint("true", "IpcUuid")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the remote command wasn't killed until %s had passed", elapsed)
+	}
+	if _, ok := errors.Cause(err).(*TimeoutError); !ok {
+		t.Errorf("QueryByConstraint returned %v instead of a *TimeoutError", err)
+	}
+}
+
+func TestSSHSchedulerHostKeyMismatch(t *testing.T) {
+	_, server, cfg := newTestSSHScheduler(t)
+	defer server.Close()
+	defer os.RemoveAll(path.Dir(cfg.GetString("condor.log_path")))
+
+	_, otherKey := newECDSAKey(t)
+	cfg.Set("condor.ssh.host_key", string(ssh.MarshalAuthorizedKey(otherKey.PublicKey())))
+	s, err := NewSSHScheduler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.QueryByConstraint("true", "IpcUuid"); err == nil {
+		t.Error("a command was run on a host with the wrong host key")
+	}
+}
+
+func TestSSHSchedulerJanitorRemovesStaged(t *testing.T) {
+	s, server, cfg := newTestSSHScheduler(t)
+	defer server.Close()
+	base := path.Dir(cfg.GetString("condor.log_path"))
+	defer os.RemoveAll(base)
+
+	jobDir := path.Join(cfg.GetString("condor.log_path"), "ipcdev", "job-07b04ce2-7757-4b21-9e15-0b4c2f44be26")
+	local := path.Join(jobDir, "logs")
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(local, "iplant.cmd"), []byte("iplant.cmd contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.runner.(stager).Stage(local); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJanitor(cfg, s, NewMemoryJournal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.remove(submissionDir{dir: jobDir, invocationID: "07b04ce2-7757-4b21-9e15-0b4c2f44be26"}, "retention"); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteUserDir := path.Join(cfg.GetString("condor.ssh.remote_dir"), "ipcdev")
+	for _, dir := range []string{jobDir, remoteUserDir} {
+		if _, err = os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed: %v", dir, err)
+		}
+	}
+	if err = s.RemoveStaged(jobDir); err != nil {
+		t.Errorf("RemoveStaged failed for a directory that was already removed: %v", err)
+	}
+}
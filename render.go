@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// renderedFiles returns the paths to the regular files in an output
+// directory, sorted by name.
+func renderedFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", dir)
+	}
+	var retval []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			retval = append(retval, filepath.Join(dir, info.Name()))
+		}
+	}
+	return retval, nil
+}
+
+// renderJobFile writes the submission files for the job in jobPath to outDir
+// without submitting it, returning the paths to the files in outDir.
+func renderJobFile(cl *CondorLauncher, jobPath, outDir string) ([]string, error) {
+	data, err := ioutil.ReadFile(jobPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", jobPath)
+	}
+	job, err := model.NewFromData(cl.config(), data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the job in %s", jobPath)
+	}
+
+	if err = validateJob(job); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(outDir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create the directory %s", outDir)
+	}
+	if _, err = cl.renderSubmission(job, outDir); err != nil {
+		return nil, err
+	}
+
+	return renderedFiles(outDir)
+}
+
+// runRender implements the render subcommand, which writes the submission
+// files for a job without submitting it.
+func runRender(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	cfgPath := flags.String("config", "", "Path to the config file. Required.")
+	jobPath := flags.String("job", "", "Path to the job JSON. Required.")
+	outDir := flags.String("out", "", "Directory to write the submission files to. Required.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: condor-launcher render --config <path> --job <path> --out <dir>")
+		fmt.Fprintln(os.Stderr, "Writes the submission files for a job without submitting it.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *cfgPath == "" || *jobPath == "" || *outDir == "" {
+		fmt.Println("Error: --config, --job and --out must be set.")
+		flags.Usage()
+		os.Exit(-1)
+	}
+
+	cfg, err := loadConfig(*cfgPath)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+
+	cl := New(cfg, nil, &osys{}, nil)
+	if cl.credentials, err = NewCredentialProvider(cfg); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if dir := cfg.GetString("condor.templates.dir"); dir != "" {
+		if cl.templates, err = LoadTemplateOverrides(dir); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+
+	files, err := renderJobFile(cl, *jobPath, *outDir)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	for _, f := range files {
+		fmt.Println(f)
+	}
+}
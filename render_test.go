@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestRenderJobFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outDir := filepath.Join(dir, "out")
+
+	scheduler := newtscheduler()
+	cl := New(test.InitConfig(t), newtmessenger(), newtsys(), scheduler)
+	files, err := renderJobFile(cl, "test/test_submission.json", outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("the job was submitted: %v", scheduler.submitted)
+	}
+	rendered := make(map[string]bool)
+	for _, f := range files {
+		rendered[f] = true
+	}
+	for _, name := range []string{"iplant.cmd", "config", "job", "irods-config"} {
+		if !rendered[filepath.Join(outDir, name)] {
+			t.Errorf("%s wasn't rendered: %v", name, files)
+		}
+	}
+}
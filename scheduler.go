@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// Scheduler defines an interface for the batch system operations needed by
+// condor-launcher. The default implementation runs the HTCondor command-line
+// tools on the local host.
+type Scheduler interface {
+	// Submit submits the job described by the submit file at submissionPath
+	// and returns the cluster ID assigned to it. Failures should be returned
+	// as a *SubmitError so that they can be retried or failed appropriately.
+	Submit(submissionPath string) (string, error)
+
+	// Remove removes the jobs matching the constraint and returns the output
+	// of the removal.
+	Remove(constraint string) ([]byte, error)
+
+	// Release releases the held jobs matching the constraint and returns the
+	// output of the release.
+	Release(constraint string) ([]byte, error)
+
+	// QueryByConstraint returns the requested attributes of the jobs in the
+	// queue that match the constraint.
+	QueryByConstraint(constraint string, attrs ...string) ([]JobAd, error)
+
+	// History returns the requested attributes of the jobs that have left the
+	// queue and match the constraint, most recent first. The search stops
+	// after limit matches unless limit is 0.
+	History(constraint string, limit int, attrs ...string) ([]JobAd, error)
+
+	// Totals returns the number of jobs in the queue in each state.
+	Totals() (QueueTotals, error)
+}
+
+// QueueTotals contains the number of jobs in the queue in each state.
+type QueueTotals struct {
+	Jobs      int
+	Completed int
+	Removed   int
+	Idle      int
+	Running   int
+	Held      int
+	Suspended int
+}
+
+// JobAd contains a subset of the attributes of a job's ClassAd, keyed by
+// attribute name. Values are the unquoted string forms of the attributes.
+type JobAd map[string]string
+
+// CommandTimeouts contains how long each of the HTCondor commands may run
+// before it's killed. A zero timeout means the command may run indefinitely.
+type CommandTimeouts struct {
+	Submit       time.Duration
+	Rm           time.Duration
+	Q            time.Duration
+	History      time.Duration
+	Release      time.Duration
+	TransferData time.Duration
+}
+
+// commandTimeoutsFromConfig reads the condor.command_timeouts settings.
+func commandTimeoutsFromConfig(cfg *viper.Viper) (CommandTimeouts, error) {
+	var timeouts CommandTimeouts
+	for key, d := range map[string]*time.Duration{
+		"submit":        &timeouts.Submit,
+		"rm":            &timeouts.Rm,
+		"q":             &timeouts.Q,
+		"history":       &timeouts.History,
+		"release":       &timeouts.Release,
+		"transfer_data": &timeouts.TransferData,
+	} {
+		key = "condor.command_timeouts." + key
+		var err error
+		if *d, err = time.ParseDuration(cfg.GetString(key)); err != nil {
+			return CommandTimeouts{}, errors.Wrapf(err, "failed to parse %s", key)
+		}
+	}
+	return timeouts, nil
+}
+
+// TimeoutError is returned when an HTCondor command runs for longer than its
+// timeout and is killed.
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s was killed after running for longer than %s", e.Command, e.Timeout)
+}
+
+// commandRunner runs the HTCondor command-line tools for an
+// HTCondorScheduler.
+type commandRunner interface {
+	// Run runs a command from dir with the environment variables in env and
+	// returns its combined output. The command must be killed once ctx is
+	// done.
+	Run(ctx context.Context, dir string, env []string, name string, args ...string) ([]byte, error)
+}
+
+// stager is implemented by the commandRunners that run commands on another
+// host, where the submission directory has to be copied before the job is
+// submitted.
+type stager interface {
+	// Stage copies a submission directory to the other host and returns the
+	// path to the copy.
+	Stage(dir string) (string, error)
+
+	// Unstage removes a file from the copy of a submission directory. It
+	// isn't an error if the file doesn't exist.
+	Unstage(dir, name string) error
+
+	// Restage copies a single file of a submission directory to the copy
+	// again.
+	Restage(dir, name string) error
+	// RemoveStaged removes the copy of a directory. It isn't an error if
+	// there isn't one.
+	RemoveStaged(dir string) error
+}
+
+// unstager is implemented by the Schedulers that may copy submission
+// directories to a remote submit host.
+type unstager interface {
+	// Unstage removes a file from the copy of a submission directory.
+	Unstage(dir, name string) error
+
+	// Restage copies a file to the copy of a submission directory again.
+	Restage(dir, name string) error
+	// RemoveStaged removes the copy of a directory.
+	RemoveStaged(dir string) error
+}
+
+// localRunner runs commands on the local host.
+type localRunner struct{}
+
+func (localRunner) Run(ctx context.Context, dir string, env []string, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = env
+	cmd.Dir = dir
+	return cmd.CombinedOutput()
+}
+
+// HTCondorScheduler is a Scheduler that executes the HTCondor command-line
+// tools.
+type HTCondorScheduler struct {
+	runner commandRunner
+
+	condorSubmit  string // path to the condor_submit executable
+	condorRm      string // path to the condor_rm executable
+	condorQ       string // path to the condor_q executable
+	condorHistory string // path to the condor_history executable
+	condorRelease string // path to the condor_release executable
+
+	// These are only set if jobs are spooled to a remote schedd.
+	condorTransferData string // path to the condor_transfer_data executable
+	scheddName         string
+	pool               string
+
+	envMutex     sync.RWMutex
+	condorPath   string // the $PATH used when running the commands
+	condorConfig string // the $CONDOR_CONFIG used when running the commands
+	timeouts     CommandTimeouts
+
+	ctx    context.Context // canceled when the scheduler is stopped
+	cancel context.CancelFunc
+}
+
+// NewHTCondorScheduler returns a new *HTCondorScheduler. The paths to the
+// executables should be absolute. The commands run without timeouts until
+// SetTimeouts is called.
+func NewHTCondorScheduler(condorSubmit, condorRm, condorQ, condorHistory, condorRelease, condorPath, condorConfig string) *HTCondorScheduler {
+	return newHTCondorScheduler(localRunner{}, condorSubmit, condorRm, condorQ, condorHistory, condorRelease, condorPath, condorConfig)
+}
+
+func newHTCondorScheduler(runner commandRunner, condorSubmit, condorRm, condorQ, condorHistory, condorRelease, condorPath, condorConfig string) *HTCondorScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &HTCondorScheduler{
+		runner:        runner,
+		condorSubmit:  condorSubmit,
+		condorRm:      condorRm,
+		condorQ:       condorQ,
+		condorHistory: condorHistory,
+		condorRelease: condorRelease,
+		condorPath:    condorPath,
+		condorConfig:  condorConfig,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// SpoolTo makes the scheduler submit jobs to the named schedd, spooling their
+// input files, and manage the jobs there. The collector for the schedd's pool
+// is optional. The output of the jobs is retrieved with the
+// condor_transfer_data executable at condorTransferData. SpoolTo must be
+// called before the scheduler is used.
+func (s *HTCondorScheduler) SpoolTo(condorTransferData, scheddName, pool string) {
+	s.condorTransferData = condorTransferData
+	s.scheddName = scheddName
+	s.pool = pool
+}
+
+// Spooling returns true if jobs are spooled to a remote schedd.
+func (s *HTCondorScheduler) Spooling() bool {
+	return s.scheddName != ""
+}
+
+// scheddArgs returns the arguments that select the remote schedd, using the
+// given flag for the schedd's name, followed by args.
+func (s *HTCondorScheduler) scheddArgs(nameFlag string, args ...string) []string {
+	if !s.Spooling() {
+		return args
+	}
+	retval := []string{nameFlag, s.scheddName}
+	if s.pool != "" {
+		retval = append(retval, "-pool", s.pool)
+	}
+	return append(retval, args...)
+}
+
+// SetEnvironment changes the $PATH and $CONDOR_CONFIG used for the commands
+// that are run from now on.
+func (s *HTCondorScheduler) SetEnvironment(condorPath, condorConfig string) {
+	s.envMutex.Lock()
+	defer s.envMutex.Unlock()
+	s.condorPath = condorPath
+	s.condorConfig = condorConfig
+}
+
+// SetTimeouts changes the timeouts for the commands that are run from now on.
+func (s *HTCondorScheduler) SetTimeouts(timeouts CommandTimeouts) {
+	s.envMutex.Lock()
+	defer s.envMutex.Unlock()
+	s.timeouts = timeouts
+}
+
+// Stop kills the commands that are running. Commands that are run afterwards
+// fail immediately.
+func (s *HTCondorScheduler) Stop() {
+	s.cancel()
+}
+
+// timeout returns the timeout for one of the HTCondor tools. The caller must
+// hold envMutex.
+func (s *HTCondorScheduler) timeout(name string) time.Duration {
+	switch name {
+	case s.condorSubmit:
+		return s.timeouts.Submit
+	case s.condorRm:
+		return s.timeouts.Rm
+	case s.condorQ:
+		return s.timeouts.Q
+	case s.condorHistory:
+		return s.timeouts.History
+	case s.condorRelease:
+		return s.timeouts.Release
+	case s.condorTransferData:
+		return s.timeouts.TransferData
+	}
+	return 0
+}
+
+// run runs one of the HTCondor tools from dir with its environment set up and
+// returns its combined output, recording its duration and exit status. The
+// command is killed if it runs for longer than its timeout or if the
+// scheduler is stopped. An empty dir runs it from the current directory.
+func (s *HTCondorScheduler) run(dir, name string, args ...string) ([]byte, error) {
+	s.envMutex.RLock()
+	env := []string{
+		fmt.Sprintf("PATH=%s", s.condorPath),
+		fmt.Sprintf("CONDOR_CONFIG=%s", s.condorConfig),
+	}
+	d := s.timeout(name)
+	s.envMutex.RUnlock()
+
+	ctx := s.ctx
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(s.ctx, d)
+		defer cancel()
+	}
+
+	start := time.Now()
+	output, err := s.runner.Run(ctx, dir, env, name, args...)
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			err = &TimeoutError{Command: path.Base(name), Timeout: d}
+		case context.Canceled:
+			err = fmt.Errorf("%s was killed because the launcher is shutting down", path.Base(name))
+		}
+	}
+	observeCommand(name, start, err)
+	return output, err
+}
+
+// Submit runs condor_submit from the directory containing the submit file,
+// copying the directory to the submit host first if it's remote. When jobs
+// are spooled, the files in the directory are copied to the schedd.
+func (s *HTCondorScheduler) Submit(submissionPath string) (string, error) {
+	dir := path.Dir(submissionPath)
+	if st, ok := s.runner.(stager); ok {
+		var err error
+		if dir, err = st.Stage(dir); err != nil {
+			return "", err
+		}
+	}
+	args := []string{path.Base(submissionPath)}
+	if s.Spooling() {
+		args = s.scheddArgs("-remote", append([]string{"-spool"}, args...)...)
+	}
+	output, err := s.run(dir, s.condorSubmit, args...)
+	log.Infof("Output of condor_submit:\n%s\n", output)
+	if err != nil {
+		return "", newSubmitError(s.condorSubmit, output, err)
+	}
+	return string(model.ExtractJobID(output)), nil
+}
+
+// Unstage removes a file from the copy of a submission directory on the
+// submit host. It does nothing if the submit host is the local host.
+func (s *HTCondorScheduler) Unstage(dir, name string) error {
+	if st, ok := s.runner.(stager); ok {
+		return st.Unstage(dir, name)
+	}
+	return nil
+}
+
+// Restage copies a file to the copy of a submission directory on the submit
+// host again, if the scheduler made a copy.
+func (s *HTCondorScheduler) Restage(dir, name string) error {
+	if st, ok := s.runner.(stager); ok {
+		return st.Restage(dir, name)
+	}
+	return nil
+}
+
+// RemoveStaged removes the copy of a directory from the submit host, if the
+// scheduler made a copy.
+func (s *HTCondorScheduler) RemoveStaged(dir string) error {
+	if st, ok := s.runner.(stager); ok {
+		return st.RemoveStaged(dir)
+	}
+	return nil
+}
+
+// Remove runs condor_rm with the given constraint.
+func (s *HTCondorScheduler) Remove(constraint string) ([]byte, error) {
+	output, err := s.run("", s.condorRm, s.scheddArgs("-name", "-constraint", constraint)...)
+	if err != nil {
+		return output, errors.Wrapf(err, "failed to get the output of '%s -constraint %s'", s.condorRm, constraint)
+	}
+	return output, nil
+}
+
+// Release runs condor_release with the given constraint.
+func (s *HTCondorScheduler) Release(constraint string) ([]byte, error) {
+	output, err := s.run("", s.condorRelease, s.scheddArgs("-name", "-constraint", constraint)...)
+	if err != nil {
+		return output, errors.Wrapf(err, "failed to get the output of '%s -constraint %s'", s.condorRelease, constraint)
+	}
+	return output, nil
+}
+
+// QueryByConstraint runs condor_q with the given constraint, auto-formatting
+// the requested attributes.
+func (s *HTCondorScheduler) QueryByConstraint(constraint string, attrs ...string) ([]JobAd, error) {
+	return s.query(s.condorQ, constraint, attrs)
+}
+
+// History runs condor_history with the given constraint, auto-formatting the
+// requested attributes.
+func (s *HTCondorScheduler) History(constraint string, limit int, attrs ...string) ([]JobAd, error) {
+	// condor_history reads the whole history file unless it's told when to
+	// stop.
+	var options []string
+	if limit > 0 {
+		options = []string{"-match", strconv.Itoa(limit)}
+	}
+	return s.query(s.condorHistory, constraint, attrs, options...)
+}
+
+// Totals runs condor_q -totals.
+func (s *HTCondorScheduler) Totals() (QueueTotals, error) {
+	output, err := s.run("", s.condorQ, s.scheddArgs("-name", "-totals")...)
+	if err != nil {
+		return QueueTotals{}, errors.Wrapf(err, "failed to get the output of '%s -totals'", s.condorQ)
+	}
+	return parseQueueTotals(output)
+}
+
+// TransferData runs condor_transfer_data with the given constraint, which
+// retrieves the output of the matching jobs from the remote schedd.
+func (s *HTCondorScheduler) TransferData(constraint string) ([]byte, error) {
+	if !s.Spooling() {
+		return nil, errors.New("jobs aren't being spooled to a remote schedd")
+	}
+	output, err := s.run("", s.condorTransferData, s.scheddArgs("-name", "-constraint", constraint)...)
+	if err != nil {
+		return output, errors.Wrapf(err, "failed to get the output of '%s -constraint %s'", s.condorTransferData, constraint)
+	}
+	return output, nil
+}
+
+// queueTotalsRegexp matches the counts in the summary line of condor_q.
+var queueTotalsRegexp = regexp.MustCompile(`(\d+) (jobs|completed|removed|idle|running|held|suspended)\b`)
+
+// parseQueueTotals parses the output of condor_q -totals. Newer versions of
+// HTCondor print a line for the query and another for all users; the line
+// for the query is used. Older versions print a single line.
+func parseQueueTotals(output []byte) (QueueTotals, error) {
+	var summary string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Total for query:") {
+			summary = line
+			break
+		}
+		if strings.Contains(line, " jobs;") {
+			summary = line
+		}
+	}
+	if summary == "" {
+		return QueueTotals{}, fmt.Errorf("no totals were found in the condor_q output: %q", output)
+	}
+
+	var totals QueueTotals
+	fields := map[string]*int{
+		"jobs":      &totals.Jobs,
+		"completed": &totals.Completed,
+		"removed":   &totals.Removed,
+		"idle":      &totals.Idle,
+		"running":   &totals.Running,
+		"held":      &totals.Held,
+		"suspended": &totals.Suspended,
+	}
+	for _, m := range queueTotalsRegexp.FindAllStringSubmatch(summary, -1) {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return QueueTotals{}, errors.Wrapf(err, "failed to parse %q", m[0])
+		}
+		*fields[m[2]] = n
+	}
+	return totals, nil
+}
+
+// query runs condor_q or condor_history with the given options and returns
+// the requested attributes of the jobs that match the constraint.
+func (s *HTCondorScheduler) query(cmdPath, constraint string, attrs []string, options ...string) ([]JobAd, error) {
+	args := append([]string{}, options...)
+	args = append(args, "-constraint", constraint, "-af:t")
+	cmdArgs := s.scheddArgs("-name", append(args, attrs...)...)
+	output, err := s.run("", cmdPath, cmdArgs...)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to get the output of the command '%s %s'",
+			cmdPath,
+			strings.Join(cmdArgs, " "))
+	}
+	return parseJobAds(output, attrs), nil
+}
+
+// parseJobAds parses the tab-separated output of an auto-formatted condor_q
+// or condor_history command. Blank lines are skipped.
+func parseJobAds(output []byte, attrs []string) []JobAd {
+	var retval []JobAd
+
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		fields := strings.Split(string(line), "\t")
+		ad := make(JobAd, len(attrs))
+		for i, attr := range attrs {
+			if i < len(fields) {
+				ad[attr] = strings.TrimSpace(fields[i])
+			}
+		}
+		retval = append(retval, ad)
+	}
+
+	return retval
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+var (
+	listing = []byte(`
+63c5523d-d8a5-49bc-addc-99a73566cd89
+b788569f-6948-4586-b5bd-5ea096986331
+eca67a7c-e745-4e98-b892-67a9948bc2cb
+
+571722aa-f46c-40fd-a688-69068fb52ee1
+105fba2c-c9a5-4a89-8033-9d3b3e5c419f
+51d4cb60-e925-4229-a257-8d5b6feeedb8
+22c13517-4a2d-4874-92b3-5b5d03299d60
+316bc5ba-aaee-4922-a8c7-ea9479a65650
+1e0cc85e-6053-452c-b1a9-cedc0f12cf7b
+7ffa2752-e7bf-4eae-8ed5-b366aef7978e
+d9eaa702-14d5-439e-b01f-4ca3a39096ec
+57ff5e6b-5a4f-496b-9f66-eeadfbd03e86
+0af6c62a-3570-46de-9f27-9b6c430bd912
+0d607f70-ad65-4a8c-bfe3-1b0efb7a20e9
+10af43af-6f63-4305-8bad-e70ae208ec4c
+1fa4bea3-8f3e-472e-9981-3b1a5b0d425e
+30282173-70e5-4055-8621-a3a149db1829
+9b21c5c6-19b3-45cc-9e87-720d57032e71
+6a54a3bc-1a42-453d-9fa9-81300804f26f
+827624c9-1e1b-4783-ab7a-23e78c599cc3
+c6193b50-cdaa-48c8-aa69-3957431b05a2
+d0952a64-8d7c-4d2b-9046-6c91425e0671
+
+4457ec2d-5203-4ab6-95e5-2831d998dd1f
+6e7d9735-1fc7-4626-b5d3-91993eae7a1b
+3c967e99-51ff-484d-a000-3ce3adf744ce
+8d64bc74-750a-4cd3-bbf3-2d9a4e56fcf0
+77ac1023-c6d1-403c-8088-04205a270c7a
+dc9f2455-da10-42c6-bc58-b7a963b46338
+74a17e36-ac52-4dde-9abb-e5a8dca0b2c6
+7446aa7b-16db-4b4f-ad8d-8d802b402aaa
+ee6cdfe9-bd90-460a-bb5f-b10b3e299b10
+a45770ad-cc7d-4fc8-8b1a-ffb75bd44e0e
+dd632e6c-50e7-4b81-bb07-9d2abe0a9b15
+f532df1e-591e-47f1-84e6-fdf670727040
+12febe03-ae83-48f2-b828-c2865fecf09e
+e802a7b5-13f2-462d-ac85-f9836a4fd575
+18f6b09f-63bd-4825-a34e-4767dee4f358
+4a039e5a-0335-45ee-880b-5495c92bfc9a
+6123e600-ec4f-4d29-b2c4-edd0af089b04
+ba30efdd-4207-4120-91dd-de5caed467ae
+9d20a879-6d33-43b4-b430-0c1cfaf5a7c4
+8f4002c0-d650-4252-943d-56287b6c6efe
+3c5c986e-1b69-4ff2-a470-0f677148240e
+f0ffb7ee-b7c6-4a07-814b-88d76b3cc3b8
+65ecca14-759e-41ee-b764-069ac0155df5
+36770cc9-d80b-405c-b9be-c5977ae3e83b
+4a4926a6-2a18-4b37-a361-581658a0f067
+15384749-bc5f-43ff-854e-b6495e0c6ee4
+2e8c0c9c-133a-4436-b1a4-3bb303ce7cd3`)
+)
+
+func TestParseJobAds(t *testing.T) {
+	var ids []string
+	for _, ad := range parseJobAds(listing, []string{"IpcUuid"}) {
+		ids = append(ids, ad["IpcUuid"])
+	}
+
+	invID := "63c5523d-d8a5-49bc-addc-99a73566cd89"
+	found := containsInvocationID(ids, invID)
+	if !found {
+		t.Errorf("The expected InvocationID of %s was not parsed", invID)
+	}
+
+	invID = "b788569f-6948-4586-b5bd-5ea096986331"
+	found = containsInvocationID(ids, invID)
+	if !found {
+		t.Errorf("The expected InvocationID of %s was not parsed", invID)
+	}
+
+	invID = "eca67a7c-e745-4e98-b892-67a9948bc2cb"
+	found = containsInvocationID(ids, invID)
+	if !found {
+		t.Errorf("The expected InvocationID of %s was not parsed", invID)
+	}
+
+	if len(ids) != 49 {
+		t.Errorf("parseJobAds returned %d ads instead of 49", len(ids))
+	}
+}
+
+func TestParseJobAdsMultipleAttributes(t *testing.T) {
+	output := []byte("foo\t1\t2\n\nbar\t3\n")
+	actual := parseJobAds(output, []string{"IpcUuid", "ClusterId", "JobStatus"})
+	expected := []JobAd{
+		{"IpcUuid": "foo", "ClusterId": "1", "JobStatus": "2"},
+		{"IpcUuid": "bar", "ClusterId": "3"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("parseJobAds returned %#v instead of %#v", actual, expected)
+	}
+}
+
+func TestHTCondorSchedulerSubmit(t *testing.T) {
+	actual, err := newTestScheduler(t).Submit("/tmp/iplant.cmd")
+	if err != nil {
+		t.Error(err)
+	}
+	expected := "10000"
+	if actual != expected {
+		t.Errorf("Submit returned '%s' instead of '%s'", actual, expected)
+	}
+}
+
+func TestHTCondorSchedulerRemove(t *testing.T) {
+	actual, err := newTestScheduler(t).Remove(`IpcUuid =?= "foo"`)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []byte("IpcUuid =?= \"foo\" was stopped\n")
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Remove returned '%s' instead of '%s'", actual, expected)
+	}
+}
+
+func TestHTCondorSchedulerRelease(t *testing.T) {
+	actual, err := newTestScheduler(t).Release(`IpcUuid =?= "foo"`)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []byte("IpcUuid =?= \"foo\" was released\n")
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Release returned '%s' instead of '%s'", actual, expected)
+	}
+}
+
+func TestHTCondorSchedulerHistory(t *testing.T) {
+	actual, err := newTestScheduler(t).History(`IpcUuid =?= "foo"`, 0, "IpcUuid", "ClusterId", "JobStatus", "ExitCode")
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []JobAd{
+		{
+			"IpcUuid":   "571722aa-f46c-40fd-a688-69068fb52ee1",
+			"ClusterId": "10000",
+			"JobStatus": "4",
+			"ExitCode":  "0",
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("History returned %#v instead of %#v", actual, expected)
+	}
+}
+
+func TestParseQueueTotals(t *testing.T) {
+	cases := []struct {
+		output   string
+		expected QueueTotals
+	}{
+		{
+			"Total for query: 12 jobs; 1 completed, 0 removed, 7 idle, 3 running, 1 held, 0 suspended\n" +
+				"Total for all users: 40 jobs; 2 completed, 0 removed, 25 idle, 10 running, 3 held, 0 suspended\n",
+			QueueTotals{Jobs: 12, Completed: 1, Idle: 7, Running: 3, Held: 1},
+		},
+		{
+			"-- Submitter: submit.example.org : <127.0.0.1:9618> : submit.example.org\n" +
+				"5 jobs; 0 completed, 0 removed, 2 idle, 2 running, 1 held, 0 suspended\n",
+			QueueTotals{Jobs: 5, Idle: 2, Running: 2, Held: 1},
+		},
+	}
+	for _, c := range cases {
+		actual, err := parseQueueTotals([]byte(c.output))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if actual != c.expected {
+			t.Errorf("parseQueueTotals returned %+v instead of %+v", actual, c.expected)
+		}
+	}
+	if _, err := parseQueueTotals([]byte("condor_q: failed to connect\n")); err == nil {
+		t.Error("totals were parsed from output that doesn't contain any")
+	}
+}
+
+func TestHTCondorSchedulerTotals(t *testing.T) {
+	actual, err := newTestScheduler(t).Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := QueueTotals{Jobs: 12, Completed: 1, Idle: 7, Running: 3, Held: 1}
+	if actual != expected {
+		t.Errorf("Totals returned %+v instead of %+v", actual, expected)
+	}
+}
+
+// writeTestScript writes a shell script standing in for one of the HTCondor
+// tools to a new temporary directory, which the caller should remove.
+func writeTestScript(t *testing.T, name, body string) (string, string) {
+	dir, err := ioutil.TempDir("", "condor-launcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := path.Join(dir, name)
+	if err = ioutil.WriteFile(script, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return script, dir
+}
+
+// sleepCommand returns a command that sleeps long enough for a test to time
+// out. The scripts run with an empty $PATH, so sleep is found beforehand. The
+// shell is replaced so that killing the script kills sleep too.
+func sleepCommand(t *testing.T) string {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep isn't available")
+	}
+	return "exec " + sleep + " 10"
+}
+
+func TestCommandTimeoutsFromConfig(t *testing.T) {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("condor.command_timeouts.rm", "0s")
+	actual, err := commandTimeoutsFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CommandTimeouts{Submit: 2 * time.Minute, Q: time.Minute, History: 2 * time.Minute, Release: time.Minute, TransferData: 10 * time.Minute}
+	if actual != expected {
+		t.Errorf("commandTimeoutsFromConfig returned %+v instead of %+v", actual, expected)
+	}
+
+	cfg.Set("condor.command_timeouts.q", "soon")
+	if _, err = commandTimeoutsFromConfig(cfg); err == nil {
+		t.Error("an invalid timeout was accepted")
+	}
+}
+
+func TestHTCondorSchedulerTimeout(t *testing.T) {
+	script, dir := writeTestScript(t, "condor_q", sleepCommand(t))
+	defer os.RemoveAll(dir)
+
+	s := newTestScheduler(t)
+	s.condorQ = script
+	s.SetTimeouts(CommandTimeouts{Q: 100 * time.Millisecond})
+
+	start := time.Now()
+	_, err := s.QueryByConstraint("true", "IpcUuid")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("condor_q wasn't killed until %s had passed", elapsed)
+	}
+	timeoutErr, ok := errors.Cause(err).(*TimeoutError)
+	if !ok {
+		t.Fatalf("QueryByConstraint returned %v instead of a *TimeoutError", err)
+	}
+	if timeoutErr.Command != "condor_q" || timeoutErr.Timeout != 100*time.Millisecond {
+		t.Errorf("the timeout was reported as %+v", timeoutErr)
+	}
+}
+
+func TestHTCondorSchedulerSubmitTimeout(t *testing.T) {
+	script, dir := writeTestScript(t, "condor_submit", sleepCommand(t))
+	defer os.RemoveAll(dir)
+
+	s := newTestScheduler(t)
+	s.condorSubmit = script
+	s.SetTimeouts(CommandTimeouts{Submit: 100 * time.Millisecond})
+
+	_, err := s.Submit(path.Join(dir, "iplant.cmd"))
+	submitErr, ok := err.(*SubmitError)
+	if !ok {
+		t.Fatalf("Submit returned %v instead of a *SubmitError", err)
+	}
+	if !submitErr.Transient() {
+		t.Errorf("the timeout was classified as %s instead of transient", submitErr.Kind)
+	}
+	if _, ok = errors.Cause(submitErr.Err).(*TimeoutError); !ok {
+		t.Errorf("the submit error wasn't caused by a *TimeoutError: %v", submitErr.Err)
+	}
+}
+
+func TestHTCondorSchedulerStop(t *testing.T) {
+	script, dir := writeTestScript(t, "condor_rm", sleepCommand(t))
+	defer os.RemoveAll(dir)
+
+	s := newTestScheduler(t)
+	s.condorRm = script
+	time.AfterFunc(100*time.Millisecond, s.Stop)
+
+	start := time.Now()
+	_, err := s.Remove("true")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("condor_rm wasn't killed until %s had passed", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "shutting down") {
+		t.Errorf("Remove returned %v after the scheduler was stopped", err)
+	}
+}
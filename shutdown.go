@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Ticker calls a function on a fixed interval until it's stopped.
+type Ticker struct {
+	ticker *time.Ticker
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// startTicker calls f every interval until the returned *Ticker is stopped.
+func startTicker(interval time.Duration, f func()) *Ticker {
+	t := &Ticker{
+		ticker: time.NewTicker(interval),
+		done:   make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			select {
+			case <-t.ticker.C:
+				f()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Stop stops the ticker and waits for a call that's in progress to return.
+func (t *Ticker) Stop() {
+	t.ticker.Stop()
+	close(t.done)
+	t.wg.Wait()
+}
+
+// beginHandling registers an AMQP delivery handler that's starting work. If
+// the launcher is shutting down, it blocks until the AMQP connection has been
+// closed and returns false. The delivery should be left unacknowledged so
+// that the broker requeues it for another launcher when the connection
+// closes, rather than being rejected and redelivered to this one.
+func (cl *CondorLauncher) beginHandling() bool {
+	cl.drainMutex.Lock()
+	if cl.draining {
+		cl.drainMutex.Unlock()
+		<-cl.closed
+		return false
+	}
+	defer cl.drainMutex.Unlock()
+	cl.inflight.Add(1)
+	return true
+}
+
+// endHandling registers that a delivery handler has finished.
+func (cl *CondorLauncher) endHandling() {
+	cl.inflight.Done()
+}
+
+// drain stops new deliveries from being handled and waits up to timeout for
+// the handlers that are already running to finish. It returns false if the
+// timeout expired first. The deliveries that arrive afterwards are held until
+// closeDeliveries is called.
+func (cl *CondorLauncher) drain(timeout time.Duration) bool {
+	cl.drainMutex.Lock()
+	if !cl.draining {
+		cl.draining = true
+		close(cl.stopping)
+	}
+	cl.drainMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		cl.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// closeDeliveries releases the delivery handlers held since the launcher
+// started draining. It's called once the AMQP connection has been closed.
+func (cl *CondorLauncher) closeDeliveries() {
+	cl.drainMutex.Lock()
+	defer cl.drainMutex.Unlock()
+	select {
+	case <-cl.closed:
+	default:
+		close(cl.closed)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestTicker(t *testing.T) {
+	var calls int32
+	ticker := startTicker(time.Millisecond, func() {
+		atomic.AddInt32(&calls, 1)
+	})
+	time.Sleep(20 * time.Millisecond)
+	ticker.Stop()
+
+	stopped := atomic.LoadInt32(&calls)
+	if stopped == 0 {
+		t.Fatal("the function was never called")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if actual := atomic.LoadInt32(&calls); actual != stopped {
+		t.Errorf("the function was called %d times after the ticker was stopped", actual-stopped)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cl := New(cfg, newtmessenger(), newtsys(), newtscheduler())
+
+	if !cl.beginHandling() {
+		t.Fatal("beginHandling returned false before the launcher was draining")
+	}
+	if cl.drain(10 * time.Millisecond) {
+		t.Error("drain returned true while a handler was running")
+	}
+
+	// New deliveries are held without being handled or acknowledged until
+	// the connection is closed.
+	j := test.InitTests(t, cfg)
+	delivery, ack := launchDelivery(t, j)
+	handled := make(chan struct{})
+	go func() {
+		cl.handleLaunchRequests()(delivery)
+		close(handled)
+	}()
+	select {
+	case <-handled:
+		t.Fatal("a delivery was handled while the launcher was draining")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cl.endHandling()
+	if !cl.drain(10 * time.Millisecond) {
+		t.Error("drain returned false after the handlers finished")
+	}
+
+	cl.closeDeliveries()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("the delivery was still held after the connection was closed")
+	}
+	if ack.acked || ack.rejected {
+		t.Errorf("the delivery was acknowledged during shutdown: %#v", ack)
+	}
+	if updates := cl.client.(*tmessenger).updates; len(updates) != 0 {
+		t.Errorf("updates were published during shutdown: %v", updates)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/condor-launcher/classad"
+)
+
+// completedJobsConstraint matches the jobs submitted by the launcher that
+// have completed but are still in the queue. A remote schedd keeps spooled
+// jobs in its queue until their output has been retrieved.
+var completedJobsConstraint = classad.And(
+	classad.IsNot(classad.Attr("IpcUuid"), classad.Undefined),
+	classad.Equal(classad.Attr("JobStatus"), classad.Int(4)),
+).String()
+
+// SpoolingScheduler is a Scheduler that can spool jobs to a remote schedd.
+type SpoolingScheduler interface {
+	Scheduler
+
+	// Spooling returns true if jobs are spooled to a remote schedd.
+	Spooling() bool
+
+	// TransferData retrieves the output of the spooled jobs matching the
+	// constraint from the remote schedd.
+	TransferData(constraint string) ([]byte, error)
+}
+
+// retrieveSpooledOutput retrieves the output of every completed job from the
+// remote schedd, placing it in the job's submission directory, and then
+// removes the job from the schedd's queue.
+func retrieveSpooledOutput(s SpoolingScheduler) {
+	ads, err := s.QueryByConstraint(completedJobsConstraint, "IpcUuid", "ClusterId")
+	if err != nil {
+		log.Errorf("%+v\n", errors.Wrap(err, "failed to list the completed jobs on the remote schedd"))
+		return
+	}
+	for _, ad := range ads {
+		invocationID := ad["IpcUuid"]
+		constraint := ipcUUIDConstraint(invocationID)
+		if _, err = s.TransferData(constraint); err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to retrieve the output of job %s", invocationID))
+			spooledOutputRetrievals.WithLabelValues("failed").Inc()
+			continue
+		}
+		if _, err = s.Remove(constraint); err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to remove job %s from the remote schedd", invocationID))
+		}
+		log.Infof("retrieved the output of job %s (Condor ID %s)", invocationID, ad["ClusterId"])
+		spooledOutputRetrievals.WithLabelValues("succeeded").Inc()
+	}
+}
+
+// startOutputRetrieval starts up the code that periodically retrieves the
+// output of the jobs spooled to a remote schedd.
+func startOutputRetrieval(s SpoolingScheduler, interval time.Duration) *Ticker {
+	return startTicker(interval, func() {
+		retrieveSpooledOutput(s)
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+// tspooler is a tscheduler that spools jobs to a remote schedd.
+type tspooler struct {
+	*tscheduler
+	transferred []string
+	transferErr map[string]error // keyed by constraint
+}
+
+func newtspooler() *tspooler {
+	return &tspooler{tscheduler: newtscheduler(), transferErr: make(map[string]error)}
+}
+
+func (s *tspooler) Spooling() bool {
+	return true
+}
+
+func (s *tspooler) TransferData(constraint string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.transferErr[constraint]; err != nil {
+		return nil, err
+	}
+	s.transferred = append(s.transferred, constraint)
+	return nil, nil
+}
+
+func TestRetrieveSpooledOutput(t *testing.T) {
+	s := newtspooler()
+	s.queue = []JobAd{
+		{"IpcUuid": "07b04ce2-7757-4b21-9e15-0b4c2f44be26", "ClusterId": "10000", "JobStatus": jobStatusCompleted},
+		{"IpcUuid": "3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2", "ClusterId": "10001", "JobStatus": jobStatusCompleted},
+	}
+	failed := ipcUUIDConstraint("3f1c9b39-0b5e-4d1b-8f43-64a1c2d6f0a2")
+	s.transferErr[failed] = errors.New("the schedd is down")
+
+	retrieveSpooledOutput(s)
+
+	succeeded := ipcUUIDConstraint("07b04ce2-7757-4b21-9e15-0b4c2f44be26")
+	if len(s.transferred) != 1 || s.transferred[0] != succeeded {
+		t.Errorf("the output of %v was retrieved instead of %s", s.transferred, succeeded)
+	}
+	if len(s.removed) != 1 || s.removed[0] != succeeded {
+		t.Errorf("%v was removed instead of %s, which shouldn't happen before the output is retrieved", s.removed, succeeded)
+	}
+}
+
+func TestLaunchSpooledRemovesIRODSConfig(t *testing.T) {
+	cfg := test.InitConfig(t)
+	cl := New(cfg, nil, newtsys(), newtspooler())
+	j := test.InitTests(t, cfg)
+	defer os.RemoveAll(path.Join(j.CondorLogPath, j.Submitter))
+
+	if _, err := cl.launch(j); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(jobLogsDirectory(j), irodsConfigName)); !os.IsNotExist(err) {
+		t.Errorf("the irods-config file was kept after it was spooled: %v", err)
+	}
+}
+
+// newRecordingScheduler returns an *HTCondorScheduler whose commands write
+// their arguments to files named after them in a new temporary directory,
+// which the caller should remove.
+func newRecordingScheduler(t *testing.T) (*HTCondorScheduler, string) {
+	dir, err := ioutil.TempDir("", "condor-launcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := func(name, output string) string {
+		fname := path.Join(dir, name)
+		body := "#!/bin/sh\necho \"$@\" > " + shellQuote(fname+".args") + "\necho '" + output + "'\n"
+		if err := ioutil.WriteFile(fname, []byte(body), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	s := NewHTCondorScheduler(
+		script("condor_submit", "1 job(s) submitted to cluster 42."),
+		script("condor_rm", ""),
+		script("condor_q", ""),
+		script("condor_history", ""),
+		script("condor_release", ""),
+		"",
+		"",
+	)
+	s.SpoolTo(script("condor_transfer_data", ""), "schedd.example.org", "cm.example.org")
+	return s, dir
+}
+
+// recordedArgs returns the arguments a command written by
+// newRecordingScheduler was last run with.
+func recordedArgs(t *testing.T, dir, name string) string {
+	data, err := ioutil.ReadFile(path.Join(dir, name+".args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestHTCondorSchedulerSpooling(t *testing.T) {
+	s, dir := newRecordingScheduler(t)
+	defer os.RemoveAll(dir)
+
+	id, err := s.Submit(path.Join(dir, "iplant.cmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "42" {
+		t.Errorf("Submit returned %s instead of 42", id)
+	}
+	if _, err = s.QueryByConstraint("true", "IpcUuid"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Remove("true"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.TransferData("true"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.History("true", 1, "IpcUuid"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"condor_submit":        "-remote schedd.example.org -pool cm.example.org -spool iplant.cmd",
+		"condor_q":             "-name schedd.example.org -pool cm.example.org -constraint true -af:t IpcUuid",
+		"condor_rm":            "-name schedd.example.org -pool cm.example.org -constraint true",
+		"condor_transfer_data": "-name schedd.example.org -pool cm.example.org -constraint true",
+		"condor_history":       "-name schedd.example.org -pool cm.example.org -match 1 -constraint true -af:t IpcUuid",
+	}
+	for name, args := range expected {
+		if actual := recordedArgs(t, dir, name); actual != args {
+			t.Errorf("%s was run with '%s' instead of '%s'", name, actual, args)
+		}
+	}
+}
+
+func TestHTCondorSchedulerNotSpooling(t *testing.T) {
+	s := newTestScheduler(t)
+	if s.Spooling() {
+		t.Error("a scheduler without a remote schedd is spooling")
+	}
+	if _, err := s.TransferData("true"); err == nil {
+		t.Error("TransferData succeeded without a remote schedd")
+	}
+}
@@ -1,100 +1,51 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"os/exec"
-	"path"
-	"path/filepath"
-	"strings"
+	"regexp"
 
 	"github.com/pkg/errors"
-)
 
-// ExecCondorQHeldIDs runs the
-// `condor_q -constraint 'JobStatus =?= 5' -format "%s\n" IpcUuid`
-// command and returns its output.
-func ExecCondorQHeldIDs(condorPath, condorConfig string) ([]byte, error) {
-	var (
-		output []byte
-		err    error
-	)
-	csPath, err := exec.LookPath("condor_q")
-	if err != nil {
-		return output, errors.Wrap(err, "failed to find condor_q on the $PATH")
-	}
-	if !path.IsAbs(csPath) {
-		csPath, err = filepath.Abs(csPath)
-		if err != nil {
-			return output, errors.Wrapf(err, "failed to get the absolute path of %s", csPath)
-		}
-	}
+	"github.com/cyverse-de/condor-launcher/classad"
+)
 
-	cmdArgs := []string{
-		"-constraint",
-		"JobStatus =?= 5",
-		"-format",
-		"%s\\n",
-		"IpcUuid"}
+// heldJobsConstraint matches the jobs that are in the held state.
+var heldJobsConstraint = classad.Is(classad.Attr("JobStatus"), classad.Int(5)).String()
 
-	cmd := exec.Command(csPath, cmdArgs...)
-	cmd.Env = []string{
-		fmt.Sprintf("PATH=%s", condorPath),
-		fmt.Sprintf("CONDOR_CONFIG=%s", condorConfig),
-	}
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return output, errors.Wrapf(err,
-			"failed to get the output of the command '%s %s'",
-			csPath,
-			strings.Join(cmdArgs, " "))
-	}
-	return output, nil
+// ipcUUIDConstraint returns a constraint that matches the jobs submitted for
+// the given invocationID.
+func ipcUUIDConstraint(invocationID string) string {
+	return classad.Is(classad.Attr("IpcUuid"), classad.String(invocationID)).String()
 }
 
-// ExecCondorRm runs condor_rm with an IpcUuid constraint for the given invocationID.
-// Returns the output of the command and possibly an error.
-func ExecCondorRm(invocationID, condorPath, condorConfig string) ([]byte, error) {
-	var (
-		output []byte
-		err    error
-	)
-	crPath, err := exec.LookPath("condor_rm")
-	log.Infof("condor_rm found at %s", crPath)
-	if err != nil {
-		return output, errors.Wrap(err, "failed to find condor_rm on the $PATH")
-	}
-	if !path.IsAbs(crPath) {
-		crPath, err = filepath.Abs(crPath)
-		if err != nil {
-			return output, errors.Wrapf(err, "failed to get the absolute path of %s", crPath)
-		}
-	}
+// invocationIDRegexp matches the canonical form of a UUID.
+var invocationIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
 
-	// condor_rm -constraint 'IpcUuid =?= "<uuid>"'
-	constraintIpcUUID := fmt.Sprintf(`IpcUuid =?= "%s"`, invocationID)
-	cmd := exec.Command(crPath, "-constraint", constraintIpcUUID)
-	cmd.Env = []string{
-		fmt.Sprintf("PATH=%s", condorPath),
-		fmt.Sprintf("CONDOR_CONFIG=%s", condorConfig),
+// validateInvocationID returns an error if an invocation ID isn't a UUID.
+func validateInvocationID(invocationID string) error {
+	if !invocationIDRegexp.MatchString(invocationID) {
+		return fmt.Errorf("invalid invocation ID %q", invocationID)
 	}
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return output, errors.Wrapf(err, "failed to get the output of '%s %s %s'", crPath, "-constraint", constraintIpcUUID)
-	}
-	return output, nil
+	return nil
 }
 
-func heldQueueInvocationIDs(condorQFormattedOutput []byte) []string {
-	var retval []string
+// heldJobAds returns the ads of the jobs in the held state that were
+// submitted by the launcher, with the attributes needed to apply a
+// HeldJobPolicy.
+func heldJobAds(scheduler Scheduler) ([]JobAd, error) {
+	ads, err := scheduler.QueryByConstraint(heldJobsConstraint, heldJobAttrs...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the held jobs")
+	}
 
-	lines := bytes.Split(condorQFormattedOutput, []byte("\n"))
-	for _, line := range lines {
-		invocationID := bytes.TrimSpace(line)
-		if len(invocationID) > 0 {
-			retval = append(retval, string(invocationID))
+	var retval []JobAd
+	for _, ad := range ads {
+		if err = validateInvocationID(ad["IpcUuid"]); err != nil {
+			log.Warnf("skipping the held job with Condor ID %s: %s", ad["ClusterId"], err)
+			continue
 		}
+		retval = append(retval, ad)
 	}
 
-	return retval
+	return retval, nil
 }
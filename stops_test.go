@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"io"
 	"os"
-	"reflect"
 	"strings"
 	"testing"
 
@@ -22,64 +21,8 @@ func shouldrun() bool {
 	return false
 }
 
-var (
-	listing = []byte(`
-63c5523d-d8a5-49bc-addc-99a73566cd89
-b788569f-6948-4586-b5bd-5ea096986331
-eca67a7c-e745-4e98-b892-67a9948bc2cb
-
-571722aa-f46c-40fd-a688-69068fb52ee1
-105fba2c-c9a5-4a89-8033-9d3b3e5c419f
-51d4cb60-e925-4229-a257-8d5b6feeedb8
-22c13517-4a2d-4874-92b3-5b5d03299d60
-316bc5ba-aaee-4922-a8c7-ea9479a65650
-1e0cc85e-6053-452c-b1a9-cedc0f12cf7b
-7ffa2752-e7bf-4eae-8ed5-b366aef7978e
-d9eaa702-14d5-439e-b01f-4ca3a39096ec
-57ff5e6b-5a4f-496b-9f66-eeadfbd03e86
-0af6c62a-3570-46de-9f27-9b6c430bd912
-0d607f70-ad65-4a8c-bfe3-1b0efb7a20e9
-10af43af-6f63-4305-8bad-e70ae208ec4c
-1fa4bea3-8f3e-472e-9981-3b1a5b0d425e
-30282173-70e5-4055-8621-a3a149db1829
-9b21c5c6-19b3-45cc-9e87-720d57032e71
-6a54a3bc-1a42-453d-9fa9-81300804f26f
-827624c9-1e1b-4783-ab7a-23e78c599cc3
-c6193b50-cdaa-48c8-aa69-3957431b05a2
-d0952a64-8d7c-4d2b-9046-6c91425e0671
-
-4457ec2d-5203-4ab6-95e5-2831d998dd1f
-6e7d9735-1fc7-4626-b5d3-91993eae7a1b
-3c967e99-51ff-484d-a000-3ce3adf744ce
-8d64bc74-750a-4cd3-bbf3-2d9a4e56fcf0
-77ac1023-c6d1-403c-8088-04205a270c7a
-dc9f2455-da10-42c6-bc58-b7a963b46338
-74a17e36-ac52-4dde-9abb-e5a8dca0b2c6
-7446aa7b-16db-4b4f-ad8d-8d802b402aaa
-ee6cdfe9-bd90-460a-bb5f-b10b3e299b10
-a45770ad-cc7d-4fc8-8b1a-ffb75bd44e0e
-dd632e6c-50e7-4b81-bb07-9d2abe0a9b15
-f532df1e-591e-47f1-84e6-fdf670727040
-12febe03-ae83-48f2-b828-c2865fecf09e
-e802a7b5-13f2-462d-ac85-f9836a4fd575
-18f6b09f-63bd-4825-a34e-4767dee4f358
-4a039e5a-0335-45ee-880b-5495c92bfc9a
-6123e600-ec4f-4d29-b2c4-edd0af089b04
-ba30efdd-4207-4120-91dd-de5caed467ae
-9d20a879-6d33-43b4-b430-0c1cfaf5a7c4
-8f4002c0-d650-4252-943d-56287b6c6efe
-3c5c986e-1b69-4ff2-a470-0f677148240e
-f0ffb7ee-b7c6-4a07-814b-88d76b3cc3b8
-65ecca14-759e-41ee-b764-069ac0155df5
-36770cc9-d80b-405c-b9be-c5977ae3e83b
-4a4926a6-2a18-4b37-a361-581658a0f067
-15384749-bc5f-43ff-854e-b6495e0c6ee4
-2e8c0c9c-133a-4436-b1a4-3bb303ce7cd3`)
-)
-
-func isInvocationIDHeld(condorQListing []byte, invocationID string) bool {
-	actual := heldQueueInvocationIDs(condorQListing)
-	for _, uuid := range actual {
+func containsInvocationID(invocationIDs []string, invocationID string) bool {
+	for _, uuid := range invocationIDs {
 		if uuid == invocationID {
 			return true
 		}
@@ -88,61 +31,99 @@ func isInvocationIDHeld(condorQListing []byte, invocationID string) bool {
 	return false
 }
 
-func TestCondorID(t *testing.T) {
+func TestHeldJobAds(t *testing.T) {
+	ads, err := heldJobAds(newTestScheduler(t))
+	if err != nil {
+		t.Error(err)
+	}
+	var output []string
+	for _, ad := range ads {
+		output = append(output, ad["IpcUuid"])
+	}
+
 	invID := "63c5523d-d8a5-49bc-addc-99a73566cd89"
-	found := isInvocationIDHeld(listing, invID)
+	found := containsInvocationID(output, invID)
 	if !found {
 		t.Errorf("The expected InvocationID of %s was not in the Held state", invID)
 	}
 
 	invID = "b788569f-6948-4586-b5bd-5ea096986331"
-	found = isInvocationIDHeld(listing, invID)
+	found = containsInvocationID(output, invID)
 	if !found {
 		t.Errorf("The expected InvocationID of %s was not in the Held state", invID)
 	}
 
 	invID = "eca67a7c-e745-4e98-b892-67a9948bc2cb"
-	found = isInvocationIDHeld(listing, invID)
+	found = containsInvocationID(output, invID)
 	if !found {
 		t.Errorf("The expected InvocationID of %s was not in the Held state", invID)
 	}
 }
 
-func TestExecCondorQ(t *testing.T) {
-	test.InitPath(t)
-	output, err := ExecCondorQHeldIDs("", "")
-	if err != nil {
-		t.Error(err)
+func TestIPCUUIDConstraint(t *testing.T) {
+	actual := ipcUUIDConstraint("foo")
+	expected := `IpcUuid =?= "foo"`
+	if actual != expected {
+		t.Errorf("ipcUUIDConstraint returned '%s' instead of '%s'", actual, expected)
 	}
+}
 
-	invID := "63c5523d-d8a5-49bc-addc-99a73566cd89"
-	found := isInvocationIDHeld(output, invID)
-	if !found {
-		t.Errorf("The expected InvocationID of %s was not in the Held state", invID)
+func TestIPCUUIDConstraintEscaping(t *testing.T) {
+	actual := ipcUUIDConstraint(`x" || IpcUuid =!= "`)
+	expected := `IpcUuid =?= "x\" || IpcUuid =!= \""`
+	if actual != expected {
+		t.Errorf("ipcUUIDConstraint returned '%s' instead of '%s'", actual, expected)
 	}
+}
 
-	invID = "b788569f-6948-4586-b5bd-5ea096986331"
-	found = isInvocationIDHeld(output, invID)
-	if !found {
-		t.Errorf("The expected InvocationID of %s was not in the Held state", invID)
+func TestValidateInvocationID(t *testing.T) {
+	valid := []string{
+		"571722aa-f46c-40fd-a688-69068fb52ee1",
+		"571722AA-F46C-40FD-A688-69068FB52EE1",
+	}
+	for _, id := range valid {
+		if err := validateInvocationID(id); err != nil {
+			t.Errorf("validateInvocationID rejected %q: %s", id, err)
+		}
 	}
 
-	invID = "eca67a7c-e745-4e98-b892-67a9948bc2cb"
-	found = isInvocationIDHeld(output, invID)
-	if !found {
-		t.Errorf("The expected InvocationID of %s was not in the Held state", invID)
+	invalid := []string{
+		"",
+		"foo",
+		"571722aa-f46c-40fd-a688-69068fb52ee",
+		"571722aa-f46c-40fd-a688-69068fb52ee1 ",
+		`571722aa-f46c-40fd-a688-69068fb52ee1" || true || "`,
+		"571722aa-f46c-40fd-a688-69068fb52ee1\n",
+		"571722aaxf46c-40fd-a688-69068fb52ee1",
+	}
+	for _, id := range invalid {
+		if err := validateInvocationID(id); err == nil {
+			t.Errorf("validateInvocationID accepted %q", id)
+		}
 	}
 }
 
-func TestExecCondorRm(t *testing.T) {
-	test.InitPath(t)
-	actual, err := ExecCondorRm("foo", "", "")
+func TestStopHandlerInvalidInvocationID(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+
+	body, err := json.Marshal(messaging.StopRequest{InvocationID: `x" || IpcUuid =!= "`})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	ack := &tacknowledger{}
+	cl.stopHandler()(amqp.Delivery{Acknowledger: ack, Body: body})
+
+	if !ack.rejected || ack.requeued {
+		t.Errorf("the stop request wasn't rejected without requeueing: %#v", ack)
+	}
+	if len(scheduler.removed) != 0 {
+		t.Errorf("jobs were removed for an invalid invocation ID: %v", scheduler.removed)
 	}
-	expected := []byte("IpcUuid =?= \"foo\" was stopped\n")
-	if !reflect.DeepEqual(actual, expected) {
-		t.Errorf("ExecCondorRm returned '%s' instead of '%s'", actual, expected)
+	if len(client.updates) != 0 {
+		t.Errorf("updates were published for an invalid invocation ID: %#v", client.updates)
 	}
 }
 
@@ -158,7 +139,7 @@ func TestStopHandler(t *testing.T) {
 	cfg := test.InitConfig(t)
 	test.InitPath(t)
 	filesystem := newtsys()
-	cl := New(cfg, nil, filesystem, "condor_submit", "condor_rm")
+	cl := New(cfg, nil, filesystem, newTestScheduler(t))
 	stopMsg := messaging.StopRequest{
 		InvocationID: "b788569f-6948-4586-b5bd-5ea096986331",
 	}
@@ -183,7 +164,7 @@ func TestStopHandler(t *testing.T) {
 		io.Copy(&buf, r)
 		coord <- buf.String()
 	}()
-	cl.stopHandler("", "")(msg)
+	cl.stopHandler()(msg)
 	w.Close()
 	actual := <-coord
 	if !strings.Contains(actual, "Running condor_q...") {
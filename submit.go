@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/classad"
+)
+
+// JobFieldError describes a job field that is invalid or can't be placed in a
+// submit description.
+type JobFieldError struct {
+	Field   string // the name of the field in the job JSON
+	Problem string
+}
+
+func (e *JobFieldError) Error() string {
+	return fmt.Sprintf("the %s field %s", e.Field, e.Problem)
+}
+
+// JobFieldErrors lists every problem found with the fields of a job.
+type JobFieldErrors []*JobFieldError
+
+func (e JobFieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "the job can't be submitted: " + strings.Join(msgs, "; ")
+}
+
+// containsControl returns true if s contains a control character, including
+// the Unicode line and paragraph separators.
+func containsControl(s string) bool {
+	for _, r := range s {
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeMacros keeps condor_submit from expanding $(...) macro references in
+// a value.
+func escapeMacros(s string) string {
+	return strings.Replace(s, "$", "$(DOLLAR)", -1)
+}
+
+// checkExpression returns a description of the problem if s isn't a plausible
+// ClassAd expression that can be wrapped in parentheses without changing the
+// meaning of the surrounding expression.
+func checkExpression(s string) string {
+	depth := 0
+	inString := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return "has unbalanced parentheses"
+			}
+		}
+	}
+	if inString {
+		return "has an unterminated string"
+	}
+	if depth != 0 {
+		return "has unbalanced parentheses"
+	}
+	return ""
+}
+
+// escapeString escapes a value for the inside of a string literal in a
+// submit description, where the job submission builder's templates already
+// supply the quotes.
+func escapeString(s string) string {
+	q := classad.Quote(s)
+	return escapeMacros(q[1 : len(q)-1])
+}
+
+// escapeSubmitFields returns a copy of a job with the fields that the job
+// submission builder places in the submit description escaped for where
+// they're placed, so that the builder's templates can be used as they are. The
+// username is also written to other files, so it's checked during validation
+// instead of being escaped. The job must not contain control characters.
+func escapeSubmitFields(s *model.Job) *model.Job {
+	escaped := *s
+	escaped.Group = escapeMacros(s.Group)
+	escaped.UserID = escapeMacros(s.UserID)
+	escaped.UserGroups = make([]string, len(s.UserGroups))
+	for i, group := range s.UserGroups {
+		escaped.UserGroups[i] = escapeMacros(group)
+	}
+	escaped.Extra.HTCondor.ExtraRequirements = escapeMacros(s.Extra.HTCondor.ExtraRequirements)
+	if len(s.Steps) > 0 {
+		escaped.Steps = append([]model.Step(nil), s.Steps...)
+		component := &escaped.Steps[0].Component
+		component.Name = escapeString(component.Name)
+		component.Location = escapeString(component.Location)
+		component.Container.Image.OSGImagePath = escapeString(component.Container.Image.OSGImagePath)
+	}
+	return &escaped
+}
+
+// writeJobFile copies the names of the files the job submission builder wrote
+// from the escaped copy of a job back to the job, then replaces the job file
+// the builder wrote from the escaped copy so that the job runs with the
+// fields it was submitted with.
+func writeJobFile(s, escaped *model.Job, dir string) error {
+	s.OutputTicketFile = escaped.OutputTicketFile
+	s.InputTicketsFile = escaped.InputTicketsFile
+	s.InputPathListFile = escaped.InputPathListFile
+	s.ConfigFile = escaped.ConfigFile
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(s); err != nil {
+		return errors.Wrap(err, "failed to marshal the job")
+	}
+	fname := filepath.Join(dir, "job")
+	return errors.Wrapf(ioutil.WriteFile(fname, buf.Bytes(), 0644), "failed to write %s", fname)
+}
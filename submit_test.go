@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	jobs "gopkg.in/cyverse-de/job-templates.v6"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func loadTestJob(t *testing.T, fname string) *model.Job {
+	cfg := test.InitConfig(t)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := model.NewFromData(cfg, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// buildTestJob runs the job submission builder for a job in a new directory
+// and returns the directory along with the submit description. The caller
+// should remove the directory.
+func buildTestJob(t *testing.T, j *model.Job) (string, []byte) {
+	dir, err := ioutil.TempDir("", "submit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, err := jobs.NewJobSubmissionBuilder(j.ExecutionTarget, test.InitConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	submissionPath, err := builder.Build(j, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(submissionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, contents
+}
+
+// For jobs without anything that needs escaping, the escaped copy should
+// produce the same submit description as the job.
+func TestEscapeSubmitFieldsUnchanged(t *testing.T) {
+	for _, target := range []string{"condor", "interapps"} {
+		j := loadTestJob(t, "test/test_submission.json")
+		j.ExecutionTarget = target
+		j.Extra.HTCondor.ExtraRequirements = `(Machine =!= "bad.example.org")`
+
+		dir, expected := buildTestJob(t, j)
+		defer os.RemoveAll(dir)
+		dir, actual := buildTestJob(t, escapeSubmitFields(j))
+		defer os.RemoveAll(dir)
+		if string(actual) != string(expected) {
+			t.Errorf("the %s submit description was:\n%s\ninstead of:\n%s", target, actual, expected)
+		}
+	}
+}
+
+func TestEscapeSubmitFields(t *testing.T) {
+	j := loadTestJob(t, "test/test_submission.json")
+	j.Steps[0].Component.Name = `wc" && +Evil = "yes`
+	j.Steps[0].Component.Location = "$(ENV(HOME))"
+	j.UserGroups = []string{"groups:$(HOME)"}
+
+	escaped := escapeSubmitFields(j)
+	dir, actual := buildTestJob(t, escaped)
+	defer os.RemoveAll(dir)
+	for _, expected := range []string{
+		`+IpcExe = "wc\" && +Evil = \"yes"` + "\n",
+		`+IpcExePath = "$(DOLLAR)(ENV(HOME))"` + "\n",
+		`+IpcUserGroups = {"groups:$(DOLLAR)(HOME)"}` + "\n",
+	} {
+		if !strings.Contains(string(actual), expected) {
+			t.Errorf("the submit description doesn't contain %q:\n%s", expected, actual)
+		}
+	}
+	if j.Steps[0].Component.Location != "$(ENV(HOME))" || j.UserGroups[0] != "groups:$(HOME)" {
+		t.Errorf("escaping the submit fields changed the job: %#v", j)
+	}
+
+	// The job file holds the fields the job was submitted with.
+	if err := writeJobFile(j, escaped, dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "job"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written model.Job
+	if err = json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Steps[0].Component.Name != j.Steps[0].Component.Name {
+		t.Errorf("the job file contains the name %q", written.Steps[0].Component.Name)
+	}
+	if written.InputPathListFile == "" || written.InputPathListFile != escaped.InputPathListFile {
+		t.Errorf("the job file contains the input path list file %q", written.InputPathListFile)
+	}
+}
+
+func TestCheckSubmitFieldsRejectsControlCharacters(t *testing.T) {
+	j := loadTestJob(t, "test/test_submission.json")
+	j.Submitter = "someone\nexecutable = /bin/evil"
+	j.Steps[0].Component.Location = "/usr/bin\r"
+	j.Extra.HTCondor.ExtraRequirements = "true\u2028"
+	j.UserGroups = append(j.UserGroups, "groups:\x00")
+
+	err := checkSubmitFields(j)
+	errs, ok := err.(JobFieldErrors)
+	if !ok {
+		t.Fatalf("checkSubmitFields returned %#v instead of JobFieldErrors", err)
+	}
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	for _, field := range []string{"username", "steps[0].component.location", "extra.htcondor.extra_requirements", "user_groups[3]"} {
+		if !fields[field] {
+			t.Errorf("the %s field wasn't reported: %s", field, err)
+		}
+	}
+}
+
+func TestCheckSubmitFieldsExtraRequirements(t *testing.T) {
+	cases := map[string]bool{
+		`Machine =!= "a"`:               true,
+		`(Memory > 1024) && (Cpus > 1)`: true,
+		`Name =?= "has ) paren"`:        true,
+		`true) || (true`:                false,
+		`(true`:                         false,
+		`Name =?= "unterminated`:        false,
+	}
+	for reqs, ok := range cases {
+		j := loadTestJob(t, "test/test_submission.json")
+		j.Extra.HTCondor.ExtraRequirements = reqs
+		err := checkSubmitFields(j)
+		if ok && err != nil {
+			t.Errorf("the requirements %q were rejected: %s", reqs, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("the requirements %q were accepted", reqs)
+		}
+	}
+}
+
+func TestHandleLaunchRequestsInvalidSubmitField(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+
+	j := test.InitTests(t, cfg)
+	defer os.RemoveAll(path.Join(j.CondorLogPath, j.Submitter))
+	j.Steps[0].Component.Name = "wc\nexecutable = /bin/evil"
+
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("the job was submitted: %v", scheduler.submitted)
+	}
+	// The job fails validation, so none of its files are written.
+	if !ack.acked {
+		t.Error("the launch request was not acknowledged")
+	}
+	if _, err := os.Stat(jobLogsDirectory(j)); !os.IsNotExist(err) {
+		t.Errorf("the submission directory was created for the invalid job: %v", err)
+	}
+	if len(client.updates) != 1 {
+		t.Fatalf("%d updates were published instead of 1", len(client.updates))
+	}
+	u := client.updates[0]
+	if u.State != messaging.FailedState || !strings.Contains(u.Message, "steps[0].component.name") {
+		t.Errorf("unexpected update for the invalid job: %s %q", u.State, u.Message)
+	}
+}
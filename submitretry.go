@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// The kinds of condor_submit failures.
+const (
+	submitErrorTransient = "transient"
+	submitErrorPermanent = "permanent"
+	submitErrorUnknown   = "unknown"
+)
+
+// transientSubmitErrors are found in the output of condor_submit when it
+// couldn't reach or authenticate with the schedd. Submitting the job again
+// later may work.
+var transientSubmitErrors = []string{
+	"failed to connect",
+	"connection refused",
+	"connection reset",
+	"timed out",
+	"can't find address",
+	"unable to contact",
+	"temporarily unavailable",
+	"failed to authenticate",
+	"authentication failed",
+	"authenticate:",
+	"secman:",
+	"failed to commit",
+}
+
+// permanentSubmitErrors are found in the output of condor_submit when the
+// submit description was rejected. Submitting it again won't help.
+var permanentSubmitErrors = []string{
+	"parse error",
+	"syntax error",
+	"error: on line",
+	"error in submit file",
+	"invalid",
+	"is not a valid",
+	"does not exist",
+	"no such file or directory",
+	"unknown command",
+}
+
+// classifySubmitOutput returns the kind of failure described by the output
+// of condor_submit. Connection problems are checked for first because their
+// messages can mention things like invalid credentials.
+func classifySubmitOutput(output []byte) string {
+	lower := strings.ToLower(string(output))
+	for _, s := range transientSubmitErrors {
+		if strings.Contains(lower, s) {
+			return submitErrorTransient
+		}
+	}
+	for _, s := range permanentSubmitErrors {
+		if strings.Contains(lower, s) {
+			return submitErrorPermanent
+		}
+	}
+	return submitErrorUnknown
+}
+
+// SubmitError is returned when condor_submit fails. It contains the output of
+// the command and what kind of failure it was.
+type SubmitError struct {
+	Kind   string
+	Output string
+	Err    error
+}
+
+// newSubmitError returns a *SubmitError for a condor_submit command that
+// failed with err. Timeouts are transient, since the schedd may only have
+// been busy. Other failures to run the command aren't classified.
+func newSubmitError(cmdPath string, output []byte, err error) *SubmitError {
+	kind := submitErrorUnknown
+	switch err.(type) {
+	case *exec.ExitError, *ssh.ExitError:
+		kind = classifySubmitOutput(output)
+	case *TimeoutError:
+		kind = submitErrorTransient
+	}
+	return &SubmitError{
+		Kind:   kind,
+		Output: string(output),
+		Err:    errors.Wrapf(err, "failed to execute %s", cmdPath),
+	}
+}
+
+func (e *SubmitError) Error() string {
+	output := strings.TrimSpace(e.Output)
+	if output == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s:\n%s", e.Err, output)
+}
+
+// Transient returns true if submitting the job again may work.
+func (e *SubmitError) Transient() bool {
+	return e.Kind == submitErrorTransient
+}
+
+// Permanent returns true if the job will never be accepted as it is.
+func (e *SubmitError) Permanent() bool {
+	return e.Kind == submitErrorPermanent
+}
+
+// isPermanentSubmitError returns true if err was caused by condor_submit
+// rejecting the submit description.
+func isPermanentSubmitError(err error) bool {
+	submitErr, ok := errors.Cause(err).(*SubmitError)
+	return ok && submitErr.Permanent()
+}
+
+// submitBackoff returns how long to wait before the given retry of a
+// submission, counting from 1. The delay doubles with each retry, up to
+// condor.submit_retry.max_delay.
+func submitBackoff(cfg *viper.Viper, retry int) time.Duration {
+	initial, err := time.ParseDuration(cfg.GetString("condor.submit_retry.initial_delay"))
+	if err != nil {
+		return 0
+	}
+	max, err := time.ParseDuration(cfg.GetString("condor.submit_retry.max_delay"))
+	if err != nil {
+		return 0
+	}
+	d := initial
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// submit submits a job, retrying transient failures with an exponential
+// backoff up to condor.submit_retry.max_retries times, or until the launcher
+// starts shutting down. Before each retry the queue is checked in case the
+// failed attempt submitted the job anyway.
+func (cl *CondorLauncher) submit(s *model.Job, submissionPath string) (string, error) {
+	id, err := cl.scheduler.Submit(submissionPath)
+	for retry := 1; err != nil; retry++ {
+		submitErr, ok := errors.Cause(err).(*SubmitError)
+		if !ok {
+			return "", err
+		}
+		submitFailures.WithLabelValues(submitErr.Kind).Inc()
+
+		cfg := cl.config()
+		if !submitErr.Transient() || retry > cfg.GetInt("condor.submit_retry.max_retries") {
+			return "", err
+		}
+		delay := submitBackoff(cfg, retry)
+		log.Warnf("retrying the submission of job %s in %s after a transient failure: %s", s.InvocationID, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-cl.stopping:
+			// The launch request is requeued for another launcher.
+			log.Warnf("giving up on the submission of job %s because the launcher is shutting down", s.InvocationID)
+			return "", err
+		}
+
+		existingID, existingErr := cl.existingClusterID(s.InvocationID)
+		if existingErr != nil {
+			return "", existingErr
+		}
+		if existingID != "" {
+			log.Infof("job %s was submitted as Condor ID %s despite the failure", s.InvocationID, existingID)
+			return existingID, nil
+		}
+		id, err = cl.scheduler.Submit(submissionPath)
+	}
+	return id, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/messaging.v6"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+func TestClassifySubmitOutput(t *testing.T) {
+	tests := map[string]string{
+		"ERROR: Failed to connect to local queue manager\nCEDAR:6001:Failed to connect to <127.0.0.1:9618>\n":      submitErrorTransient,
+		"ERROR: Failed to connect to queue manager submit.example.org\nAUTHENTICATE:1003:Failed to authenticate\n": submitErrorTransient,
+		"SECMAN:2007:Failed to end classad message.\n":                                                             submitErrorTransient,
+		"ERROR: Parse error in expression: \n\tRequirements = (OpSys == \n":                                        submitErrorPermanent,
+		"ERROR: on Line 12 of submit file: \nERROR: Invalid Requirements expression\n":                             submitErrorPermanent,
+		"ERROR: Executable file /usr/local/bin/road-runner does not exist\n":                                       submitErrorPermanent,
+		"something went wrong\n": submitErrorUnknown,
+	}
+	for output, expected := range tests {
+		if actual := classifySubmitOutput([]byte(output)); actual != expected {
+			t.Errorf("%q was classified as %s instead of %s", output, actual, expected)
+		}
+	}
+}
+
+func TestSubmitBackoff(t *testing.T) {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("condor.submit_retry.initial_delay", "1s")
+	cfg.Set("condor.submit_retry.max_delay", "5s")
+	for retry, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if actual := submitBackoff(cfg, retry); actual != expected {
+			t.Errorf("retry %d was delayed by %s instead of %s", retry, actual, expected)
+		}
+	}
+}
+
+func TestHTCondorSchedulerSubmitError(t *testing.T) {
+	script, dir := writeTestScript(t, "condor_submit", "echo 'ERROR: on Line 3 of submit file:'\necho 'ERROR: Parse error in expression'\nexit 1")
+	defer os.RemoveAll(dir)
+
+	s := newTestScheduler(t)
+	s.condorSubmit = script
+	_, err := s.Submit(path.Join(dir, "iplant.cmd"))
+	submitErr, ok := err.(*SubmitError)
+	if !ok {
+		t.Fatalf("Submit returned %#v instead of a *SubmitError", err)
+	}
+	if !submitErr.Permanent() {
+		t.Errorf("the failure was classified as %s instead of permanent", submitErr.Kind)
+	}
+	if !strings.Contains(err.Error(), "Parse error in expression") {
+		t.Errorf("the error doesn't contain the output of condor_submit: %s", err)
+	}
+}
+
+// newSubmitRetryTest returns a launcher whose submissions are retried without
+// delay, along with its test scheduler and messenger.
+func newSubmitRetryTest(t *testing.T) (*CondorLauncher, *tscheduler, *tmessenger) {
+	cfg := test.InitConfig(t)
+	SetDefaults(cfg)
+	cfg.Set("condor.submit_retry.initial_delay", "1ms")
+	cfg.Set("condor.submit_retry.max_delay", "1ms")
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	return New(cfg, client, newtsys(), scheduler), scheduler, client
+}
+
+func TestHandleLaunchRequestsRetriesTransientSubmitErrors(t *testing.T) {
+	cl, scheduler, client := newSubmitRetryTest(t)
+	scheduler.submitErrs = []error{
+		&SubmitError{Kind: submitErrorTransient, Err: errors.New("failed to execute condor_submit")},
+		&SubmitError{Kind: submitErrorTransient, Err: errors.New("failed to execute condor_submit")},
+	}
+
+	j := test.InitTests(t, cl.config())
+	defer os.RemoveAll(path.Join(j.CondorLogPath, j.Submitter))
+
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if len(scheduler.submitted) != 3 {
+		t.Errorf("the job was submitted %d times instead of 3", len(scheduler.submitted))
+	}
+	if !ack.acked {
+		t.Error("the launch request was not acknowledged")
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.SubmittedState {
+		t.Errorf("a single Submitted update was not published: %#v", client.updates)
+	}
+}
+
+func TestHandleLaunchRequestsGivesUpOnTransientSubmitErrors(t *testing.T) {
+	cl, scheduler, client := newSubmitRetryTest(t)
+	cl.config().Set("condor.submit_retry.max_retries", 1)
+	for i := 0; i < 3; i++ {
+		scheduler.submitErrs = append(scheduler.submitErrs, &SubmitError{Kind: submitErrorTransient, Err: errors.New("failed to execute condor_submit")})
+	}
+
+	j := test.InitTests(t, cl.config())
+	defer os.RemoveAll(path.Join(j.CondorLogPath, j.Submitter))
+
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if len(scheduler.submitted) != 2 {
+		t.Errorf("the job was submitted %d times instead of 2", len(scheduler.submitted))
+	}
+	if !ack.rejected || !ack.requeued {
+		t.Error("the launch request was not requeued after the retries ran out")
+	}
+	if len(client.updates) != 0 {
+		t.Errorf("job updates were published: %#v", client.updates)
+	}
+}
+
+func TestHandleLaunchRequestsFailsPermanentSubmitErrors(t *testing.T) {
+	cl, scheduler, client := newSubmitRetryTest(t)
+	scheduler.submitErrs = []error{&SubmitError{
+		Kind:   submitErrorPermanent,
+		Output: "ERROR: Parse error in expression",
+		Err:    errors.New("failed to execute condor_submit"),
+	}}
+
+	j := test.InitTests(t, cl.config())
+	defer os.RemoveAll(path.Join(j.CondorLogPath, j.Submitter))
+
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if len(scheduler.submitted) != 1 {
+		t.Errorf("the job was submitted %d times instead of once", len(scheduler.submitted))
+	}
+	if ack.requeued {
+		t.Error("the launch request was requeued")
+	}
+	if len(client.updates) != 1 || client.updates[0].State != messaging.FailedState ||
+		!strings.Contains(client.updates[0].Message, "Parse error in expression") {
+		t.Errorf("a Failed update with the condor_submit output was not published: %#v", client.updates)
+	}
+}
+
+func TestSubmitFindsJobSubmittedDespiteFailure(t *testing.T) {
+	cl, scheduler, _ := newSubmitRetryTest(t)
+	j := test.InitTests(t, cl.config())
+
+	scheduler.submitErrs = []error{&SubmitError{Kind: submitErrorTransient, Err: errors.New("failed to execute condor_submit")}}
+	scheduler.queue = []JobAd{{"IpcUuid": j.InvocationID, "ClusterId": "42"}}
+	id, err := cl.submit(j, "/tmp/iplant.cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "42" {
+		t.Errorf("submit returned %s instead of the existing cluster ID 42", id)
+	}
+	if len(scheduler.submitted) != 1 {
+		t.Errorf("the job was submitted %d times instead of once", len(scheduler.submitted))
+	}
+}
+
+func TestSubmitGivesUpWhenShuttingDown(t *testing.T) {
+	cl, scheduler, _ := newSubmitRetryTest(t)
+	cl.config().Set("condor.submit_retry.initial_delay", "1h")
+	cl.config().Set("condor.submit_retry.max_delay", "1h")
+	j := test.InitTests(t, cl.config())
+
+	scheduler.submitErrs = []error{&SubmitError{Kind: submitErrorTransient, Err: errors.New("failed to execute condor_submit")}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := cl.submit(j, "/tmp/iplant.cmd")
+		done <- err
+	}()
+	cl.drain(0)
+
+	select {
+	case err := <-done:
+		if submitErr, ok := errors.Cause(err).(*SubmitError); !ok || !submitErr.Transient() {
+			t.Errorf("submit returned %v instead of the transient failure", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("submit was still waiting to retry after the launcher started shutting down")
+	}
+	if len(scheduler.submitted) != 1 {
+		t.Errorf("the job was submitted %d times instead of once", len(scheduler.submitted))
+	}
+}
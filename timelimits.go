@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// jobTimeLimit returns the wall-clock time limit for a job, which is the sum
+// of the time limits of its steps. The default is used if none of the steps
+// have a time limit.
+func jobTimeLimit(job *model.Job, defaultLimit time.Duration) time.Duration {
+	var limit time.Duration
+	for _, step := range job.Steps {
+		limit += time.Duration(step.Component.TimeLimit) * time.Second
+	}
+	if limit == 0 {
+		return defaultLimit
+	}
+	return limit
+}
+
+// timeLimit is the time limit of a single job. The deadline is zero until the
+// job starts running.
+type timeLimit struct {
+	limit    time.Duration
+	deadline time.Time
+}
+
+// TimeLimits tracks the wall-clock deadlines of the launched jobs. A job's
+// deadline is set when it starts running, so the time it spends in the queue
+// doesn't count against its time limit.
+type TimeLimits struct {
+	mutex        sync.Mutex
+	defaultLimit time.Duration // used for jobs whose steps have no time limit
+	limits       map[string]*timeLimit
+}
+
+// NewTimeLimits returns a new *TimeLimits. Jobs whose steps don't have time
+// limits get the default time limit; a default of zero leaves them unlimited.
+func NewTimeLimits(defaultLimit time.Duration) *TimeLimits {
+	return &TimeLimits{
+		defaultLimit: defaultLimit,
+		limits:       make(map[string]*timeLimit),
+	}
+}
+
+// Track starts tracking the time limit of a job that was just submitted. It
+// returns false if the job doesn't have a time limit.
+func (t *TimeLimits) Track(job *model.Job) bool {
+	limit := jobTimeLimit(job, t.defaultLimit)
+	if limit <= 0 {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.limits[job.InvocationID]; !ok {
+		t.limits[job.InvocationID] = &timeLimit{limit: limit}
+	}
+	return true
+}
+
+// Restore starts tracking a job whose deadline was set before the launcher
+// was restarted.
+func (t *TimeLimits) Restore(invocationID string, deadline time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.limits[invocationID] = &timeLimit{limit: deadline.Sub(time.Now()), deadline: deadline}
+}
+
+// Start sets the deadline of a job that has started running. Jobs that are
+// released from the held state keep the deadline they were given the first
+// time they ran. The last return value is false if the job isn't tracked or
+// its deadline was already set.
+func (t *TimeLimits) Start(invocationID string, now time.Time) (time.Time, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tl, ok := t.limits[invocationID]
+	if !ok || !tl.deadline.IsZero() {
+		return time.Time{}, false
+	}
+	tl.deadline = now.Add(tl.limit)
+	return tl.deadline, true
+}
+
+// Remaining returns how much time a job has left. Jobs that haven't started
+// running have all of their time limit left. The last return value is false
+// if the job isn't tracked.
+func (t *TimeLimits) Remaining(invocationID string, now time.Time) (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tl, ok := t.limits[invocationID]
+	if !ok {
+		return 0, false
+	}
+	if tl.deadline.IsZero() {
+		return tl.limit, true
+	}
+	if remaining := tl.deadline.Sub(now); remaining > 0 {
+		return remaining, true
+	}
+	return 0, true
+}
+
+// Adjust adds delta, which may be negative, to the time limit of a job. The
+// new deadline is returned, or the zero time if the job hasn't started
+// running. The last return value is false if the job isn't tracked.
+func (t *TimeLimits) Adjust(invocationID string, delta time.Duration) (time.Time, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tl, ok := t.limits[invocationID]
+	if !ok {
+		return time.Time{}, false
+	}
+	tl.limit += delta
+	if !tl.deadline.IsZero() {
+		tl.deadline = tl.deadline.Add(delta)
+	}
+	return tl.deadline, true
+}
+
+// Expired returns the invocation IDs of the running jobs whose deadlines have
+// passed.
+func (t *TimeLimits) Expired(now time.Time) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var retval []string
+	for invocationID, tl := range t.limits {
+		if !tl.deadline.IsZero() && !now.Before(tl.deadline) {
+			retval = append(retval, invocationID)
+		}
+	}
+	return retval
+}
+
+// Forget stops tracking the time limit of a job.
+func (t *TimeLimits) Forget(invocationID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.limits, invocationID)
+}
+
+// recordDeadline records the deadline of a job in the journal so that it
+// survives a restart.
+func recordDeadline(journal *Journal, invocationID string, deadline time.Time) {
+	if err := journal.Record(JournalEntry{InvocationID: invocationID, Deadline: &deadline}); err != nil {
+		log.Errorf("%+v\n", errors.Wrapf(err, "failed to record the deadline of job %s", invocationID))
+	}
+}
+
+// enforceTimeLimits removes the jobs that have run past their deadlines.
+func (cl *CondorLauncher) enforceTimeLimits(now time.Time) {
+	for _, invocationID := range cl.timeLimits.Expired(now) {
+		log.Warnf("job %s has run past its time limit", invocationID)
+		err := cl.removeJobWithExitCode(invocationID, "Job was killed because it reached its time limit", int(messaging.StatusTimeLimit))
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to remove job %s after it reached its time limit", invocationID))
+			timeLimitsExceeded.WithLabelValues("failed").Inc()
+			continue
+		}
+		timeLimitsExceeded.WithLabelValues("removed").Inc()
+	}
+}
+
+// startTimeLimitTicker starts up the code that periodically removes the jobs
+// that have run past their deadlines.
+func startTimeLimitTicker(launcher *CondorLauncher, interval time.Duration) *Ticker {
+	return startTicker(interval, func() {
+		launcher.enforceTimeLimits(time.Now())
+	})
+}
+
+// timeLimitRequestHandler answers requests for the time left before a job is
+// removed. Requests for jobs the launcher isn't tracking are ignored.
+func (cl *CondorLauncher) timeLimitRequestHandler() func(d amqp.Delivery) {
+	return func(d amqp.Delivery) {
+		if !cl.beginHandling() {
+			return
+		}
+		defer cl.endHandling()
+
+		req := &messaging.TimeLimitRequest{}
+		if err := json.Unmarshal(d.Body, req); err != nil {
+			log.Errorf("%+v\n", errors.Wrap(err, "failed to unmarshal the time limit request body"))
+			unmarshalFailures.WithLabelValues("time_limit_request").Inc()
+			rejectDelivery(d, false, "failed to Reject TimeLimitRequest")
+			return
+		}
+
+		remaining, ok := cl.timeLimits.Remaining(req.InvocationID, time.Now())
+		if !ok {
+			ackDelivery(d, fmt.Sprintf("failed to ACK TimeLimitRequest for %s", req.InvocationID))
+			return
+		}
+
+		ms := int64(remaining / time.Millisecond)
+		if err := cl.client.SendTimeLimitResponse(req.InvocationID, ms); err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "failed to send the time limit response for job %s", req.InvocationID))
+			rejectDelivery(d, !d.Redelivered, fmt.Sprintf("failed to Reject TimeLimitRequest for %s", req.InvocationID))
+			return
+		}
+		ackDelivery(d, fmt.Sprintf("failed to ACK TimeLimitRequest for %s", req.InvocationID))
+	}
+}
+
+// timeLimitDeltaHandler adjusts the time limits of jobs. Deltas for jobs the
+// launcher isn't tracking are ignored.
+func (cl *CondorLauncher) timeLimitDeltaHandler() func(d amqp.Delivery) {
+	return func(d amqp.Delivery) {
+		if !cl.beginHandling() {
+			return
+		}
+		defer cl.endHandling()
+
+		delta := &messaging.TimeLimitDelta{}
+		if err := json.Unmarshal(d.Body, delta); err != nil {
+			log.Errorf("%+v\n", errors.Wrap(err, "failed to unmarshal the time limit delta body"))
+			unmarshalFailures.WithLabelValues("time_limit_delta").Inc()
+			rejectDelivery(d, false, "failed to Reject TimeLimitDelta")
+			return
+		}
+
+		duration, err := time.ParseDuration(delta.Delta)
+		if err != nil {
+			log.Errorf("%+v\n", errors.Wrapf(err, "ignoring the time limit delta %q for job %s", delta.Delta, delta.InvocationID))
+			rejectDelivery(d, false, fmt.Sprintf("failed to Reject TimeLimitDelta for %s", delta.InvocationID))
+			return
+		}
+
+		if deadline, ok := cl.timeLimits.Adjust(delta.InvocationID, duration); ok {
+			log.Infof("adjusted the time limit of job %s by %s", delta.InvocationID, duration)
+			if !deadline.IsZero() {
+				recordDeadline(cl.journal, delta.InvocationID, deadline)
+			}
+		}
+		ackDelivery(d, fmt.Sprintf("failed to ACK TimeLimitDelta for %s", delta.InvocationID))
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+const timeLimitTestID = "07b04ce2-7757-4b21-9e15-0b4c2f44be26"
+
+// timeLimitJob returns a job with a step for each of the given time limits,
+// in seconds.
+func timeLimitJob(limits ...int) *model.Job {
+	j := &model.Job{InvocationID: timeLimitTestID}
+	for _, limit := range limits {
+		j.Steps = append(j.Steps, model.Step{Component: model.StepComponent{TimeLimit: limit}})
+	}
+	return j
+}
+
+// jsonDelivery returns an amqp.Delivery containing msg along with the
+// acknowledger for it.
+func jsonDelivery(t *testing.T, msg interface{}) (amqp.Delivery, *tacknowledger) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &tacknowledger{}
+	return amqp.Delivery{Acknowledger: ack, Body: body}, ack
+}
+
+func TestJobTimeLimit(t *testing.T) {
+	if actual := jobTimeLimit(timeLimitJob(60, 30), time.Hour); actual != 90*time.Second {
+		t.Errorf("the time limit was %s instead of the sum of the steps", actual)
+	}
+	if actual := jobTimeLimit(timeLimitJob(0), time.Hour); actual != time.Hour {
+		t.Errorf("the time limit was %s instead of the default", actual)
+	}
+}
+
+func TestTimeLimits(t *testing.T) {
+	limits := NewTimeLimits(0)
+	if limits.Track(timeLimitJob(0)) {
+		t.Error("a job without a time limit was tracked")
+	}
+	if !limits.Track(timeLimitJob(60)) {
+		t.Fatal("a job with a time limit wasn't tracked")
+	}
+
+	now := time.Now()
+	if remaining, _ := limits.Remaining(timeLimitTestID, now.Add(time.Hour)); remaining != time.Minute {
+		t.Errorf("%s was left before the job started instead of 1m0s", remaining)
+	}
+	if expired := limits.Expired(now.Add(time.Hour)); len(expired) != 0 {
+		t.Errorf("a job that isn't running expired: %v", expired)
+	}
+
+	deadline, ok := limits.Start(timeLimitTestID, now)
+	if !ok || !deadline.Equal(now.Add(time.Minute)) {
+		t.Errorf("Start returned (%s, %t)", deadline, ok)
+	}
+	if _, ok = limits.Start(timeLimitTestID, now.Add(time.Hour)); ok {
+		t.Error("a released job's deadline was reset")
+	}
+
+	if deadline, _ = limits.Adjust(timeLimitTestID, 30*time.Second); !deadline.Equal(now.Add(90 * time.Second)) {
+		t.Errorf("the adjusted deadline was %s", deadline)
+	}
+	if remaining, _ := limits.Remaining(timeLimitTestID, now.Add(time.Minute)); remaining != 30*time.Second {
+		t.Errorf("%s was left instead of 30s", remaining)
+	}
+	if expired := limits.Expired(now.Add(time.Minute)); len(expired) != 0 {
+		t.Errorf("a job expired before its deadline: %v", expired)
+	}
+	if expired := limits.Expired(now.Add(90 * time.Second)); len(expired) != 1 || expired[0] != timeLimitTestID {
+		t.Errorf("Expired returned %v", expired)
+	}
+
+	limits.Forget(timeLimitTestID)
+	if _, ok = limits.Remaining(timeLimitTestID, now); ok {
+		t.Error("a forgotten job is still tracked")
+	}
+}
+
+func TestMonitorStartsTimeLimit(t *testing.T) {
+	journal := NewMemoryJournal()
+	monitor := NewStatusMonitor(newtscheduler(), newtmessenger(), journal)
+	limits := NewTimeLimits(0)
+	monitor.EnforceTimeLimits(limits)
+
+	j := timeLimitJob(60)
+	limits.Track(j)
+	monitor.Track(j, "1")
+	monitor.update(timeLimitTestID, JobAd{"ClusterId": "1", "JobStatus": jobStatusRunning})
+
+	if expired := limits.Expired(time.Now().Add(2 * time.Minute)); len(expired) != 1 {
+		t.Error("the time limit wasn't started when the job started running")
+	}
+	entry, ok := journal.Entry(timeLimitTestID)
+	if !ok || entry.Deadline == nil {
+		t.Errorf("the deadline wasn't journaled: %#v", entry)
+	}
+
+	monitor.update(timeLimitTestID, JobAd{"ClusterId": "1", "JobStatus": jobStatusCompleted, "ExitCode": "0"})
+	if _, ok = limits.Remaining(timeLimitTestID, time.Now()); ok {
+		t.Error("the time limit is still tracked after the job finished")
+	}
+}
+
+func TestTimeLimitRequestHandler(t *testing.T) {
+	client := newtmessenger()
+	cl := New(test.InitConfig(t), client, newtsys(), newtscheduler())
+	cl.timeLimits = NewTimeLimits(0)
+	cl.timeLimits.Track(timeLimitJob(60))
+
+	d, ack := jsonDelivery(t, &messaging.TimeLimitRequest{InvocationID: timeLimitTestID})
+	cl.timeLimitRequestHandler()(d)
+	if !ack.acked {
+		t.Error("the time limit request was not acknowledged")
+	}
+	responses := client.published[messaging.TimeLimitResponsesKey(timeLimitTestID)]
+	if len(responses) != 1 {
+		t.Fatalf("%d time limit responses were sent instead of 1", len(responses))
+	}
+	resp := &messaging.TimeLimitResponse{}
+	if err := json.Unmarshal(responses[0], resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.MillisecondsRemaining != 60000 {
+		t.Errorf("the response had %dms remaining instead of 60000ms", resp.MillisecondsRemaining)
+	}
+
+	other := "3b4f0a2e-0d53-4f5c-9a4e-2a1d9b2f5c11"
+	d, ack = jsonDelivery(t, &messaging.TimeLimitRequest{InvocationID: other})
+	cl.timeLimitRequestHandler()(d)
+	if !ack.acked || len(client.published[messaging.TimeLimitResponsesKey(other)]) != 0 {
+		t.Error("a request for an untracked job wasn't ignored")
+	}
+}
+
+func TestTimeLimitDeltaHandler(t *testing.T) {
+	cl := New(test.InitConfig(t), newtmessenger(), newtsys(), newtscheduler())
+	cl.timeLimits = NewTimeLimits(0)
+	cl.timeLimits.Track(timeLimitJob(60))
+	now := time.Now()
+	cl.timeLimits.Start(timeLimitTestID, now)
+
+	d, ack := jsonDelivery(t, &messaging.TimeLimitDelta{InvocationID: timeLimitTestID, Delta: "1h"})
+	cl.timeLimitDeltaHandler()(d)
+	if !ack.acked {
+		t.Error("the time limit delta was not acknowledged")
+	}
+	entry, ok := cl.journal.Entry(timeLimitTestID)
+	if !ok || entry.Deadline == nil || !entry.Deadline.Equal(now.Add(61*time.Minute)) {
+		t.Errorf("the adjusted deadline wasn't journaled: %#v", entry)
+	}
+
+	d, ack = jsonDelivery(t, &messaging.TimeLimitDelta{InvocationID: timeLimitTestID, Delta: "forever"})
+	cl.timeLimitDeltaHandler()(d)
+	if !ack.rejected || ack.requeued {
+		t.Error("an unparseable delta was not rejected without being requeued")
+	}
+}
+
+func TestEnforceTimeLimits(t *testing.T) {
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(test.InitConfig(t), client, newtsys(), scheduler)
+	cl.timeLimits = NewTimeLimits(0)
+	cl.timeLimits.Track(timeLimitJob(60))
+	now := time.Now()
+	cl.timeLimits.Start(timeLimitTestID, now)
+
+	cl.enforceTimeLimits(now.Add(30 * time.Second))
+	if len(scheduler.removed) != 0 {
+		t.Fatalf("a job was removed before its deadline: %v", scheduler.removed)
+	}
+
+	cl.enforceTimeLimits(now.Add(time.Minute))
+	if len(scheduler.removed) != 1 {
+		t.Fatalf("%d jobs were removed instead of 1", len(scheduler.removed))
+	}
+	if len(client.updates) != 1 {
+		t.Fatalf("%d updates were published instead of 1", len(client.updates))
+	}
+	u := client.updates[0]
+	if u.State != messaging.FailedState || u.Job.ExitCode != int(messaging.StatusTimeLimit) {
+		t.Errorf("unexpected update for the expired job: %s, exit code %d", u.State, u.Job.ExitCode)
+	}
+	if _, ok := cl.timeLimits.Remaining(timeLimitTestID, now); ok {
+		t.Error("the removed job's time limit is still tracked")
+	}
+}
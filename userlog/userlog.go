@@ -0,0 +1,437 @@
+// Package userlog parses HTCondor user event logs, such as the condor.log
+// file that's written into the submission directory of every job that
+// condor-launcher submits.
+//
+// A user log is a sequence of events. Each event starts with a header line
+// containing a three digit event code, the job ID and a timestamp, continues
+// with zero or more indented lines of event-specific details, and ends with a
+// line containing only "...".
+package userlog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Event codes used in the HTCondor user log.
+const (
+	SubmitCode     = 0
+	ExecuteCode    = 1
+	EvictedCode    = 4
+	TerminatedCode = 5
+	ImageSizeCode  = 6
+	AbortedCode    = 9
+	HeldCode       = 12
+	ReleasedCode   = 13
+)
+
+// eventSeparator is the line that ends each event.
+const eventSeparator = "..."
+
+var (
+	headerRegexp      = regexp.MustCompile(`^(\d{3}) \((\d+)\.(\d+)\.(\d+)\) (\S+)[ T](\d{2}:\d{2}:\d{2}) (.*)$`)
+	hostRegexp        = regexp.MustCompile(`host: <([^>]*)>`)
+	normalRegexp      = regexp.MustCompile(`Normal termination \(return value (-?\d+)\)`)
+	abnormalRegexp    = regexp.MustCompile(`Abnormal termination \(signal (\d+)\)`)
+	holdCodeRegexp    = regexp.MustCompile(`^Code (\d+) Subcode (\d+)$`)
+	imageSizeRegexp   = regexp.MustCompile(`Image size of job updated: (\d+)`)
+	sizeDetailRegexp  = regexp.MustCompile(`^(\d+)\s+-\s+(.*)$`)
+	remoteUsageRegexp = regexp.MustCompile(`^Usr (\d+) (\d{2}):(\d{2}):(\d{2}), Sys (\d+) (\d{2}):(\d{2}):(\d{2})\s+-\s+Run Remote Usage$`)
+	resourceRegexp    = regexp.MustCompile(`^(.+?)\s+:\s+(.*)$`)
+)
+
+// Header contains the fields that are common to every event.
+type Header struct {
+	Code    int
+	Cluster int
+	Proc    int
+	Subproc int
+	Time    time.Time
+}
+
+// Event is implemented by every event type in this package.
+type Event interface {
+	EventHeader() Header
+}
+
+// EventHeader returns the header of the event.
+func (h Header) EventHeader() Header {
+	return h
+}
+
+// JobID returns the job ID in the <cluster>.<proc> format used by the
+// HTCondor command-line tools.
+func (h Header) JobID() string {
+	return fmt.Sprintf("%d.%d", h.Cluster, h.Proc)
+}
+
+// Resource contains the usage, request, and allocation of a single resource as
+// reported in the partitionable resources table of some events. Usage is -1
+// if it wasn't reported.
+type Resource struct {
+	Usage     float64
+	Request   float64
+	Allocated float64
+}
+
+// Usage contains the resource usage reported for a job.
+type Usage struct {
+	RemoteUserCPU time.Duration
+	RemoteSysCPU  time.Duration
+	BytesSent     int64
+	BytesReceived int64
+	Resources     map[string]Resource // keyed by name, e.g. "Memory (MB)"
+}
+
+// SubmitEvent is logged when a job is submitted.
+type SubmitEvent struct {
+	Header
+	Host string
+}
+
+// ExecuteEvent is logged when a job starts running.
+type ExecuteEvent struct {
+	Header
+	Host string
+}
+
+// ImageSizeEvent is logged when the memory usage of a job is updated.
+type ImageSizeEvent struct {
+	Header
+	ImageSizeKB       int64
+	MemoryUsageMB     int64
+	ResidentSetSizeKB int64
+}
+
+// EvictedEvent is logged when a job is evicted from the machine it was
+// running on.
+type EvictedEvent struct {
+	Header
+	Checkpointed bool
+	Usage        Usage
+}
+
+// TerminatedEvent is logged when a job exits. ExitCode is only meaningful if
+// Normal is true and Signal is only meaningful if it's false.
+type TerminatedEvent struct {
+	Header
+	Normal   bool
+	ExitCode int
+	Signal   int
+	Usage    Usage
+}
+
+// AbortedEvent is logged when a job is removed from the queue.
+type AbortedEvent struct {
+	Header
+	Reason string
+}
+
+// HeldEvent is logged when a job is put on hold.
+type HeldEvent struct {
+	Header
+	Reason  string
+	Code    int
+	Subcode int
+}
+
+// ReleasedEvent is logged when a job is released from hold.
+type ReleasedEvent struct {
+	Header
+	Reason string
+}
+
+// UnknownEvent is returned for event codes that this package doesn't parse.
+// Lines contains the body of the event with the indentation removed.
+type UnknownEvent struct {
+	Header
+	Description string
+	Lines       []string
+}
+
+// Parser splits user log text into events. Text can be fed to it in
+// arbitrary chunks; incomplete events are kept until the rest of the event
+// arrives.
+type Parser struct {
+	partial []byte   // text after the last newline seen
+	lines   []string // lines of the event that hasn't been terminated yet
+}
+
+// NewParser returns a new *Parser.
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+// Feed adds text to the parser and returns the events that were completed by
+// it. Events that can't be parsed are skipped. If any were skipped then the
+// first error encountered is returned along with the events that could be
+// parsed.
+func (p *Parser) Feed(data []byte) ([]Event, error) {
+	var (
+		events   []Event
+		firstErr error
+	)
+
+	p.partial = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(p.partial[:i]), "\r")
+		p.partial = p.partial[i+1:]
+
+		if line != eventSeparator {
+			p.lines = append(p.lines, line)
+			continue
+		}
+
+		ev, err := parseEvent(p.lines)
+		p.lines = nil
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		events = append(events, ev)
+	}
+
+	return events, firstErr
+}
+
+// Parse reads an entire user log and returns the events in it.
+func Parse(r io.Reader) ([]Event, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the user log")
+	}
+	return NewParser().Feed(data)
+}
+
+// parseTime parses an event timestamp. Older versions of HTCondor log the
+// month and day without a year, in which case the current year is assumed.
+func parseTime(date, clock string) (time.Time, error) {
+	if strings.Contains(date, "/") {
+		t, err := time.ParseInLocation("01/02 15:04:05", date+" "+clock, time.Local)
+		if err != nil {
+			return t, err
+		}
+		return t.AddDate(time.Now().Year(), 0, 0), nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", date+" "+clock, time.Local)
+}
+
+// parseHeader parses the first line of an event.
+func parseHeader(line string) (Header, string, error) {
+	var h Header
+
+	m := headerRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return h, "", fmt.Errorf("malformed event header: %q", line)
+	}
+	h.Code, _ = strconv.Atoi(m[1])
+	h.Cluster, _ = strconv.Atoi(m[2])
+	h.Proc, _ = strconv.Atoi(m[3])
+	h.Subproc, _ = strconv.Atoi(m[4])
+
+	t, err := parseTime(m[5], m[6])
+	if err != nil {
+		return h, "", errors.Wrapf(err, "malformed event timestamp: %q", line)
+	}
+	h.Time = t
+
+	return h, m[7], nil
+}
+
+// parseEvent parses the lines of a single event, not including the separator.
+func parseEvent(lines []string) (Event, error) {
+	// Skip any blank lines between events.
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("empty event")
+	}
+
+	h, desc, err := parseHeader(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	body := make([]string, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		body = append(body, strings.TrimSpace(line))
+	}
+
+	switch h.Code {
+	case SubmitCode:
+		return &SubmitEvent{Header: h, Host: parseHost(desc)}, nil
+	case ExecuteCode:
+		return &ExecuteEvent{Header: h, Host: parseHost(desc)}, nil
+	case ImageSizeCode:
+		return parseImageSize(h, desc, body), nil
+	case EvictedCode:
+		ev := &EvictedEvent{Header: h, Usage: parseUsage(body)}
+		ev.Checkpointed = len(body) > 0 && strings.HasPrefix(body[0], "(1)")
+		return ev, nil
+	case TerminatedCode:
+		return parseTerminated(h, body)
+	case AbortedCode:
+		return &AbortedEvent{Header: h, Reason: firstLine(body)}, nil
+	case HeldCode:
+		return parseHeld(h, body), nil
+	case ReleasedCode:
+		return &ReleasedEvent{Header: h, Reason: firstLine(body)}, nil
+	default:
+		return &UnknownEvent{Header: h, Description: desc, Lines: body}, nil
+	}
+}
+
+// firstLine returns the first line of an event body, or an empty string if
+// the body is empty.
+func firstLine(body []string) string {
+	if len(body) == 0 {
+		return ""
+	}
+	return body[0]
+}
+
+// parseHost extracts the address from a "... host: <address>" description.
+func parseHost(desc string) string {
+	m := hostRegexp.FindStringSubmatch(desc)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+func parseImageSize(h Header, desc string, body []string) *ImageSizeEvent {
+	ev := &ImageSizeEvent{Header: h}
+	if m := imageSizeRegexp.FindStringSubmatch(desc); m != nil {
+		ev.ImageSizeKB, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	for _, line := range body {
+		m := sizeDetailRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		value, _ := strconv.ParseInt(m[1], 10, 64)
+		switch {
+		case strings.HasPrefix(m[2], "MemoryUsage"):
+			ev.MemoryUsageMB = value
+		case strings.HasPrefix(m[2], "ResidentSetSize"):
+			ev.ResidentSetSizeKB = value
+		}
+	}
+	return ev
+}
+
+func parseTerminated(h Header, body []string) (*TerminatedEvent, error) {
+	ev := &TerminatedEvent{Header: h, Usage: parseUsage(body)}
+	status := firstLine(body)
+	if m := normalRegexp.FindStringSubmatch(status); m != nil {
+		ev.Normal = true
+		ev.ExitCode, _ = strconv.Atoi(m[1])
+	} else if m := abnormalRegexp.FindStringSubmatch(status); m != nil {
+		ev.Signal, _ = strconv.Atoi(m[1])
+	} else {
+		return nil, fmt.Errorf("malformed termination status for job %s: %q", h.JobID(), status)
+	}
+	return ev, nil
+}
+
+func parseHeld(h Header, body []string) *HeldEvent {
+	ev := &HeldEvent{Header: h}
+	for _, line := range body {
+		if m := holdCodeRegexp.FindStringSubmatch(line); m != nil {
+			ev.Code, _ = strconv.Atoi(m[1])
+			ev.Subcode, _ = strconv.Atoi(m[2])
+		} else if ev.Reason == "" {
+			ev.Reason = line
+		}
+	}
+	return ev
+}
+
+// cpuTime converts the day and clock fields of a remote usage line to a
+// time.Duration.
+func cpuTime(days, hours, minutes, seconds string) time.Duration {
+	d, _ := strconv.Atoi(days)
+	h, _ := strconv.Atoi(hours)
+	m, _ := strconv.Atoi(minutes)
+	s, _ := strconv.Atoi(seconds)
+	return time.Duration(d)*24*time.Hour +
+		time.Duration(h)*time.Hour +
+		time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second
+}
+
+// parseUsage extracts the resource usage from the body of an evicted or
+// terminated event.
+func parseUsage(body []string) Usage {
+	u := Usage{Resources: make(map[string]Resource)}
+	inResources := false
+
+	for _, line := range body {
+		if m := remoteUsageRegexp.FindStringSubmatch(line); m != nil {
+			u.RemoteUserCPU = cpuTime(m[1], m[2], m[3], m[4])
+			u.RemoteSysCPU = cpuTime(m[5], m[6], m[7], m[8])
+			continue
+		}
+		if m := sizeDetailRegexp.FindStringSubmatch(line); m != nil {
+			value, _ := strconv.ParseInt(m[1], 10, 64)
+			switch m[2] {
+			case "Run Bytes Sent By Job":
+				u.BytesSent = value
+			case "Run Bytes Received By Job":
+				u.BytesReceived = value
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "Partitionable Resources") {
+			inResources = true
+			continue
+		}
+		if !inResources {
+			continue
+		}
+		m := resourceRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if r, ok := parseResource(m[2]); ok {
+			u.Resources[m[1]] = r
+		}
+	}
+
+	return u
+}
+
+// parseResource parses the columns of a row in the partitionable resources
+// table. The usage column is blank for some resources.
+func parseResource(columns string) (Resource, bool) {
+	var values []float64
+	for _, field := range strings.Fields(columns) {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return Resource{}, false
+		}
+		values = append(values, v)
+	}
+	switch {
+	case len(values) == 2:
+		return Resource{Usage: -1, Request: values[0], Allocated: values[1]}, true
+	case len(values) >= 3:
+		return Resource{Usage: values[0], Request: values[1], Allocated: values[2]}, true
+	default:
+		return Resource{}, false
+	}
+}
@@ -0,0 +1,194 @@
+package userlog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLog = `000 (10000.000.000) 2019-06-05 15:10:01 Job submitted from host: <10.0.0.1:9618?addrs=10.0.0.1-9618&noUDP&sock=1234_abcd_3>
+...
+001 (10000.000.000) 2019-06-05 15:10:30 Job executing on host: <10.0.0.2:9618?addrs=10.0.0.2-9618&noUDP&sock=5678_efgh_4>
+...
+006 (10000.000.000) 2019-06-05 15:10:40 Image size of job updated: 12345
+	3  -  MemoryUsage of job (MB)
+	2048  -  ResidentSetSize of job (KB)
+...
+012 (10000.000.000) 2019-06-05 15:11:51 Job was held.
+	Error from slot1@node-2: Failed to execute '/usr/local/bin/road-runner'
+	Code 6 Subcode 2
+...
+013 (10000.000.000) 2019-06-05 15:12:00 Job was released.
+	via condor_release (by user condor)
+...
+004 (10000.000.000) 2019-06-05 15:13:00 Job was evicted.
+	(0) Job was not checkpointed.
+		Usr 0 00:00:01, Sys 0 00:00:02  -  Run Remote Usage
+		Usr 0 00:00:00, Sys 0 00:00:00  -  Run Local Usage
+	0  -  Run Bytes Sent By Job
+	0  -  Run Bytes Received By Job
+...
+005 (10000.000.000) 2019-06-05 15:20:00 Job terminated.
+	(1) Normal termination (return value 3)
+		Usr 0 01:02:03, Sys 1 00:00:04  -  Run Remote Usage
+		Usr 0 00:00:00, Sys 0 00:00:00  -  Run Local Usage
+		Usr 0 01:02:03, Sys 1 00:00:04  -  Total Remote Usage
+		Usr 0 00:00:00, Sys 0 00:00:00  -  Total Local Usage
+	1024  -  Run Bytes Sent By Job
+	2048  -  Run Bytes Received By Job
+	1024  -  Total Bytes Sent By Job
+	2048  -  Total Bytes Received By Job
+	Partitionable Resources :    Usage  Request Allocated
+	   Cpus                 :                 1         1
+	   Disk (KB)            :       15        1   2000000
+	   Memory (MB)          :        3        1      1024
+...
+009 (10001.000.000) 06/05 16:00:00 Job was aborted by the user.
+	via condor_rm (by user condor)
+...
+`
+
+func TestParse(t *testing.T) {
+	events, err := Parse(strings.NewReader(testLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 8 {
+		t.Fatalf("Parse returned %d events instead of 8", len(events))
+	}
+
+	submit, ok := events[0].(*SubmitEvent)
+	if !ok {
+		t.Fatalf("event 0 is a %T instead of a *SubmitEvent", events[0])
+	}
+	if submit.Cluster != 10000 || submit.JobID() != "10000.0" {
+		t.Errorf("the submit event has the job ID %s instead of 10000.0", submit.JobID())
+	}
+	expectedTime := time.Date(2019, 6, 5, 15, 10, 1, 0, time.Local)
+	if !submit.Time.Equal(expectedTime) {
+		t.Errorf("the submit event time was %s instead of %s", submit.Time, expectedTime)
+	}
+
+	execute, ok := events[1].(*ExecuteEvent)
+	if !ok {
+		t.Fatalf("event 1 is a %T instead of an *ExecuteEvent", events[1])
+	}
+	if !strings.HasPrefix(execute.Host, "10.0.0.2:9618") {
+		t.Errorf("the execute event host was %q", execute.Host)
+	}
+
+	imageSize, ok := events[2].(*ImageSizeEvent)
+	if !ok {
+		t.Fatalf("event 2 is a %T instead of an *ImageSizeEvent", events[2])
+	}
+	if imageSize.ImageSizeKB != 12345 || imageSize.MemoryUsageMB != 3 || imageSize.ResidentSetSizeKB != 2048 {
+		t.Errorf("unexpected image size event: %#v", imageSize)
+	}
+
+	held, ok := events[3].(*HeldEvent)
+	if !ok {
+		t.Fatalf("event 3 is a %T instead of a *HeldEvent", events[3])
+	}
+	if held.Code != 6 || held.Subcode != 2 || !strings.HasPrefix(held.Reason, "Error from slot1@node-2") {
+		t.Errorf("unexpected held event: %#v", held)
+	}
+
+	released, ok := events[4].(*ReleasedEvent)
+	if !ok {
+		t.Fatalf("event 4 is a %T instead of a *ReleasedEvent", events[4])
+	}
+	if released.Reason != "via condor_release (by user condor)" {
+		t.Errorf("the release reason was %q", released.Reason)
+	}
+
+	evicted, ok := events[5].(*EvictedEvent)
+	if !ok {
+		t.Fatalf("event 5 is a %T instead of an *EvictedEvent", events[5])
+	}
+	if evicted.Checkpointed || evicted.Usage.RemoteUserCPU != time.Second || evicted.Usage.RemoteSysCPU != 2*time.Second {
+		t.Errorf("unexpected evicted event: %#v", evicted)
+	}
+
+	terminated, ok := events[6].(*TerminatedEvent)
+	if !ok {
+		t.Fatalf("event 6 is a %T instead of a *TerminatedEvent", events[6])
+	}
+	if !terminated.Normal || terminated.ExitCode != 3 {
+		t.Errorf("the job terminated with (%t, %d) instead of (true, 3)", terminated.Normal, terminated.ExitCode)
+	}
+	usage := terminated.Usage
+	if usage.RemoteUserCPU != time.Hour+2*time.Minute+3*time.Second || usage.RemoteSysCPU != 24*time.Hour+4*time.Second {
+		t.Errorf("unexpected remote usage: %s user, %s sys", usage.RemoteUserCPU, usage.RemoteSysCPU)
+	}
+	if usage.BytesSent != 1024 || usage.BytesReceived != 2048 {
+		t.Errorf("unexpected bytes transferred: %d sent, %d received", usage.BytesSent, usage.BytesReceived)
+	}
+	expectedResources := map[string]Resource{
+		"Cpus":        {Usage: -1, Request: 1, Allocated: 1},
+		"Disk (KB)":   {Usage: 15, Request: 1, Allocated: 2000000},
+		"Memory (MB)": {Usage: 3, Request: 1, Allocated: 1024},
+	}
+	for name, expected := range expectedResources {
+		if actual := usage.Resources[name]; actual != expected {
+			t.Errorf("resource %s was %#v instead of %#v", name, actual, expected)
+		}
+	}
+
+	aborted, ok := events[7].(*AbortedEvent)
+	if !ok {
+		t.Fatalf("event 7 is a %T instead of an *AbortedEvent", events[7])
+	}
+	if aborted.Cluster != 10001 || aborted.Time.Year() != time.Now().Year() {
+		t.Errorf("unexpected aborted event header: %#v", aborted.Header)
+	}
+}
+
+func TestParserFeedPartial(t *testing.T) {
+	p := NewParser()
+	split := strings.Index(testLog, "Job executing") + 5
+
+	events, err := p.Feed([]byte(testLog[:split]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("the first chunk produced %d events instead of 1", len(events))
+	}
+
+	events, err = p.Feed([]byte(testLog[split:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 7 {
+		t.Fatalf("the second chunk produced %d events instead of 7", len(events))
+	}
+	if _, ok := events[0].(*ExecuteEvent); !ok {
+		t.Errorf("the first event in the second chunk is a %T instead of an *ExecuteEvent", events[0])
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	log := "this is not an event\n...\n" + testLog
+	events, err := Parse(strings.NewReader(log))
+	if err == nil {
+		t.Error("no error was returned for a malformed event")
+	}
+	if len(events) != 8 {
+		t.Errorf("Parse returned %d events instead of 8", len(events))
+	}
+}
+
+func TestParseUnknownEvent(t *testing.T) {
+	log := "028 (10000.000.000) 2019-06-05 15:10:01 Job ad information event triggered.\n\tfoo = 1\n...\n"
+	events, err := Parse(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, ok := events[0].(*UnknownEvent)
+	if !ok {
+		t.Fatalf("the event is a %T instead of an *UnknownEvent", events[0])
+	}
+	if unknown.Code != 28 || len(unknown.Lines) != 1 || unknown.Lines[0] != "foo = 1" {
+		t.Errorf("unexpected unknown event: %#v", unknown)
+	}
+}
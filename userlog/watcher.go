@@ -0,0 +1,174 @@
+package userlog
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Handler is called for each event read by a Watcher. The key is the one
+// that the log was added to the Watcher with.
+type Handler func(key string, ev Event)
+
+// ErrorHandler is called when a Watcher can't read or parse a log.
+type ErrorHandler func(key string, err error)
+
+// followedLog is the read state of a single log.
+type followedLog struct {
+	path   string
+	offset int64
+	parser *Parser
+}
+
+// Watcher follows a set of user logs, passing new events to a Handler as
+// they're written. Logs are checked for new events on a fixed interval, and
+// logs that don't exist yet are checked again on the next pass.
+type Watcher struct {
+	interval time.Duration
+	handler  Handler
+	onError  ErrorHandler
+	mutex    sync.Mutex
+	logs     map[string]*followedLog
+	done     chan struct{}
+}
+
+// NewWatcher returns a new *Watcher. The onError function may be nil.
+func NewWatcher(interval time.Duration, handler Handler, onError ErrorHandler) *Watcher {
+	if onError == nil {
+		onError = func(string, error) {}
+	}
+	return &Watcher{
+		interval: interval,
+		handler:  handler,
+		onError:  onError,
+		logs:     make(map[string]*followedLog),
+	}
+}
+
+// Add starts following the log at the given path, reading it from the
+// beginning. Adding a key that's already present replaces it.
+func (w *Watcher) Add(key, path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.logs[key] = &followedLog{path: path, parser: NewParser()}
+}
+
+// Remove stops following the log added with the given key.
+func (w *Watcher) Remove(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.logs, key)
+}
+
+// Len returns the number of logs being followed.
+func (w *Watcher) Len() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.logs)
+}
+
+// read returns the events that have been written to a log since it was last
+// read.
+func (l *followedLog) read() ([]Event, error) {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", l.path)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat %s", l.path)
+	}
+
+	// Start over if the log was truncated or replaced by a shorter file.
+	if info.Size() < l.offset {
+		l.offset = 0
+		l.parser = NewParser()
+	}
+	if info.Size() == l.offset {
+		return nil, nil
+	}
+
+	if _, err = f.Seek(l.offset, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "failed to seek in %s", l.path)
+	}
+	data := make([]byte, info.Size()-l.offset)
+	n, err := io.ReadFull(f, data)
+	l.offset += int64(n)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrapf(err, "failed to read %s", l.path)
+	}
+
+	events, err := l.parser.Feed(data[:n])
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse %s", l.path)
+	}
+	return events, err
+}
+
+// keyedEvent associates an event with the key of the log it was read from.
+type keyedEvent struct {
+	key string
+	ev  Event
+}
+
+// Poll reads every followed log once and passes the new events to the
+// handler. The handler is called without holding any locks, so it may add or
+// remove logs.
+func (w *Watcher) Poll() {
+	var events []keyedEvent
+
+	w.mutex.Lock()
+	for key, l := range w.logs {
+		evs, err := l.read()
+		if err != nil {
+			w.onError(key, err)
+		}
+		for _, ev := range evs {
+			events = append(events, keyedEvent{key: key, ev: ev})
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, ke := range events {
+		w.handler(ke.key, ke.ev)
+	}
+}
+
+// Start polls the followed logs periodically until Stop is called.
+func (w *Watcher) Start() {
+	w.mutex.Lock()
+	w.done = make(chan struct{})
+	done := w.done
+	w.mutex.Unlock()
+
+	go func() {
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				w.Poll()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the polling started by Start.
+func (w *Watcher) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+}
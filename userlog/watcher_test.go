@@ -0,0 +1,63 @@
+package userlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWatcherPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "condor.log")
+
+	var received []Event
+	w := NewWatcher(0, func(key string, ev Event) {
+		if key != "job" {
+			t.Errorf("the handler was called with the key %q", key)
+		}
+		received = append(received, ev)
+	}, func(key string, err error) {
+		t.Error(err)
+	})
+	w.Add("job", logPath)
+
+	// The log doesn't exist yet.
+	w.Poll()
+	if len(received) != 0 {
+		t.Fatalf("%d events were received before the log existed", len(received))
+	}
+
+	split := strings.Index(testLog, "Job executing") + 5
+	if err = ioutil.WriteFile(logPath, []byte(testLog[:split]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.Poll()
+	if len(received) != 1 {
+		t.Fatalf("%d events were received instead of 1", len(received))
+	}
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(testLog[split:]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	w.Poll()
+	if len(received) != 8 {
+		t.Fatalf("%d events were received instead of 8", len(received))
+	}
+
+	w.Remove("job")
+	if w.Len() != 0 {
+		t.Errorf("the watcher is following %d logs after the only one was removed", w.Len())
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v4"
+)
+
+// The execution targets the launcher can submit jobs to.
+var executionTargets = []string{"condor", "interapps", "osg"}
+
+// imageNameRegexp matches Docker image names, which may start with a registry
+// host and port. It follows the reference grammar used by Docker.
+var imageNameRegexp = regexp.MustCompile(
+	`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+		`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`,
+)
+
+// imageTagRegexp matches Docker image tags.
+var imageTagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// jobValidator collects the problems found with a job so that they can all be
+// reported at once.
+type jobValidator struct {
+	errs JobFieldErrors
+}
+
+// fail records a problem with a field.
+func (v *jobValidator) fail(field, problem string, args ...interface{}) {
+	v.errs = append(v.errs, &JobFieldError{Field: field, Problem: fmt.Sprintf(problem, args...)})
+}
+
+// Err returns the problems found with the job, if any.
+func (v *jobValidator) Err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// text checks a value that's placed in the submit description, where a
+// control character could start a command of its own.
+func (v *jobValidator) text(field, value string) {
+	if containsControl(value) {
+		v.fail(field, "contains a control character")
+	}
+}
+
+// submitFields checks the job fields that are placed in the submit
+// description, so that a job that can't be submitted is rejected before its
+// submission files are written.
+func (v *jobValidator) submitFields(s *model.Job) {
+	v.text("group", s.Group)
+	v.text("username", s.Submitter)
+	if strings.ContainsAny(s.Submitter, `"\$`) {
+		v.fail("username", "contains a quote, backslash or dollar sign")
+	}
+	v.text("user_id", s.UserID)
+	for i, group := range s.UserGroups {
+		v.text(fmt.Sprintf("user_groups[%d]", i), group)
+	}
+	if len(s.Steps) > 0 {
+		component := &s.Steps[0].Component
+		v.text("steps[0].component.name", component.Name)
+		v.text("steps[0].component.location", component.Location)
+		if s.ExecutionTarget == "osg" {
+			v.text("steps[0].component.container.image.osg_image_path", component.Container.Image.OSGImagePath)
+		}
+	}
+	if extra := s.Extra.HTCondor.ExtraRequirements; extra != "" && s.ExecutionTarget == "condor" {
+		const field = "extra.htcondor.extra_requirements"
+		if containsControl(extra) {
+			v.fail(field, "contains a control character")
+		} else if problem := checkExpression(extra); problem != "" {
+			v.fail(field, "%s", problem)
+		}
+	}
+}
+
+// checkSubmitFields checks the job fields that are placed in the submit
+// description. The returned error is a JobFieldErrors.
+func checkSubmitFields(s *model.Job) error {
+	v := &jobValidator{}
+	v.submitFields(s)
+	return v.Err()
+}
+
+// hasParentReference returns true if a path contains a ".." element.
+func hasParentReference(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// pathElement checks a value that's used as a single directory name in the
+// job's log directory, which it must not be able to leave.
+func (v *jobValidator) pathElement(field, value string) {
+	switch {
+	case value == "":
+		v.fail(field, "is empty")
+	case strings.Contains(value, "/"):
+		v.fail(field, "must not contain /")
+	case strings.HasPrefix(value, "."):
+		v.fail(field, "must not start with .")
+	}
+}
+
+// absolutePath checks a path that must be absolute.
+func (v *jobValidator) absolutePath(field, p string) {
+	switch {
+	case p == "":
+		v.fail(field, "is empty")
+	case !path.IsAbs(p):
+		v.fail(field, "must be an absolute path")
+	case hasParentReference(p):
+		v.fail(field, "must not contain ..")
+	}
+}
+
+// image checks the container image of a step that runs in Docker.
+func (v *jobValidator) image(field string, image *model.ContainerImage) {
+	if image.Name == "" {
+		v.fail(field+".name", "is empty")
+	} else if !imageNameRegexp.MatchString(image.Name) {
+		v.fail(field+".name", "is not a valid image name")
+	}
+	if image.Tag != "" && !imageTagRegexp.MatchString(image.Tag) {
+		v.fail(field+".tag", "is not a valid image tag")
+	}
+}
+
+// resources checks the resource requests and limits of a step.
+func (v *jobValidator) resources(field string, c *model.Container) {
+	if c.MinCPUCores < 0 {
+		v.fail(field+".min_cpu_cores", "is negative")
+	}
+	if c.MaxCPUCores < 0 {
+		v.fail(field+".max_cpu_cores", "is negative")
+	}
+	if c.MaxCPUCores > 0 && c.MinCPUCores > c.MaxCPUCores {
+		v.fail(field+".min_cpu_cores", "is greater than max_cpu_cores")
+	}
+	if c.MinMemoryLimit < 0 {
+		v.fail(field+".min_memory_limit", "is negative")
+	}
+	if c.MemoryLimit < 0 {
+		v.fail(field+".memory_limit", "is negative")
+	}
+	if c.MemoryLimit > 0 && c.MinMemoryLimit > c.MemoryLimit {
+		v.fail(field+".min_memory_limit", "is greater than memory_limit")
+	}
+	if c.MinDiskSpace < 0 {
+		v.fail(field+".min_disk_space", "is negative")
+	}
+}
+
+// step checks a single step of a job.
+func (v *jobValidator) step(i int, step *model.Step, target string) {
+	field := fmt.Sprintf("steps[%d]", i)
+	component := field + ".component"
+
+	if target == "osg" {
+		if step.Component.Container.Image.OSGImagePath == "" {
+			v.fail(component+".container.image.osg_image_path", "is required for osg jobs")
+		}
+	} else {
+		v.image(component+".container.image", &step.Component.Container.Image)
+	}
+	v.resources(component+".container", &step.Component.Container)
+	if step.Component.TimeLimit < 0 {
+		v.fail(component+".time_limit_seconds", "is negative")
+	}
+
+	for j, input := range step.Config.Inputs {
+		inputField := fmt.Sprintf("%s.config.input[%d]", field, j)
+		v.absolutePath(inputField+".value", input.Value)
+		if target == "osg" && input.Ticket == "" {
+			v.fail(inputField+".ticket", "is required for osg jobs")
+		}
+	}
+	for j, output := range step.Config.Outputs {
+		outputField := fmt.Sprintf("%s.config.output[%d].name", field, j)
+		if output.Name == "" {
+			v.fail(outputField, "is empty")
+		} else if hasParentReference(output.Name) {
+			v.fail(outputField, "must not contain ..")
+		}
+	}
+}
+
+// validateJob checks a job before any of its submission files are written. The
+// returned error is a JobFieldErrors listing every problem that was found.
+func validateJob(s *model.Job) error {
+	v := &jobValidator{}
+
+	if err := validateInvocationID(s.InvocationID); err != nil {
+		v.fail("uuid", "is not a valid UUID")
+	}
+	// The username and the job name are part of the job's log directory.
+	v.pathElement("username", s.Submitter)
+	v.pathElement("name", s.Name)
+
+	knownTarget := false
+	for _, target := range executionTargets {
+		if s.ExecutionTarget == target {
+			knownTarget = true
+		}
+	}
+	if !knownTarget {
+		v.fail("execution_target", "must be one of %s", strings.Join(executionTargets, ", "))
+	}
+
+	if len(s.Steps) == 0 {
+		v.fail("steps", "is empty")
+	}
+	if s.ExecutionTarget == "osg" && len(s.Steps) > 1 {
+		v.fail("steps", "must contain a single step for osg jobs")
+	}
+	for i := range s.Steps {
+		v.step(i, &s.Steps[i], s.ExecutionTarget)
+	}
+
+	if s.OutputDir != "" {
+		v.absolutePath("output_dir", s.OutputDir)
+	}
+	if s.ExecutionTarget == "osg" && s.OutputDirTicket == "" {
+		v.fail("output_dir_ticket", "is required for osg jobs")
+	}
+
+	v.submitFields(s)
+
+	return v.Err()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"gopkg.in/cyverse-de/messaging.v6"
+	"gopkg.in/cyverse-de/model.v4"
+
+	"github.com/cyverse-de/condor-launcher/test"
+)
+
+// reportedFields returns the fields named in a JobFieldErrors.
+func reportedFields(t *testing.T, err error) map[string]bool {
+	errs, ok := err.(JobFieldErrors)
+	if !ok {
+		t.Fatalf("%#v is not a JobFieldErrors", err)
+	}
+	retval := make(map[string]bool)
+	for _, e := range errs {
+		retval[e.Field] = true
+	}
+	return retval
+}
+
+func TestValidateJob(t *testing.T) {
+	for _, fname := range []string{"test/test_submission.json", "test/no_volumes_submission.json"} {
+		if err := validateJob(loadTestJob(t, fname)); err != nil {
+			t.Errorf("%s failed validation: %s", fname, err)
+		}
+	}
+
+	cases := []struct {
+		field  string
+		modify func(j *model.Job)
+	}{
+		{"uuid", func(j *model.Job) { j.InvocationID = "not-a-uuid" }},
+		{"username", func(j *model.Job) { j.Submitter = "" }},
+		{"username", func(j *model.Job) { j.Submitter = "../ipcdev" }},
+		{"username", func(j *model.Job) { j.Submitter = ".." }},
+		{"username", func(j *model.Job) { j.Submitter = ".hidden" }},
+		{"name", func(j *model.Job) { j.Name = "" }},
+		{"name", func(j *model.Job) { j.Name = "../../etc" }},
+		{"name", func(j *model.Job) { j.Name = "a/b" }},
+		{"name", func(j *model.Job) { j.Name = ".." }},
+		{"name", func(j *model.Job) { j.Name = ".analysis" }},
+		{"execution_target", func(j *model.Job) { j.ExecutionTarget = "kubernetes" }},
+		{"steps", func(j *model.Job) { j.Steps = nil }},
+		{"output_dir", func(j *model.Job) { j.OutputDir = "relative/path" }},
+		{"steps[0].component.container.image.name", func(j *model.Job) { j.Steps[0].Component.Container.Image.Name = "" }},
+		{"steps[0].component.container.image.name", func(j *model.Job) { j.Steps[0].Component.Container.Image.Name = "Bad Image" }},
+		{"steps[0].component.container.image.tag", func(j *model.Job) { j.Steps[0].Component.Container.Image.Tag = "-latest" }},
+		{"steps[0].component.container.min_cpu_cores", func(j *model.Job) { j.Steps[0].Component.Container.MinCPUCores = -1 }},
+		{"steps[0].component.container.min_cpu_cores", func(j *model.Job) {
+			j.Steps[0].Component.Container.MinCPUCores = 4
+			j.Steps[0].Component.Container.MaxCPUCores = 2
+		}},
+		{"steps[0].component.container.min_memory_limit", func(j *model.Job) { j.Steps[0].Component.Container.MinMemoryLimit = 4096 }},
+		{"steps[0].component.container.min_disk_space", func(j *model.Job) { j.Steps[0].Component.Container.MinDiskSpace = -1 }},
+		{"steps[0].component.time_limit_seconds", func(j *model.Job) { j.Steps[0].Component.TimeLimit = -1 }},
+		{"steps[0].config.input[0].value", func(j *model.Job) { j.Steps[0].Config.Inputs[0].Value = "/iplant/home/../secret" }},
+		{"steps[0].config.output[0].name", func(j *model.Job) { j.Steps[0].Config.Outputs[0].Name = "../escape" }},
+		{"steps[0].component.container.image.osg_image_path", func(j *model.Job) { j.ExecutionTarget = "osg" }},
+		{"steps[0].config.input[0].ticket", func(j *model.Job) { j.ExecutionTarget = "osg" }},
+		{"output_dir_ticket", func(j *model.Job) { j.ExecutionTarget = "osg" }},
+		{"steps", func(j *model.Job) {
+			j.ExecutionTarget = "osg"
+			j.Steps = append(j.Steps, j.Steps[0])
+		}},
+		{"group", func(j *model.Job) { j.Group = "de\nqueue" }},
+		{"username", func(j *model.Job) { j.Submitter = "test\rqueue" }},
+		{"username", func(j *model.Job) { j.Submitter = `test" +Evil = "yes` }},
+		{"user_groups[0]", func(j *model.Job) { j.UserGroups = []string{"a\u2028b"} }},
+		{"steps[0].component.name", func(j *model.Job) { j.Steps[0].Component.Name = "wc\nqueue" }},
+		{"steps[0].component.location", func(j *model.Job) { j.Steps[0].Component.Location = "/usr/bin\x00" }},
+		{"extra.htcondor.extra_requirements", func(j *model.Job) { j.Extra.HTCondor.ExtraRequirements = "true\nqueue" }},
+		{"extra.htcondor.extra_requirements", func(j *model.Job) { j.Extra.HTCondor.ExtraRequirements = "true) || (false" }},
+	}
+	for _, c := range cases {
+		j := loadTestJob(t, "test/test_submission.json")
+		c.modify(j)
+		err := validateJob(j)
+		if err == nil {
+			t.Errorf("the invalid %s field was accepted", c.field)
+			continue
+		}
+		if !reportedFields(t, err)[c.field] {
+			t.Errorf("the %s field wasn't reported: %s", c.field, err)
+		}
+	}
+}
+
+func TestValidateJobReportsEveryProblem(t *testing.T) {
+	j := loadTestJob(t, "test/test_submission.json")
+	j.Submitter = ""
+	j.Steps[0].Component.Container.Image.Name = ""
+	j.Steps[0].Component.Container.MinDiskSpace = -1
+
+	fields := reportedFields(t, validateJob(j))
+	if len(fields) != 3 {
+		t.Errorf("%d problems were reported instead of 3: %v", len(fields), fields)
+	}
+}
+
+func TestHandleLaunchRequestsInvalidJob(t *testing.T) {
+	cfg := test.InitConfig(t)
+	scheduler := newtscheduler()
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), scheduler)
+
+	j := test.InitTests(t, cfg)
+	j.Steps = nil
+	j.Submitter = ""
+
+	delivery, ack := launchDelivery(t, j)
+	cl.handleLaunchRequests()(delivery)
+
+	if len(scheduler.submitted) != 0 {
+		t.Errorf("the invalid job was submitted: %v", scheduler.submitted)
+	}
+	if !ack.acked {
+		t.Error("the launch request was not acknowledged")
+	}
+	if _, err := os.Stat(path.Join(j.CondorLogPath, "test_this_is_a_test")); !os.IsNotExist(err) {
+		t.Error("the submission directory was created for the invalid job")
+	}
+	if len(client.updates) != 1 {
+		t.Fatalf("%d updates were published instead of 1", len(client.updates))
+	}
+	u := client.updates[0]
+	if u.State != messaging.FailedState {
+		t.Errorf("a %s update was published instead of a Failed one", u.State)
+	}
+	for _, field := range []string{"steps", "username"} {
+		if !strings.Contains(u.Message, "the "+field+" field") {
+			t.Errorf("the update doesn't mention the %s field: %q", field, u.Message)
+		}
+	}
+}
+
+func TestHandleLaunchRequestsMissingJob(t *testing.T) {
+	cfg := test.InitConfig(t)
+	client := newtmessenger()
+	cl := New(cfg, client, newtsys(), newtscheduler())
+
+	delivery, ack := jsonDelivery(t, &messaging.JobRequest{Command: messaging.Launch})
+	cl.handleLaunchRequests()(delivery)
+
+	if !ack.rejected {
+		t.Error("a launch request without a job was not rejected")
+	}
+	if len(client.updates) != 0 {
+		t.Errorf("updates were published for a launch request without a job: %#v", client.updates)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// DirWatcher calls a function whenever anything in a directory changes.
+// Directories are watched rather than files because files are usually
+// replaced rather than rewritten, and mounted Kubernetes ConfigMaps are
+// updated by swapping a symlink.
+type DirWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// WatchDir starts calling onChange whenever anything in dir changes. The calls
+// are made one at a time from a single goroutine.
+func WatchDir(dir string, onChange func()) (*DirWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create a watcher for %s", dir)
+	}
+	if err = watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, errors.Wrapf(err, "failed to watch %s", dir)
+	}
+
+	w := &DirWatcher{watcher: watcher, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("%+v\n", errors.Wrapf(err, "error watching %s", dir))
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Stop stops watching the directory and waits for any call to onChange that's
+// in progress.
+func (w *DirWatcher) Stop() {
+	w.watcher.Close()
+	<-w.done
+}